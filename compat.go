@@ -0,0 +1,253 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strings"
+)
+
+// Compatible returns whether the formats a and b have identical field
+// layouts, with the same field names, offsets, sizes and signedness in
+// the same order. If they are not compatible, the differences between
+// the formats are described in diffs. The names and IDs of the formats
+// are not compared. Fields that differ only in their signedness are not
+// compatible, since values of the field would be silently misinterpreted
+// if decoded according to the other format; the signedness of the fields
+// of a format may be audited with SignednessMap.
+func Compatible(a, b *Format) (ok bool, diffs []string) {
+	n := len(a.Fields)
+	if len(b.Fields) < n {
+		n = len(b.Fields)
+	}
+	for i, fa := range a.Fields[:n] {
+		fb := b.Fields[i]
+		if fa.Name != fb.Name {
+			diffs = append(diffs, fmt.Sprintf("field %d: name %s != %s", i, fa.Name, fb.Name))
+		}
+		if fa.Offset != fb.Offset {
+			diffs = append(diffs, fmt.Sprintf("field %d (%s): offset %d != %d", i, fa.Name, fa.Offset, fb.Offset))
+		}
+		if fa.Size != fb.Size {
+			diffs = append(diffs, fmt.Sprintf("field %d (%s): size %d != %d", i, fa.Name, fa.Size, fb.Size))
+		}
+		if fa.Signed != fb.Signed {
+			diffs = append(diffs, fmt.Sprintf("field %d (%s): signed %t != %t", i, fa.Name, fa.Signed, fb.Signed))
+		}
+	}
+	for i, f := range a.Fields[n:] {
+		diffs = append(diffs, fmt.Sprintf("field %d (%s): missing from second format", n+i, f.Name))
+	}
+	for i, f := range b.Fields[n:] {
+		diffs = append(diffs, fmt.Sprintf("field %d (%s): missing from first format", n+i, f.Name))
+	}
+	return len(diffs) == 0, diffs
+}
+
+// SignednessMap returns a map from the C names of the fields of f to whether
+// the field is signed according to the format.
+func (f *Format) SignednessMap() map[string]bool {
+	m := make(map[string]bool, len(f.Fields))
+	for _, field := range f.Fields {
+		m[field.Name] = field.Signed
+	}
+	return m
+}
+
+// Fingerprint returns a hash of the field layout of f, covering the name, C
+// type, offset, size and signedness of each field in order. The name and ID
+// of the event are not included, so formats that are compatible according
+// to Compatible and have the same C types have the same fingerprint. The
+// hash is not cryptographic and must not be used to protect against
+// maliciously constructed formats.
+func (f *Format) Fingerprint() uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, field := range f.Fields {
+		h.Write([]byte(field.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(field.CType))
+		h.Write([]byte{0})
+		for _, v := range []int{field.Offset, field.Size, b2i(field.Signed)} {
+			binary.LittleEndian.PutUint64(buf[:], uint64(v))
+			h.Write(buf[:])
+		}
+	}
+	return h.Sum64()
+}
+
+// LayoutError is returned by ValidateLayout when a Go type does not match
+// the layout of a kprobe event format.
+type LayoutError struct {
+	Type   reflect.Type // Type is the Go type that was checked.
+	Format string       // Format is the name of the event format.
+
+	// Mismatches describes each difference between
+	// the Go type and the event format.
+	Mismatches []string
+}
+
+func (e *LayoutError) Error() string {
+	return fmt.Sprintf("type %s does not match layout of %s: %s", e.Type, e.Format, strings.Join(e.Mismatches, "; "))
+}
+
+// ValidateLayout checks that typ, a struct type, may be used with
+// encoding/binary's Read function to decode event records described by f.
+// Field offsets of typ are determined as they are by encoding/binary, so
+// padding must be made explicit with blank fields, and nested structs are
+// flattened. Each non-empty field of f must correspond to a field of typ at
+// the same offset with the same size. Integer fields must have the signedness
+// of the format's field, except for char arrays which may be either signed
+// or unsigned, and bool fields may be represented by bool or uint8. Array
+// fields must be represented by Go arrays with the same number of elements,
+// and dynamic array locators by 4 byte integers. If typ does not match f,
+// the returned error is a *LayoutError describing each mismatch.
+func ValidateLayout(typ reflect.Type, f *Format) error {
+	if typ.Kind() != reflect.Struct {
+		return fmt.Errorf("invalid type for %s: %s is not a struct", f.Name, typ)
+	}
+	size := binary.Size(reflect.Zero(typ).Interface())
+	if size < 0 {
+		return fmt.Errorf("invalid type for %s: %s is not a fixed size type", f.Name, typ)
+	}
+	fields := binaryFields(typ, "", 0, nil)
+	byOffset := make(map[int]binaryField)
+	for _, bf := range fields {
+		byOffset[bf.offset] = bf
+	}
+
+	var mismatches []string
+	used := make(map[int]bool)
+	for _, field := range f.Fields {
+		if field.Size == 0 {
+			continue
+		}
+		bf, ok := byOffset[field.Offset]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("field %s: no field at offset %d", field.Name, field.Offset))
+			continue
+		}
+		used[bf.offset] = true
+		if n := binary.Size(reflect.Zero(bf.typ).Interface()); n != field.Size {
+			mismatches = append(mismatches, fmt.Sprintf("field %s (%s): size %d != %d", bf.name, field.Name, n, field.Size))
+			continue
+		}
+		if msg := kindMismatch(bf.typ, field); msg != "" {
+			mismatches = append(mismatches, fmt.Sprintf("field %s (%s): %s", bf.name, field.Name, msg))
+		}
+	}
+	for _, bf := range fields {
+		if !used[bf.offset] {
+			mismatches = append(mismatches, fmt.Sprintf("field %s: offset %d does not match a field", bf.name, bf.offset))
+		}
+	}
+	if size > f.Size {
+		mismatches = append(mismatches, fmt.Sprintf("size %d exceeds record size %d", size, f.Size))
+	}
+	if len(mismatches) != 0 {
+		return &LayoutError{Type: typ, Format: f.Name, Mismatches: mismatches}
+	}
+	return nil
+}
+
+// binaryField is a non-blank field of a struct with its offset as
+// determined by encoding/binary.
+type binaryField struct {
+	name   string
+	offset int
+	typ    reflect.Type
+}
+
+// binaryFields returns the flattened non-blank fields of the struct type typ
+// appended to dst. The offsets of the fields are relative to base and names
+// are prefixed with prefix.
+func binaryFields(typ reflect.Type, prefix string, base int, dst []binaryField) []binaryField {
+	off := base
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		switch {
+		case sf.Name == "_", sf.Tag.Get("pad") != "":
+		case sf.Type.Kind() == reflect.Struct:
+			dst = binaryFields(sf.Type, prefix+sf.Name+".", off, dst)
+		default:
+			dst = append(dst, binaryField{name: prefix + sf.Name, offset: off, typ: sf.Type})
+		}
+		off += binary.Size(reflect.Zero(sf.Type).Interface())
+	}
+	return dst
+}
+
+// kindMismatch returns a description of the difference between the kind of
+// typ and the type of the format field, or the empty string if typ is
+// consistent with field.
+func kindMismatch(typ reflect.Type, field Field) string {
+	if _, ok := dynamicElement(field.CType); ok {
+		switch typ.Kind() {
+		case reflect.Uint32, reflect.Int32:
+			return ""
+		}
+		return fmt.Sprintf("%s is not a dynamic array locator", typ)
+	}
+	n, _, err := arraySize(field.CType)
+	if err != nil {
+		return err.Error()
+	}
+	elem := typ
+	if typ.Kind() == reflect.Array {
+		if n == 1 {
+			return fmt.Sprintf("%s is not a scalar", typ)
+		}
+		if typ.Len() != n {
+			return fmt.Sprintf("array length %d != %d", typ.Len(), n)
+		}
+		elem = typ.Elem()
+	} else if n != 1 {
+		return fmt.Sprintf("%s is not an array of length %d", typ, n)
+	}
+	base := baseType(field.CType)
+	switch {
+	case base == "bool" && (elem.Kind() == reflect.Bool || elem.Kind() == reflect.Uint8):
+		return ""
+	case base == "char" && n > 1 && (isSignedKind(elem.Kind()) || isUnsignedKind(elem.Kind())):
+		return ""
+	case field.Signed && isSignedKind(elem.Kind()), !field.Signed && isUnsignedKind(elem.Kind()):
+		return ""
+	}
+	return fmt.Sprintf("kind %s inconsistent with signed %t", elem.Kind(), field.Signed)
+}
+
+// isSignedKind returns whether k is a signed integer kind.
+func isSignedKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+// isUnsignedKind returns whether k is an unsigned integer kind.
+func isUnsignedKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// WithID returns a shallow copy of f with its ID set to id. Event IDs may
+// change when a probe is recreated or the system is rebooted while the
+// layout of the event is unchanged, as may be detected by comparing the
+// Fingerprint of a newly read format with that of f. WithID allows the new
+// ID to be used without reparsing the format. The returned Format shares
+// its struct types, fields and other reference values with f, so neither
+// should be modified.
+func (f *Format) WithID(id uint16) *Format {
+	c := *f
+	c.ID = id
+	return &c
+}
@@ -0,0 +1,264 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompatible(t *testing.T) {
+	parse := func(format string) *Format {
+		t.Helper()
+		f, err := ParseFormat(strings.NewReader(format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		return f
+	}
+	scalar := parse(formatTests[0].format)
+	array := parse(formatTests[1].format)
+
+	tests := []struct {
+		name      string
+		a, b      *Format
+		wantOK    bool
+		wantDiffs []string
+	}{
+		{name: "same", a: scalar, b: parse(formatTests[0].format), wantOK: true},
+		{
+			name: "flags array",
+			a:    scalar, b: array,
+			wantDiffs: []string{
+				"field 8 (flags): size 4 != 8",
+				"field 9 (mode): offset 32 != 36",
+			},
+		},
+		{
+			name: "truncated",
+			a:    scalar, b: parse(formatTests[0].format[:strings.Index(formatTests[0].format, "\tfield:unsigned long flags;")]),
+			wantDiffs: []string{
+				"field 8 (flags): missing from second format",
+				"field 9 (mode): missing from second format",
+			},
+		},
+		{
+			name: "renamed and resigned",
+			a:    scalar, b: parse(strings.Replace(formatTests[0].format, "field:int __probe_nargs;\toffset:16;\tsize:4;\tsigned:1;", "field:unsigned int nargs;\toffset:16;\tsize:4;\tsigned:0;", 1)),
+			wantDiffs: []string{
+				"field 5: name __probe_nargs != nargs",
+				"field 5 (__probe_nargs): signed true != false",
+			},
+		},
+	}
+	for _, test := range tests {
+		ok, diffs := Compatible(test.a, test.b)
+		if ok != test.wantOK {
+			t.Errorf("unexpected compatibility for %s: got:%t want:%t", test.name, ok, test.wantOK)
+		}
+		if !reflect.DeepEqual(diffs, test.wantDiffs) {
+			t.Errorf("unexpected differences for %s:\ngot: %q\nwant:%q", test.name, diffs, test.wantDiffs)
+		}
+	}
+}
+
+func TestSignednessMap(t *testing.T) {
+	a, err := ParseFormat(strings.NewReader(formatTests[0].format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	b, err := ParseFormat(strings.NewReader(strings.Replace(formatTests[0].format,
+		"field:int __probe_nargs;\toffset:16;\tsize:4;\tsigned:1;",
+		"field:int __probe_nargs;\toffset:16;\tsize:4;\tsigned:0;", 1)))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+
+	ok, diffs := Compatible(a, b)
+	if ok {
+		t.Error("unexpected compatibility for formats differing in signedness")
+	}
+	wantDiffs := []string{"field 5 (__probe_nargs): signed true != false"}
+	if !reflect.DeepEqual(diffs, wantDiffs) {
+		t.Errorf("unexpected differences:\ngot: %q\nwant:%q", diffs, wantDiffs)
+	}
+
+	sa := a.SignednessMap()
+	sb := b.SignednessMap()
+	if len(sa) != len(a.Fields) || len(sb) != len(b.Fields) {
+		t.Fatalf("unexpected signedness map lengths: %d and %d", len(sa), len(sb))
+	}
+	var changed []string
+	for name, signed := range sa {
+		if sb[name] != signed {
+			changed = append(changed, name)
+		}
+	}
+	if !reflect.DeepEqual(changed, []string{"__probe_nargs"}) {
+		t.Errorf("unexpected changed fields: %q", changed)
+	}
+	if !sa["common_pid"] || sa["common_type"] {
+		t.Errorf("unexpected common field signedness: %v", sa)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	const format = `name: fingerprint
+ID: 7029
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:void * argv[2];	offset:8;	size:16;	signed:0;
+	field:u32 argc;	offset:24;	size:4;	signed:0;
+
+print fmt: "argc=%u", REC->argc
+`
+	fingerprint := func(format string) uint64 {
+		t.Helper()
+		f, err := ParseFormat(strings.NewReader(format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		return f.Fingerprint()
+	}
+	want := fingerprint(format)
+
+	same := []string{
+		strings.Replace(format, "ID: 7029", "ID: 812", 1),
+		strings.Replace(format, "name: fingerprint", "name: renamed", 1),
+		strings.Replace(format, "void * argv", "void *argv", 1),
+		strings.Replace(format, "\n\n", "\n", -1),
+		strings.Replace(format, "print fmt: \"argc=%u\", REC->argc", "print fmt: \"%u\", REC->argc", 1),
+	}
+	for i, f := range same {
+		if got := fingerprint(f); got != want {
+			t.Errorf("unexpected fingerprint for variant %d: got:%#x want:%#x", i, got, want)
+		}
+	}
+
+	different := []string{
+		strings.Replace(format, "u32 argc", "u32 count", 1),
+		strings.Replace(format, "u32 argc;\toffset:24;\tsize:4;\tsigned:0;", "u32 argc;\toffset:24;\tsize:4;\tsigned:1;", 1),
+		strings.Replace(format, "u32 argc;\toffset:24", "u32 argc;\toffset:28", 1),
+		strings.Replace(format, "u32 argc", "int argc", 1),
+	}
+	for i, f := range different {
+		if got := fingerprint(f); got == want {
+			t.Errorf("unexpected matching fingerprint for variant %d: %#x", i, got)
+		}
+	}
+}
+
+func TestWithID(t *testing.T) {
+	f, err := ParseFormat(strings.NewReader(unpackTests[1].format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	g := f.WithID(812)
+	if g == f {
+		t.Fatal("WithID returned the original format")
+	}
+	if g.ID != 812 {
+		t.Errorf("unexpected ID: got:%d want:812", g.ID)
+	}
+	if f.ID != 2034 {
+		t.Errorf("original ID modified: got:%d want:2034", f.ID)
+	}
+	if g.Name != f.Name {
+		t.Errorf("unexpected name: got:%q want:%q", g.Name, f.Name)
+	}
+	if g.Type != f.Type || g.Unpacked != f.Unpacked {
+		t.Error("struct types not shared after WithID")
+	}
+	if &g.Fields[0] != &f.Fields[0] {
+		t.Error("fields not shared after WithID")
+	}
+	if g.Fingerprint() != f.Fingerprint() {
+		t.Error("unexpected fingerprint change after WithID")
+	}
+}
+
+func TestValidateLayout(t *testing.T) {
+	f, err := ParseFormat(strings.NewReader(formatTests[0].format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+
+	type myprobe struct {
+		CommonFields
+		_        [4]byte
+		ProbeIP  uint32
+		Nargs    int32
+		Dfd      uint32
+		Filename uint32
+		Flags    uint32
+		Mode     uint32
+	}
+	err = ValidateLayout(reflect.TypeOf(myprobe{}), f)
+	if err != nil {
+		t.Errorf("unexpected error for valid type: %v", err)
+	}
+
+	data := make([]byte, f.Size)
+	binary.LittleEndian.PutUint32(data[16:], 0xffffffff)
+	binary.LittleEndian.PutUint32(data[32:], 0644)
+	var v myprobe
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &v)
+	if err != nil {
+		t.Fatalf("unexpected error reading data: %v", err)
+	}
+	if v.Nargs != -1 || v.Mode != 0644 {
+		t.Errorf("unexpected decoded values: nargs=%d mode=%o", v.Nargs, v.Mode)
+	}
+
+	type wrong struct {
+		CommonFields
+		_        [4]byte
+		ProbeIP  uint32
+		Nargs    uint32
+		Dfd      uint32
+		Filename uint32
+		Flags    [2]uint16
+		Mode     uint64
+	}
+	err = ValidateLayout(reflect.TypeOf(wrong{}), f)
+	var lerr *LayoutError
+	if !errors.As(err, &lerr) {
+		t.Fatalf("unexpected error for invalid type: %v", err)
+	}
+	want := []string{
+		"field Nargs (__probe_nargs): kind uint32 inconsistent with signed true",
+		"field Flags (flags): [2]uint16 is not a scalar",
+		"field Mode (mode): size 8 != 4",
+		"size 40 exceeds record size 36",
+	}
+	if !reflect.DeepEqual(lerr.Mismatches, want) {
+		t.Errorf("unexpected mismatches:\ngot: %q\nwant:%q", lerr.Mismatches, want)
+	}
+
+	type unpadded struct {
+		CommonFields
+		ProbeIP uint32
+	}
+	err = ValidateLayout(reflect.TypeOf(unpadded{}), f)
+	if !errors.As(err, &lerr) {
+		t.Fatalf("unexpected error for unpadded type: %v", err)
+	}
+	if len(lerr.Mismatches) == 0 || lerr.Mismatches[0] != "field __probe_ip: no field at offset 12" {
+		t.Errorf("unexpected mismatches for unpadded type: %q", lerr.Mismatches)
+	}
+
+	err = ValidateLayout(reflect.TypeOf(struct{ P uintptr }{}), f)
+	if err == nil {
+		t.Error("expected error for type without fixed size")
+	}
+}
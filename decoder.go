@@ -0,0 +1,156 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Decoder decodes event records of a Format into maps or user-defined
+// structs, applying conversions bound to individual fields.
+type Decoder struct {
+	format *Format
+	opts   []Option
+	binds  map[string]func([]byte) (interface{}, error)
+}
+
+// NewDecoder returns a new Decoder for events of f. The provided options
+// are used when unpacking events.
+func NewDecoder(f *Format, opts ...Option) *Decoder {
+	return &Decoder{format: f, opts: opts}
+}
+
+// BindType binds the conversion function, conv, to the field of the format
+// with the C name, field. When an event is decoded, conv is called with the
+// raw bytes of the field in the event record, or with the bytes of the data
+// of a dynamic array field, and its result is used as the value of the field.
+// The bytes passed to conv alias the event data and must not be retained.
+// Fields omitted from the format's struct types by the AllowOverlap option
+// may be bound. BindType returns an error if the format has no field with
+// the given name.
+func (d *Decoder) BindType(field string, conv func([]byte) (interface{}, error)) error {
+	if _, ok := d.format.FieldByName(field); !ok {
+		return fmt.Errorf("no field %s in format for %s", field, d.format.Name)
+	}
+	if d.binds == nil {
+		d.binds = make(map[string]func([]byte) (interface{}, error))
+	}
+	d.binds[field] = conv
+	return nil
+}
+
+// Decode decodes the event record in data into a map of field values keyed
+// by the C names of the fields. Fields with a bound conversion hold the
+// result of the conversion, and other fields hold their unpacked value as
+// described for Format.Unpack. Unbound fields that are not represented in
+// the format's struct types are not included.
+func (d *Decoder) Decode(data []byte) (map[string]interface{}, error) {
+	cfg, err := newConfig(d.opts)
+	if err != nil {
+		return nil, err
+	}
+	f := d.format
+	v := reflect.New(f.Unpacked)
+	err = f.unpack(v, data, cfg)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, len(f.Fields))
+	for _, field := range f.Fields {
+		conv, ok := d.binds[field.Name]
+		if !ok {
+			if field.Index != nil {
+				m[field.Name] = v.Elem().FieldByIndex(field.Index).Interface()
+			}
+			continue
+		}
+		raw, err := boundBytes(field, data, v.Elem(), cfg)
+		if err != nil {
+			return nil, err
+		}
+		val, err := conv(raw)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		m[field.Name] = val
+	}
+	return m, nil
+}
+
+// boundBytes returns the bytes of field in the event record data to be passed
+// to a bound conversion. The value v is the event unpacked from data, and is
+// used to obtain the length of dynamic arrays with a length field set by the
+// WithLengthField option.
+func boundBytes(field Field, data []byte, v reflect.Value, cfg *config) ([]byte, error) {
+	if field.Offset+field.Size > len(data) {
+		return nil, &DataError{Len: field.Offset + field.Size, Size: len(data)}
+	}
+	raw := data[field.Offset : field.Offset+field.Size]
+	elem, ok := dynamicElement(field.CType)
+	if !ok || field.Size != 4 {
+		return raw, nil
+	}
+	off, n := dynamicLocation(field.CType, cfg.byteOrder().Uint32(raw), field.Offset)
+	if length, ok := cfg.lengths[field.Name]; ok {
+		class, ok := dynamicClass(elem)
+		if !ok {
+			return nil, fmt.Errorf("unsupported dynamic array element type: %s", elem)
+		}
+		l, err := lengthFieldValue(v, length, machine)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		n = l * class.size
+	}
+	if off < 0 || off+n > len(data) {
+		return nil, &DataError{Field: field.Name, Offset: off, Len: n, Size: len(data)}
+	}
+	return data[off : off+n], nil
+}
+
+// DecodeStruct decodes the event record in data into the struct pointed to
+// by dst. Fields of dst are matched to the fields of the format by the C
+// name given in their name field tag, and are set to the values that would
+// be returned by Decode. Values must be assignable or convertible to the
+// type of the matching field of dst, so for example a dynamic char array
+// may be decoded into a string field, but integers are not converted to
+// strings. Fields of dst without a matching field in the format are left
+// unchanged.
+func (d *Decoder) DecodeStruct(dst interface{}, data []byte) error {
+	v := reflect.ValueOf(dst)
+	if !isStructPointer(v) {
+		return fmt.Errorf("invalid type: %T", dst)
+	}
+	m, err := d.Decode(data)
+	if err != nil {
+		return err
+	}
+	v = v.Elem()
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		name, ok := typ.Field(i).Tag.Lookup("name")
+		if !ok || !typ.Field(i).IsExported() {
+			continue
+		}
+		val, ok := m[name]
+		if !ok {
+			continue
+		}
+		src := reflect.ValueOf(val)
+		dstField := v.Field(i)
+		switch {
+		case !src.IsValid():
+			dstField.Set(reflect.Zero(dstField.Type()))
+		case src.Type().AssignableTo(dstField.Type()):
+			dstField.Set(src)
+		case src.Type().ConvertibleTo(dstField.Type()) && !(dstField.Kind() == reflect.String && isInteger(src.Type())):
+			dstField.Set(src.Convert(dstField.Type()))
+		default:
+			return fmt.Errorf("cannot set field %s of type %s from %s", typ.Field(i).Name, dstField.Type(), src.Type())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// openFlags is a custom representation of do_sys_open flags.
+type openFlags struct {
+	Access string
+	Create bool
+	Other  uint32
+}
+
+func decodeOpenFlags(b []byte) (interface{}, error) {
+	if len(b) != 4 {
+		return nil, fmt.Errorf("invalid flags length: %d", len(b))
+	}
+	v := binary.LittleEndian.Uint32(b)
+	f := openFlags{
+		Access: [...]string{"O_RDONLY", "O_WRONLY", "O_RDWR", "O_ACCMODE"}[v&0x3],
+		Create: v&0x40 != 0,
+		Other:  v &^ 0x43,
+	}
+	return f, nil
+}
+
+func TestDecoder(t *testing.T) {
+	test := unpackTests[0]
+	f, err := ParseFormat(strings.NewReader(test.format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	d := NewDecoder(f)
+	err = d.BindType("flags", decodeOpenFlags)
+	if err != nil {
+		t.Fatalf("unexpected error binding flags: %v", err)
+	}
+	err = d.BindType("filename", func(b []byte) (interface{}, error) {
+		return strings.TrimRight(string(b), "\x00"), nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error binding filename: %v", err)
+	}
+	err = d.BindType("missing", decodeOpenFlags)
+	if err == nil {
+		t.Error("expected error binding missing field")
+	}
+
+	wantFlags := openFlags{Access: "O_WRONLY", Create: true, Other: 0x88200}
+	got, err := d.Decode(test.data)
+	if err != nil {
+		t.Fatalf("unexpected error decoding: %v", err)
+	}
+	want := map[string]interface{}{
+		"common_type":          uint16(0x1bb2),
+		"common_flags":         uint8(0),
+		"common_preempt_count": uint8(0),
+		"common_pid":           int32(32705),
+		"__probe_ip":           uint64(0xffffffffae6da1f0),
+		"dfd":                  uint32(0xae6da530),
+		"filename":             "file.text",
+		"flags":                wantFlags,
+		"mode":                 uint32(0x1a4),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected decoded map:\ngot: %#v\nwant:%#v", got, want)
+	}
+
+	var event struct {
+		PID      int64     `name:"common_pid"`
+		Filename string    `name:"filename"`
+		Flags    openFlags `name:"flags"`
+		Mode     uint16    `name:"mode"`
+		Other    int       `name:"other"`
+		Ignored  int
+	}
+	err = d.DecodeStruct(&event, test.data)
+	if err != nil {
+		t.Fatalf("unexpected error decoding struct: %v", err)
+	}
+	if event.PID != 32705 || event.Filename != "file.text" || event.Flags != wantFlags || event.Mode != 0x1a4 {
+		t.Errorf("unexpected decoded struct: %+v", event)
+	}
+
+	var bad struct {
+		Flags uint32 `name:"flags"`
+	}
+	err = d.DecodeStruct(&bad, test.data)
+	if err == nil {
+		t.Error("expected error decoding bound field into incompatible type")
+	}
+
+	failing := errors.New("failed")
+	err = d.BindType("mode", func([]byte) (interface{}, error) { return nil, failing })
+	if err != nil {
+		t.Fatalf("unexpected error binding mode: %v", err)
+	}
+	_, err = d.Decode(test.data)
+	if !errors.Is(err, failing) {
+		t.Errorf("unexpected error for failing conversion: %v", err)
+	}
+}
+
+func TestDecoderLengthField(t *testing.T) {
+	var format string
+	for _, test := range formatTests {
+		if test.name == "ath10k_htt_stats" {
+			format = test.format
+			break
+		}
+	}
+	if format == "" {
+		t.Fatal("missing ath10k_htt_stats format")
+	}
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+
+	data := make([]byte, 40)
+	machine.PutUint32(data[8:], 4<<16|28)
+	machine.PutUint32(data[12:], 4<<16|32)
+	machine.PutUint64(data[16:], 3)
+	// The length in the locator for buf extends beyond the data.
+	machine.PutUint32(data[24:], 0xff<<16|36)
+	copy(data[28:], "dev\x00drv\x00\x01\x02\x03")
+
+	d := NewDecoder(f, WithLengthField("buf", "buf_len"))
+	err = d.BindType("buf", func(b []byte) (interface{}, error) {
+		return append([]byte(nil), b...), nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error binding type: %v", err)
+	}
+	m, err := d.Decode(data)
+	if err != nil {
+		t.Fatalf("unexpected error decoding: %v", err)
+	}
+	if got, want := m["buf"], []byte{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected buf: got:%v want:%v", got, want)
+	}
+
+	// Without the length field the locator length is used
+	// and is checked against the data.
+	d = NewDecoder(f)
+	err = d.BindType("buf", func(b []byte) (interface{}, error) {
+		return append([]byte(nil), b...), nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error binding type: %v", err)
+	}
+	_, err = d.Decode(data)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("unexpected error for out of range locator: got:%v want:%v", err, io.ErrUnexpectedEOF)
+	}
+}
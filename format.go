@@ -0,0 +1,1064 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Format is a parsed kprobe event format.
+type Format struct {
+	// Name and ID are the name and ID of the event.
+	Name string
+	ID   uint16
+
+	// Order is the byte order used by the decoding methods of
+	// the Format in the way described for the ByteOrder option.
+	// It is set by the ByteOrder option when the format is
+	// parsed and defaults to the host byte order. A nil Order
+	// is treated as the host byte order.
+	Order binary.ByteOrder
+
+	// Header holds any key: value lines other than name and
+	// ID that precede the format: line, such as the system:
+	// lines added by some exporters. Comment lines starting
+	// with # are not included. Header is nil if there are no
+	// such lines.
+	Header map[string]string
+
+	// Type is the packed struct type corresponding to the event
+	// format, as returned by Struct, and Unpacked is the unpacked
+	// struct type corresponding to Type, as returned by
+	// UnpackedStructFor.
+	Type     reflect.Type
+	Unpacked reflect.Type
+
+	// Size is the size of the fixed portion of an event record.
+	// It is the end of the final field unless a larger total
+	// record size is given by the RecordSize option.
+	// GoSize is the size of Type as reported by reflect, which
+	// may be larger than Size if the final field is followed by
+	// padding to satisfy the alignment of Type.
+	Size   int
+	GoSize int
+
+	// Fields holds the fields of the event in declaration order.
+	Fields []Field
+
+	// Unaligned describes the unaligned fields and dynamic arrays
+	// in Type. It is the zero value if no unpacking is required.
+	Unaligned UnalignedFieldsError
+
+	// Warnings lists the fields of Type that require unpacking.
+	// It holds the same information as Unaligned in a form that
+	// can be inspected per field.
+	Warnings []Warning
+
+	// PrintFmt is the text of the format's print fmt.
+	PrintFmt string
+
+	// PrintFields holds the C names of the fields referred to
+	// by the arguments of the print fmt, in the order in which
+	// they are first referenced. Fields that are not displayed
+	// by the print fmt are not included.
+	PrintFields []string
+
+	print *printFormat // print is the parsed PrintFmt if valid.
+
+	// radix maps the C names of fields printed directly
+	// by a hexadecimal or octal conversion of the print
+	// fmt to the conversion.
+	radix map[string]conversion
+
+	// widened is whether aligned fields of Type are
+	// widened in Unpacked by the WidenLongs option.
+	widened bool
+
+	// overlaps is whether fields of the format were
+	// omitted from Type because they overlap preceding
+	// fields. See AllowOverlap.
+	overlaps bool
+
+	// bools is whether Type has aligned bool fields,
+	// which may hold bytes other than 0 and 1 in event
+	// data and so must be unpacked.
+	bools bool
+
+	// byName maps the C names of fields to their index
+	// in Fields. It is nil if the format was not parsed
+	// or constructed by NewFormat.
+	byName map[string]int
+}
+
+// Field describes a field of a kprobe event format.
+type Field struct {
+	Name   string // Name is the C field name.
+	CType  string // CType is the C type of the field.
+	Offset int    // Offset is the byte offset of the field in an event record.
+	Size   int    // Size is the size of the field in bytes.
+	Signed bool   // Signed indicates the C type is signed.
+
+	// Type is the Go type of the field in the Format's Type.
+	// It is a byte array if the field is unaligned.
+	Type reflect.Type
+
+	// Elem is the Go type of the elements of the slice that a
+	// dynamic array field is unpacked into, such as uint8 for a
+	// __data_loc u8[] field. It is nil for other fields and for
+	// dynamic arrays with an unsupported element type.
+	Elem reflect.Type
+
+	// Index is the index sequence of the field in the Format's
+	// Type and Unpacked struct types for use with FieldByIndex.
+	// It is nil for fields omitted because they overlap a
+	// preceding field. See AllowOverlap.
+	Index []int
+
+	// Label is the display label of the field used by the
+	// print fmt, such as size for a field printed by size=%u.
+	// It is empty if the print fmt does not label the field.
+	Label string
+
+	// Symbols holds the symbolic names for values of the field
+	// given by a __print_symbolic mapping in the print fmt.
+	Symbols []Symbol
+
+	// Flags and FlagDelim hold the names of bit flags of the
+	// field and their delimiter given by a __print_flags mapping
+	// in the print fmt.
+	Flags     []Symbol
+	FlagDelim string
+}
+
+// CommonFields is the standard header common to kprobe and tracepoint
+// events. It is embedded in struct types constructed with the
+// EmbedCommonFields option and is returned by Format.Common.
+type CommonFields struct {
+	Common_type          uint16 `ctyp:"unsigned short" name:"common_type"`
+	Common_flags         uint8  `ctyp:"unsigned char" name:"common_flags"`
+	Common_preempt_count uint8  `ctyp:"unsigned char" name:"common_preempt_count"`
+	Common_pid           int32  `ctyp:"int" name:"common_pid"`
+}
+
+var commonFieldsType = reflect.TypeOf(CommonFields{})
+
+// commonFieldAliases maps the C names of the fields of CommonFields to the
+// alternative names used for them by some kernels. The field with the
+// standard name is used in preference to an alias.
+var commonFieldAliases = map[string][]string{
+	// Real-time kernels with lazy preemption may
+	// report the preemption count with this name.
+	"common_preempt_count": {"common_preempt_lazy_count"},
+}
+
+// commonField returns the field of f holding the standard header field with
+// the given C name, or one of its aliases.
+func (f *Format) commonField(name string) (Field, bool) {
+	if field, ok := f.FieldByName(name); ok {
+		return field, true
+	}
+	for _, alias := range commonFieldAliases[name] {
+		if field, ok := f.FieldByName(alias); ok {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+// isCommonName returns whether name is the standard C name of a header field,
+// want, or one of its aliases.
+func isCommonName(name, want string) bool {
+	if name == want {
+		return true
+	}
+	for _, alias := range commonFieldAliases[want] {
+		if name == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// Common returns the standard header fields of the event record in data.
+// The header fields are located by their C names in f rather than by their
+// classic offsets, so headers extended with fields such as common_lock_depth,
+// common_migrate_disable or common_preempt_lazy_count, or with the standard
+// fields at other offsets, are handled. Fields are read in f's byte order.
+//
+// If a format has no field with the standard name of a header field, a
+// field with a known alias of the name is used. The supported alias is
+// common_preempt_lazy_count for common_preempt_count, used by some
+// real-time kernels. Aliases are also recognised by the EmbedCommonFields
+// option.
+func (f *Format) Common(data []byte) (CommonFields, error) {
+	var c CommonFields
+	v := reflect.ValueOf(&c).Elem()
+	for i := 0; i < commonFieldsType.NumField(); i++ {
+		want := commonFieldsType.Field(i)
+		name := want.Tag.Get("name")
+		field, ok := f.commonField(name)
+		if !ok {
+			return CommonFields{}, fmt.Errorf("no %s field in format for %s", name, f.Name)
+		}
+		if field.Size > int(want.Type.Size()) {
+			return CommonFields{}, fmt.Errorf("invalid %s size in format for %s: %d", name, f.Name, field.Size)
+		}
+		if field.Offset+field.Size > len(data) {
+			return CommonFields{}, &DataError{Len: field.Offset + field.Size, Size: len(data)}
+		}
+		u := decodeUint(data[field.Offset:], field.Size, f.byteOrder())
+		switch dst := v.Field(i); dst.Kind() {
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			// Sign-extend from the width of the field.
+			shift := 64 - 8*field.Size
+			dst.SetInt(int64(u<<shift) >> shift)
+		default:
+			dst.SetUint(u)
+		}
+	}
+	return c, nil
+}
+
+// CommonType returns the value of the common_type field of the event record
+// in data, identifying the event. The field is read according to its
+// declared offset and size in f, which must be 1, 2, 4 or 8 bytes, in f's
+// byte order. It is an error for the value not to fit in an event ID.
+func (f *Format) CommonType(data []byte) (uint16, error) {
+	field, err := f.commonType()
+	if err != nil {
+		return 0, err
+	}
+	if field.Offset+field.Size > len(data) {
+		return 0, &DataError{Len: field.Offset + field.Size, Size: len(data)}
+	}
+	typ := decodeUint(data[field.Offset:], field.Size, f.byteOrder())
+	if typ > math.MaxUint16 {
+		return 0, fmt.Errorf("invalid common_type value in event data for %s: %d", f.Name, typ)
+	}
+	return uint16(typ), nil
+}
+
+// commonType returns the common_type field of f.
+func (f *Format) commonType() (Field, error) {
+	field, ok := f.commonField("common_type")
+	if !ok {
+		return Field{}, fmt.Errorf("no common_type field in format for %s", f.Name)
+	}
+	switch field.Size {
+	case 1, 2, 4, 8:
+		return field, nil
+	default:
+		return Field{}, fmt.Errorf("invalid common_type size in format for %s: %d", f.Name, field.Size)
+	}
+}
+
+// hasCommonFields returns whether fields starts with the fields of
+// the standard header as described by CommonFields.
+func hasCommonFields(fields []Field) bool {
+	n := commonFieldsType.NumField()
+	if len(fields) < n {
+		return false
+	}
+	for i, f := range fields[:n] {
+		want := commonFieldsType.Field(i)
+		if !isCommonName(f.Name, want.Tag.Get("name")) || f.CType != want.Tag.Get("ctyp") ||
+			f.Offset != int(want.Offset) || f.Size != int(want.Type.Size()) {
+			return false
+		}
+	}
+	return true
+}
+
+// Symbol is a symbolic name for a field value.
+type Symbol struct {
+	Value uint64
+	Name  string
+}
+
+// Symbol returns the symbolic name for the value v of the field.
+func (f Field) Symbol(v uint64) (string, bool) {
+	for _, s := range f.Symbols {
+		if s.Value == v {
+			return s.Name, true
+		}
+	}
+	return "", false
+}
+
+// Warning is a diagnostic describing a field of a Format's Type that cannot
+// be used directly and requires unpacking.
+type Warning struct {
+	// Index is the index of the field in the Format's Type
+	// and Unpacked struct types, or -1 if the field is not
+	// present in the struct types.
+	Index int
+	// Name is the C name of the field.
+	Name string
+	// Category is the kind of issue with the field.
+	Category WarningCategory
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: field %d (%s)", w.Category, w.Index, w.Name)
+}
+
+// WarningCategory is the category of a Warning.
+type WarningCategory int
+
+const (
+	// UnalignedField indicates a field that is not aligned
+	// according to Go alignment rules and is represented as
+	// a byte array in the packed struct type.
+	UnalignedField WarningCategory = iota + 1
+
+	// DynamicArrayField indicates a __data_loc or __rel_loc field that
+	// refers to dynamic array or string data.
+	DynamicArrayField
+
+	// OverlappingField indicates a field that overlaps a
+	// preceding field and is omitted from the struct types.
+	// See AllowOverlap.
+	OverlappingField
+)
+
+func (c WarningCategory) String() string {
+	switch c {
+	case UnalignedField:
+		return "unaligned field"
+	case DynamicArrayField:
+		return "dynamic array"
+	case OverlappingField:
+		return "overlapping field"
+	default:
+		return fmt.Sprintf("WarningCategory(%d)", int(c))
+	}
+}
+
+// ParseFormat returns the kprobe event format in r. Unlike Struct, unaligned
+// fields and dynamic arrays are not reported as an error, but are described
+// by the returned Format's Unaligned and Warnings fields.
+func ParseFormat(r io.Reader, opts ...Option) (*Format, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseFormat(r, pkgPath, cfg)
+	if err != nil {
+		return nil, err
+	}
+	f.Unpacked, err = unpackedStructFor(f.Type, cfg)
+	if err != nil {
+		return nil, err
+	}
+	f.widened = hasWidened(f.Type, f.Unpacked)
+	f.bools = hasBools(f.Type)
+	return f, nil
+}
+
+// NewFormat returns a Format for the event with the given name and ID and
+// with the provided fields, without requiring a textual format. The Name,
+// CType, Offset, Size and Signed fields of each Field are used to construct
+// the struct types in the same way as for a parsed format, and the remaining
+// fields are ignored. The fields must be in offset order. The provided
+// fields are not modified.
+func NewFormat(name string, id uint16, fields []Field, opts ...Option) (*Format, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	f := Format{Name: name, ID: id, Order: cfg.byteOrder()}
+	f.Fields = make([]Field, len(fields))
+	for i, field := range fields {
+		if !isIdentifier(field.Name) {
+			return nil, fmt.Errorf("invalid field name: %q", field.Name)
+		}
+		ctyp, err := fetchargType(field.CType)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		f.Fields[i] = Field{
+			Name:   field.Name,
+			CType:  ctyp,
+			Offset: field.Offset,
+			Size:   field.Size,
+			Signed: field.Signed,
+		}
+	}
+	layout, err := f.layout(pkgPath, cfg.recordSize, cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = f.structOf(layout)
+	if err != nil {
+		return nil, err
+	}
+	f.Unpacked, err = unpackedStructFor(f.Type, cfg)
+	if err != nil {
+		return nil, err
+	}
+	f.widened = hasWidened(f.Type, f.Unpacked)
+	f.bools = hasBools(f.Type)
+	return &f, nil
+}
+
+// ParseFormatBytes is like ParseFormat, but parses the kprobe event format
+// held in b.
+func ParseFormatBytes(b []byte, opts ...Option) (*Format, error) {
+	return ParseFormat(bytes.NewReader(b), opts...)
+}
+
+// ParseAllLenient parses the concatenated kprobe event formats in r, such as
+// a dump of the format files of a tracefs events tree, continuing past
+// formats that cannot be parsed. The returned slices are parallel, holding
+// an element for each format block in r in order; for each block either
+// the Format or the error is non-nil. Errors include the index and name of
+// the failing block. An error reading r is returned as the final element
+// of errs with a nil Format.
+//
+// A format block starts at a name: line, and includes any comment or
+// header lines, such as system: lines, immediately preceding it. Text
+// before the first block is ignored.
+func ParseAllLenient(r io.Reader, opts ...Option) (formats []*Format, errs []error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, []error{err}
+	}
+	blocks, err := splitFormatBlocks(r, cfg.maxLineLen())
+	for i, b := range blocks {
+		f, perr := ParseFormatBytes(b, opts...)
+		if perr != nil {
+			perr = fmt.Errorf("format %d (%s): %w", i, blockName(b), perr)
+		}
+		formats = append(formats, f)
+		errs = append(errs, perr)
+	}
+	if err != nil {
+		formats = append(formats, nil)
+		errs = append(errs, err)
+	}
+	return formats, errs
+}
+
+// FormatBlock is the raw text of a single event format in a concatenated
+// dump of formats.
+type FormatBlock struct {
+	// Name is the event name given by the
+	// block's name: line.
+	Name string
+
+	// Format holds the bytes of the block,
+	// suitable for passing to ParseFormat.
+	Format io.Reader
+}
+
+// SplitFormats splits the concatenated kprobe event formats in r into
+// blocks in the manner described for ParseAllLenient, without parsing them.
+// This allows callers to select the formats to parse by name. The only
+// option used is MaxLineLen. Blocks preceding an error reading r are
+// returned along with the error.
+func SplitFormats(r io.Reader, opts ...Option) ([]FormatBlock, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := splitFormatBlocks(r, cfg.maxLineLen())
+	formats := make([]FormatBlock, len(blocks))
+	for i, b := range blocks {
+		formats[i] = FormatBlock{Name: blockName(b), Format: bytes.NewReader(b)}
+	}
+	return formats, err
+}
+
+// splitFormatBlocks returns the raw bytes of each format block in the
+// concatenated formats in r, as described for ParseAllLenient.
+func splitFormatBlocks(r io.Reader, maxLine int) ([][]byte, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxLine)
+	var (
+		blocks [][]byte
+		lines  []string
+	)
+	flush := func(lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		blocks = append(blocks, []byte(strings.Join(lines, "\n")+"\n"))
+	}
+	inBlock := false
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "name: ") {
+			lines = append(lines, line)
+			continue
+		}
+		// Move any header lines immediately preceding the
+		// name into the new block.
+		i := len(lines)
+		for i > 0 && isBlockHeader(lines[i-1]) {
+			i--
+		}
+		if inBlock {
+			flush(lines[:i])
+		}
+		lines = append(lines[i:len(lines):len(lines)], line)
+		inBlock = true
+	}
+	if inBlock {
+		flush(lines)
+	}
+	return blocks, sc.Err()
+}
+
+// isBlockHeader returns whether line is a comment or key: value header line
+// that may precede the name: line of a format block.
+func isBlockHeader(line string) bool {
+	if line == "" || line[0] == ' ' || line[0] == '\t' {
+		return false
+	}
+	if strings.HasPrefix(line, "#") {
+		return true
+	}
+	key, _, ok := headerLine(line)
+	return ok && key != "print fmt" && key != "format"
+}
+
+// blockName returns the event name of the format block b.
+func blockName(b []byte) string {
+	for _, line := range strings.Split(string(b), "\n") {
+		if name := strings.TrimPrefix(line, "name: "); name != line {
+			return name
+		}
+	}
+	return ""
+}
+
+// AliasedFields returns the C names of the dynamic array fields that are
+// held in the Unpacked type as slices aliasing the event data when unpacked
+// by Format.Unpack or Unpack in f's byte order. These fields are not valid
+// after the event data is reused. Dynamic arrays are aliased when their
+// elements are single bytes or 128 bit values, or when f's byte order is
+// the host byte order. No fields alias the event data when unpacked with
+// UnpackCopy, and all fields of events that do not need unpacking alias the
+// event data when the data is used directly; see NeedsUnpack.
+func (f *Format) AliasedFields() []string {
+	hostOrder := f.byteOrder() == machine
+	var names []string
+	for _, field := range f.Fields {
+		elem, ok := dynamicElement(field.CType)
+		if !ok || field.Index == nil {
+			continue
+		}
+		class, ok := dynamicClass(elem)
+		if !ok {
+			continue
+		}
+		if hostOrder || class.size == 1 || class.size == 16 {
+			names = append(names, field.Name)
+		}
+	}
+	return names
+}
+
+// IsReturnProbe returns whether f is the format of a return probe, such as
+// a kretprobe or uretprobe, identified by its __probe_func and __probe_ret_ip
+// fields.
+func (f *Format) IsReturnProbe() bool {
+	_, fn := f.FieldByName("__probe_func")
+	_, ip := f.FieldByName("__probe_ret_ip")
+	return fn && ip
+}
+
+// NeedsUnpack returns whether events of f must be unpacked into a value of
+// the Unpacked type because f has unaligned fields or dynamic arrays, bool
+// fields, overlapping fields allowed by the AllowOverlap option, fields
+// widened by the WidenLongs option, or a byte order other than the host
+// byte order. If it returns false, event records may be used
+// directly as values of f's Type.
+//
+// Bool fields need unpacking because the kernel may store any non-zero
+// byte value for true, which is not a valid Go bool value.
+func (f *Format) NeedsUnpack() bool {
+	return len(f.Unaligned.Fields) != 0 || f.Unaligned.DynamicArray || f.widened || f.bools || f.overlaps || f.byteOrder() != machine
+}
+
+// hasBools returns whether the packed struct type has bool or bool array
+// fields.
+func hasBools(packed reflect.Type) bool {
+	for i := 0; i < packed.NumField(); i++ {
+		if isBool(packed.Field(i).Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasWidened returns whether any aligned integer field of the packed struct
+// type is widened in the unpacked struct type.
+func hasWidened(packed, unpacked reflect.Type) bool {
+	for i := 0; i < packed.NumField(); i++ {
+		if isWidened(packed.Field(i).Type, unpacked.Field(i).Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// WireSize returns the size in bytes of the fixed portion of an event record
+// of f as declared by the format, f.Size. This is the number of bytes to take
+// from a stream of records before any dynamic array data, and is the length
+// required of data by Unpack and Validate. It may be smaller than the Go size
+// of f's Type, f.GoSize, which includes any padding following the final field
+// to satisfy the alignment of Type; a buffer used as backing memory for a
+// value of Type, or a value of Type copied into a byte slice, has the Go size.
+func (f *Format) WireSize() int {
+	return f.Size
+}
+
+// TrailingPad returns the number of bytes of padding following the final
+// field of f's Type, the difference between GoSize and Size.
+func (f *Format) TrailingPad() int {
+	return f.GoSize - f.Size
+}
+
+// LayoutEntry describes a byte range of an event record.
+type LayoutEntry struct {
+	// Start and End are the offsets of the start
+	// and end of the range, [Start,End).
+	Start, End int
+
+	// Name is the C name of the field occupying
+	// the range. It is empty for padding.
+	Name string
+}
+
+// Layout returns the byte ranges of the fixed portion of an event record
+// described by f in offset order, with gaps between fields reported as
+// padding entries. Fields that overlap preceding fields, allowed by the
+// AllowOverlap option, have ranges that overlap the preceding entries.
+// Trailing padding of f's Type beyond Size is not included.
+func (f *Format) Layout() []LayoutEntry {
+	fields := make([]Field, len(f.Fields))
+	copy(fields, f.Fields)
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].Offset < fields[j].Offset
+	})
+	var (
+		entries []LayoutEntry
+		end     int
+	)
+	for _, field := range fields {
+		if field.Offset > end {
+			entries = append(entries, LayoutEntry{Start: end, End: field.Offset})
+		}
+		entries = append(entries, LayoutEntry{Start: field.Offset, End: field.Offset + field.Size, Name: field.Name})
+		if e := field.Offset + field.Size; e > end {
+			end = e
+		}
+	}
+	return entries
+}
+
+// DecodeFlags returns the value of the named field rendered according to
+// the field's __print_flags mapping in the style of the kernel, for
+// example "O_WRONLY|O_CREAT". Bits that are not named by the mapping are
+// rendered in hexadecimal.
+func (f *Format) DecodeFlags(field string, value uint64) string {
+	fld, _ := f.FieldByName(field)
+	return printFlags(value, fld.FlagDelim, fld.Flags)
+}
+
+// FieldByName returns the field with the given C name. The returned Field's
+// Offset, Size and Signed fields may be used to read the field's value
+// directly from an event record without constructing a struct value.
+func (f *Format) FieldByName(name string) (Field, bool) {
+	if i, ok := f.byName[name]; ok && i < len(f.Fields) && f.Fields[i].Name == name {
+		return f.Fields[i], true
+	}
+	for _, field := range f.Fields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+// DataError is returned when event data is not consistent with a Format.
+// A DataError wraps io.ErrUnexpectedEOF.
+type DataError struct {
+	// Field is the C name of the dynamic array field whose
+	// data location falls outside the event data. It is empty
+	// if the data is shorter than the fixed portion of the
+	// event record.
+	Field string
+
+	// Offset and Len are the offset and length of the data
+	// required by the event record, and Size is the length
+	// of the event data.
+	Offset, Len int
+	Size        int
+}
+
+func (e *DataError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("short event data: %d < %d", e.Size, e.Len)
+	}
+	return fmt.Sprintf("invalid dynamic data indexes for %s: offset=%d len=%d outside %d bytes", e.Field, e.Offset, e.Len, e.Size)
+}
+
+// Unwrap returns io.ErrUnexpectedEOF.
+func (e *DataError) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+// TruncatedError is returned when a short event record is decoded using
+// the AllowShort option. The fields of the decoded value that are not
+// listed in Fields hold the values from the event record.
+type TruncatedError struct {
+	// Len is the length of the fixed portion of the event
+	// record and Size is the length of the event data.
+	Len, Size int
+
+	// Fields holds the C names of the fields that were not
+	// decoded because they were not fully contained in the
+	// event data.
+	Fields []string
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("truncated event data: %d < %d: fields not decoded: %s", e.Size, e.Len, strings.Join(e.Fields, ", "))
+}
+
+// Validate checks that data is long enough to hold an event record for f,
+// and that the data location of each dynamic array field lies within data.
+// Data locations are read in f's byte order. If data is not valid, the
+// returned error is a *DataError.
+func (f *Format) Validate(data []byte) error {
+	return f.validate(data, &config{order: f.byteOrder()})
+}
+
+// byteOrder returns the byte order of f, defaulting to the host byte order.
+func (f *Format) byteOrder() binary.ByteOrder {
+	if f.Order == nil {
+		return machine
+	}
+	return f.Order
+}
+
+// validate is Validate with data locations read in the byte order of cfg.
+// If cfg has strict bounds, dynamic array data must not overlap the fixed
+// portion of the record. The lengths of dynamic arrays with a length field
+// are not checked.
+func (f *Format) validate(data []byte, cfg *config) error {
+	if len(data) < f.Size {
+		return &DataError{Len: f.Size, Size: len(data)}
+	}
+	for _, field := range f.Fields {
+		if _, ok := dynamicElement(field.CType); !ok || field.Size != 4 {
+			continue
+		}
+		off, n := dynamicLocation(field.CType, cfg.byteOrder().Uint32(data[field.Offset:]), field.Offset)
+		if _, ok := cfg.lengths[field.Name]; ok {
+			// The length is held in another field and
+			// is checked when the array is unpacked.
+			n = 0
+		}
+		if off+n > len(data) {
+			return &DataError{Field: field.Name, Offset: off, Len: n, Size: len(data)}
+		}
+		if cfg.strictBounds && n != 0 && off < f.Size {
+			return fmt.Errorf("dynamic data for %s overlaps fixed record: offset=%d len=%d record size=%d", field.Name, off, n, f.Size)
+		}
+	}
+	return nil
+}
+
+// RecordLen returns the length of the event record in data, which is the
+// fixed size of the record described by f extended to the end of the
+// furthest dynamic array data referred to by the record's data locations.
+// The returned length may be greater than the length of data if the record
+// was not fully captured. Data locations are read in f's byte order. If
+// data is shorter than the fixed size of the record, the returned error is
+// a *DataError.
+func (f *Format) RecordLen(data []byte) (int, error) {
+	if len(data) < f.Size {
+		return 0, &DataError{Len: f.Size, Size: len(data)}
+	}
+	n := f.Size
+	for _, field := range f.Fields {
+		if _, ok := dynamicElement(field.CType); !ok || field.Size != 4 {
+			continue
+		}
+		off, size := dynamicLocation(field.CType, f.byteOrder().Uint32(data[field.Offset:]), field.Offset)
+		if end := off + size; end > n {
+			n = end
+		}
+	}
+	return n, nil
+}
+
+// Raw returns the fixed portion of the event record in data, and the raw
+// bytes of each non-empty dynamic array keyed by the C name of its field.
+// The returned slices alias data. Data locations are read in f's byte order.
+// If data is not valid, the returned error is a *DataError.
+func (f *Format) Raw(data []byte) (header []byte, dynamic map[string][]byte, err error) {
+	err = f.Validate(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, field := range f.Fields {
+		if _, ok := dynamicElement(field.CType); !ok || field.Size != 4 {
+			continue
+		}
+		off, n := dynamicLocation(field.CType, f.byteOrder().Uint32(data[field.Offset:]), field.Offset)
+		if n == 0 {
+			continue
+		}
+		if dynamic == nil {
+			dynamic = make(map[string][]byte)
+		}
+		dynamic[field.Name] = data[off : off+n : off+n]
+	}
+	return data[:f.Size:f.Size], dynamic, nil
+}
+
+// Unpack unpacks the event record in data into dst, which must be a pointer
+// to a struct with the layout of f's Unpacked type. See the Unpack function
+// for details of the unpacking and the options that may be used. Data is
+// decoded using f's Order unless a ByteOrder option is provided.
+func (f *Format) Unpack(dst reflect.Value, data []byte, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	return f.unpack(dst, data, cfg)
+}
+
+// unpack unpacks the event record in data into dst using the provided
+// configuration.
+func (f *Format) unpack(dst reflect.Value, data []byte, cfg *config) error {
+	if cfg.order == nil {
+		cfg.order = f.byteOrder()
+	}
+	var truncated *TruncatedError
+	if cfg.allowShort && len(data) < f.Size {
+		data, truncated = f.extendShort(data, cfg.byteOrder())
+	}
+	err := f.validate(data, cfg)
+	if err != nil {
+		return err
+	}
+	var src reflect.Value
+	if len(data) != 0 && len(data) >= int(f.Type.Size()) {
+		src = reflect.NewAt(f.Type, unsafe.Pointer(&data[0]))
+	} else {
+		// The record does not include the trailing padding
+		// of f.Type, or is empty, so work from a copy.
+		src = reflect.New(f.Type)
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(src.Pointer())), f.Type.Size()), data)
+	}
+	err = unpack(dst, src, f.Unaligned, data, cfg)
+	if err == nil && truncated != nil {
+		return truncated
+	}
+	return err
+}
+
+// extendShort returns a copy of the short event record, data, extended to
+// the length of the fixed portion of the record, with the fields that are
+// not fully contained in data zeroed. Dynamic array locators referring to
+// data beyond the end of data are also zeroed. The zeroed fields are
+// described by the returned error.
+func (f *Format) extendShort(data []byte, order binary.ByteOrder) ([]byte, *TruncatedError) {
+	ext := make([]byte, f.Size)
+	copy(ext, data)
+	err := &TruncatedError{Len: f.Size, Size: len(data)}
+	for _, field := range f.Fields {
+		end := field.Offset + field.Size
+		if end <= len(data) {
+			if _, ok := dynamicElement(field.CType); !ok || field.Size != 4 {
+				continue
+			}
+			off, n := dynamicLocation(field.CType, order.Uint32(data[field.Offset:]), field.Offset)
+			if n == 0 || off+n <= len(data) {
+				continue
+			}
+		}
+		for i := field.Offset; i < end; i++ {
+			ext[i] = 0
+		}
+		err.Fields = append(err.Fields, field.Name)
+	}
+	return ext, err
+}
+
+// BatchError is returned by UnpackBatch when an event record in a batch
+// could not be unpacked.
+type BatchError struct {
+	Index int   // Index is the index of the record in the batch.
+	Err   error // Err is the error unpacking the record.
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("event %d: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the error unpacking the record.
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// UnpackBatch unpacks each event record in srcs into the corresponding
+// element of dst as described for the Unpack method of f. The options are
+// resolved once for the whole batch. dst and srcs must have the same length.
+// Unpacking stops at the first record that cannot be unpacked, and the
+// returned error is a *BatchError holding the record's index; destinations
+// before that index have been filled.
+func UnpackBatch(dst []reflect.Value, srcs [][]byte, f *Format, opts ...Option) error {
+	if len(dst) != len(srcs) {
+		return fmt.Errorf("mismatched batch length: %d != %d", len(dst), len(srcs))
+	}
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	for i, data := range srcs {
+		err = f.unpack(dst[i], data, cfg)
+		if err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	return nil
+}
+
+// DecodeTo decodes the event record in data into a value of type T. T must
+// be a struct with the same layout as either f's Type, when f has no unaligned
+// fields or dynamic arrays, or f's Unpacked type. Field names of T are not
+// considered, so T may be a type generated from f ahead of time. The result
+// of checking the layout of T against f is cached, so repeated decoding
+// with the same type and format does not repeat the check.
+//
+// When T matches f's Type, the record is copied directly into the returned
+// value without per-field work. Otherwise data is unpacked as described for
+// Unpack, and the returned value may hold references to data.
+func DecodeTo[T any](data []byte, f *Format) (T, error) {
+	var v T
+	direct, err := f.validateLayout(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return v, err
+	}
+	if !direct {
+		err = f.Unpack(reflect.ValueOf(&v), data)
+		return v, err
+	}
+	if len(data) < f.Size {
+		return v, &DataError{Len: f.Size, Size: len(data)}
+	}
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&v)), unsafe.Sizeof(v)), data)
+	return v, nil
+}
+
+// DecodeOne parses the kprobe event format in format and decodes the single
+// event record in data, returning the event's name and its value as a struct
+// of the format's Unpacked type. The returned value does not hold references
+// to data. DecodeOne is intended for one-off use; callers decoding many
+// events should parse the format once, or use an Unpacker.
+func DecodeOne(format io.Reader, data []byte, opts ...Option) (name string, event interface{}, err error) {
+	f, err := ParseFormat(format, opts...)
+	if err != nil {
+		return "", nil, err
+	}
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return "", nil, err
+	}
+	cfg.copy = true
+	dst := reflect.New(f.Unpacked)
+	err = f.unpack(dst, data, cfg)
+	if err != nil {
+		return f.Name, nil, err
+	}
+	return f.Name, dst.Elem().Interface(), nil
+}
+
+// layoutKey is the key for cached layout validation results.
+type layoutKey struct {
+	typ, packed, unpacked reflect.Type
+	needsUnpack           bool
+}
+
+// layoutResult is a cached layout validation result.
+type layoutResult struct {
+	direct bool
+	err    error
+}
+
+// layouts is the cache of layout validation results.
+var layouts sync.Map // map[layoutKey]layoutResult
+
+// validateLayout returns whether typ has the layout of f's Type and can
+// be filled by copying an event record. If typ does not match the Type of f,
+// it must match f's Unpacked type, otherwise a non-nil error is returned.
+func (f *Format) validateLayout(typ reflect.Type) (direct bool, err error) {
+	needsUnpack := f.NeedsUnpack()
+	key := layoutKey{typ: typ, packed: f.Type, unpacked: f.Unpacked, needsUnpack: needsUnpack}
+	if r, ok := layouts.Load(key); ok {
+		r := r.(layoutResult)
+		return r.direct, r.err
+	}
+	var r layoutResult
+	switch {
+	case typ.Kind() != reflect.Struct:
+		r.err = fmt.Errorf("invalid type for %s: %s is not a struct", f.Name, typ)
+	case !needsUnpack && f.Type != nil && sameLayout(typ, f.Type, false):
+		r.direct = true
+	case f.Unpacked != nil && sameLayout(typ, f.Unpacked, true):
+	default:
+		r.err = fmt.Errorf("type %s does not match layout of %s", typ, f.Name)
+	}
+	layouts.Store(key, r)
+	return r.direct, r.err
+}
+
+// sameLayout returns whether a and b have the same memory layout. If
+// assign is true, the exported fields of b must also be assignable to the
+// corresponding fields of a.
+func sameLayout(a, b reflect.Type, assign bool) bool {
+	if a.Kind() != b.Kind() || a.Size() != b.Size() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Struct:
+		if a.NumField() != b.NumField() {
+			return false
+		}
+		for i := 0; i < a.NumField(); i++ {
+			fa, fb := a.Field(i), b.Field(i)
+			if fa.Offset != fb.Offset || fa.IsExported() != fb.IsExported() {
+				return false
+			}
+			if assign && fb.IsExported() && !fb.Type.AssignableTo(fa.Type) {
+				return false
+			}
+			if !sameLayout(fa.Type, fb.Type, false) {
+				return false
+			}
+		}
+	case reflect.Array:
+		return a.Len() == b.Len() && sameLayout(a.Elem(), b.Elem(), false)
+	case reflect.Slice:
+		return sameLayout(a.Elem(), b.Elem(), false)
+	}
+	return true
+}
@@ -0,0 +1,1693 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+type doSysOpen struct {
+	CommonType         uint16
+	CommonFlags        uint8
+	CommonPreemptCount uint8
+	CommonPID          int32
+	ProbeIP            uint64
+	Dfd                uint32
+	Filename           []byte
+	Flags              uint32
+	Mode               uint32
+}
+
+type sysRead struct {
+	CommonType         uint16
+	CommonFlags        uint8
+	CommonPreemptCount uint8
+	CommonPID          int32
+	FD                 uint32
+	_                  [4]byte
+	Buf                uint64
+	Count              uint64
+}
+
+const sysReadFormat = `name: sys_read_test
+ID: 7022
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:unsigned int fd;	offset:8;	size:4;	signed:0;
+	field:char * buf;	offset:16;	size:8;	signed:0;
+	field:size_t count;	offset:24;	size:8;	signed:0;
+`
+
+func TestDecodeTo(t *testing.T) {
+	t.Run("unpacked", func(t *testing.T) {
+		test := unpackTests[0]
+		f, err := ParseFormat(strings.NewReader(test.format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		for i := 0; i < 2; i++ { // Second pass uses the cached layout.
+			got, err := DecodeTo[doSysOpen](test.data, f)
+			if err != nil {
+				t.Fatalf("unexpected error decoding: %v", err)
+			}
+			want := doSysOpen{
+				CommonType: 0x1bb2,
+				CommonPID:  32705,
+				ProbeIP:    0xffffffffae6da1f0,
+				Dfd:        0xae6da530,
+				Filename:   []byte("file.text\x00"),
+				Flags:      0x88241,
+				Mode:       0x1a4,
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("unexpected result:\ngot: %#v\nwant:%#v", got, want)
+			}
+		}
+	})
+
+	t.Run("direct", func(t *testing.T) {
+		f, err := ParseFormat(strings.NewReader(sysReadFormat))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		want := sysRead{CommonType: 7022, CommonPID: 1234, FD: 3, Buf: 0xc000012345, Count: 4096}
+		data := unsafe.Slice((*byte)(unsafe.Pointer(&want)), unsafe.Sizeof(want))
+		got, err := DecodeTo[sysRead](data, f)
+		if err != nil {
+			t.Fatalf("unexpected error decoding: %v", err)
+		}
+		if got != want {
+			t.Errorf("unexpected result:\ngot: %#v\nwant:%#v", got, want)
+		}
+
+		_, err = DecodeTo[sysRead](data[:f.Size-1], f)
+		if err == nil {
+			t.Error("expected error for short data")
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		f, err := ParseFormat(strings.NewReader(sysReadFormat))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		_, err = DecodeTo[doSysOpen](nil, f)
+		if err == nil {
+			t.Error("expected error for mismatched layout")
+		}
+		_, err = DecodeTo[int](nil, f)
+		if err == nil {
+			t.Error("expected error for non-struct type")
+		}
+	})
+}
+
+func TestTrailingPad(t *testing.T) {
+	const format = `name: trailing_pad_test
+ID: 7023
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u64 value;	offset:8;	size:8;	signed:0;
+	field:u8 state;	offset:16;	size:1;	signed:0;
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Size != 17 {
+		t.Errorf("unexpected size: got:%d want:%d", f.Size, 17)
+	}
+	if f.GoSize != 24 {
+		t.Errorf("unexpected Go size: got:%d want:%d", f.GoSize, 24)
+	}
+	if got := f.TrailingPad(); got != 7 {
+		t.Errorf("unexpected trailing pad: got:%d want:%d", got, 7)
+	}
+	if got := f.WireSize(); got != 17 {
+		t.Errorf("unexpected wire size: got:%d want:%d", got, 17)
+	}
+
+	// A record of exactly the wire size can be unpacked.
+	data := make([]byte, f.WireSize())
+	machine.PutUint64(data[8:], 1)
+	data[16] = 2
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking wire size record: %v", err)
+	}
+	value, _ := fieldByCName(dst, "value")
+	state, _ := fieldByCName(dst, "state")
+	if value.Uint() != 1 || state.Uint() != 2 {
+		t.Errorf("unexpected values: value=%d state=%d", value.Uint(), state.Uint())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	test := unpackTests[0]
+	f, err := ParseFormat(strings.NewReader(test.format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	outside := append([]byte(nil), test.data...)
+	outside[22] = 0x10 // filename len=16 at offset 32 in 44 bytes.
+
+	tests := []struct {
+		name string
+		data []byte
+		want *DataError
+	}{
+		{name: "valid", data: test.data},
+		{name: "short", data: test.data[:f.Size-1], want: &DataError{Len: 32, Size: 31}},
+		{name: "truncated dynamic", data: test.data[:40], want: &DataError{Field: "filename", Offset: 32, Len: 10, Size: 40}},
+		{name: "outside", data: outside, want: &DataError{Field: "filename", Offset: 32, Len: 16, Size: 44}},
+	}
+	for _, test := range tests {
+		err := f.Validate(test.data)
+		if test.want == nil {
+			if err != nil {
+				t.Errorf("unexpected error for %s: %v", test.name, err)
+			}
+			continue
+		}
+		var got *DataError
+		if !errors.As(err, &got) {
+			t.Errorf("unexpected error type for %s: %T", test.name, err)
+			continue
+		}
+		if *got != *test.want {
+			t.Errorf("unexpected error for %s: got:%#v want:%#v", test.name, got, test.want)
+		}
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected error for %s to wrap io.ErrUnexpectedEOF", test.name)
+		}
+		err = f.Unpack(reflect.New(f.Unpacked), test.data)
+		if !errors.As(err, &got) {
+			t.Errorf("unexpected unpack error for %s: %v", test.name, err)
+		}
+	}
+}
+
+func TestUnpackValidateOrder(t *testing.T) {
+	const format = `name: validate_order
+ID: 7041
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc u16[] vals;	offset:8;	size:4;	signed:0;
+`
+	// Use the opposite of the host byte order so that the
+	// locator is invalid if read in host byte order.
+	var order binary.ByteOrder = binary.BigEndian
+	if machine == binary.BigEndian {
+		order = binary.LittleEndian
+	}
+	data := make([]byte, 16)
+	order.PutUint32(data[8:], 4<<16|12)
+	order.PutUint16(data[12:], 1)
+	order.PutUint16(data[14:], 2)
+
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data, ByteOrder(order))
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if got, want := dst.Elem().FieldByName("Vals").Interface(), []uint16{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected values: got:%v want:%v", got, want)
+	}
+
+	// The locator is also checked in the provided order.
+	order.PutUint32(data[8:], 8<<16|12)
+	err = f.Unpack(dst, data, ByteOrder(order))
+	want := &DataError{Field: "vals", Offset: 12, Len: 8, Size: 16}
+	var got *DataError
+	if !errors.As(err, &got) || *got != *want {
+		t.Errorf("unexpected error for out of range locator: got:%v want:%v", err, want)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	tests := []struct {
+		format string
+		want   []Warning
+	}{
+		{format: sysReadFormat, want: nil},
+		{
+			format: unpackTests[0].format,
+			want: []Warning{
+				{Index: 6, Name: "filename", Category: DynamicArrayField},
+			},
+		},
+		{
+			format: `name: ip_local_out_call
+ID: 3965
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:unsigned long __probe_ip;	offset:8;	size:8;	signed:0;
+	field:u64 sock;	offset:16;	size:8;	signed:0;
+	field:u32 size;	offset:24;	size:4;	signed:0;
+	field:u16 af;	offset:28;	size:2;	signed:0;
+	field:u32 laddr;	offset:30;	size:4;	signed:0;
+	field:u16 lport;	offset:34;	size:2;	signed:0;
+	field:u32 raddr;	offset:36;	size:4;	signed:0;
+`,
+			want: []Warning{
+				{Index: 8, Name: "laddr", Category: UnalignedField},
+			},
+		},
+		{
+			format: unpackTests[1].format,
+			want: []Warning{
+				{Index: 13, Name: "raw_cmd", Category: DynamicArrayField},
+			},
+		},
+	}
+	for _, test := range tests {
+		f, err := ParseFormat(strings.NewReader(test.format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		if !reflect.DeepEqual(f.Warnings, test.want) {
+			t.Errorf("unexpected warnings for %s:\ngot: %v\nwant:%v", f.Name, f.Warnings, test.want)
+		}
+	}
+}
+
+func TestParseFormatBytes(t *testing.T) {
+	for _, test := range unpackTests {
+		want, err := ParseFormat(strings.NewReader(test.format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s from reader: %v", test.name, err)
+		}
+		got, err := ParseFormatBytes([]byte(test.format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s from bytes: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected format for %s:\ngot: %#v\nwant:%#v", test.name, got, want)
+		}
+	}
+}
+
+func TestEmbedCommonFields(t *testing.T) {
+	test := unpackTests[0]
+	f, err := ParseFormat(strings.NewReader(test.format), EmbedCommonFields())
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	embedded := f.Type.Field(0)
+	if !embedded.Anonymous || embedded.Type != reflect.TypeOf(CommonFields{}) {
+		t.Fatalf("unexpected first field: %+v", embedded)
+	}
+	if f.Type.NumField() != 6 {
+		t.Errorf("unexpected number of fields: got:%d want:%d", f.Type.NumField(), 6)
+	}
+	pid, _ := f.FieldByName("common_pid")
+	if !reflect.DeepEqual(pid.Index, []int{0, 3}) {
+		t.Errorf("unexpected index for common_pid: %v", pid.Index)
+	}
+	filename, _ := f.FieldByName("filename")
+	if !reflect.DeepEqual(filename.Index, []int{3}) {
+		t.Errorf("unexpected index for filename: %v", filename.Index)
+	}
+	for _, field := range f.Fields {
+		typ, off := f.Type, uintptr(0)
+		for _, i := range field.Index {
+			sf := typ.Field(i)
+			off += sf.Offset
+			typ = sf.Type
+		}
+		if int(off) != field.Offset {
+			t.Errorf("unexpected offset for %s: got:%d want:%d", field.Name, off, field.Offset)
+		}
+	}
+
+	// The fast aliasing path sees the header through the embedded struct.
+	src := reflect.NewAt(f.Type, unsafe.Pointer(&test.data[0]))
+	header, ok := src.Elem().Field(0).Interface().(CommonFields)
+	if !ok {
+		t.Fatalf("unexpected header type: %T", src.Elem().Field(0).Interface())
+	}
+	wantHeader := CommonFields{Common_type: 0x1bb2, Common_pid: 32705}
+	if header != wantHeader {
+		t.Errorf("unexpected header: got:%+v want:%+v", header, wantHeader)
+	}
+
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, test.data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if got := dst.Elem().FieldByName("Common_pid").Int(); got != 32705 {
+		t.Errorf("unexpected unpacked pid: got:%d want:%d", got, 32705)
+	}
+	got, ok := CStringField(dst, "filename")
+	if !ok || got != "file.text" {
+		t.Errorf("unexpected filename: got:%q ok:%t", got, ok)
+	}
+
+	// Formats without the standard header are not changed.
+	f, err = ParseFormat(strings.NewReader(sysReadFormat[:strings.Index(sysReadFormat, "\tfield:unsigned short")]+
+		"\tfield:unsigned int fd;\toffset:0;\tsize:4;\tsigned:0;\n"), EmbedCommonFields())
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Type.Field(0).Anonymous {
+		t.Error("unexpected embedded header for format without common fields")
+	}
+}
+
+func TestEmbedCommonFieldsOrder(t *testing.T) {
+	const format = `name: embed_order
+ID: 7
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u32 value;	offset:8;	size:4;	signed:0;
+	field:u64 total;	offset:16;	size:8;	signed:0;
+`
+	// Use the opposite of the host byte order so that the
+	// header fields must be swapped.
+	var order binary.ByteOrder = binary.BigEndian
+	if machine == binary.BigEndian {
+		order = binary.LittleEndian
+	}
+	data := make([]byte, 24)
+	order.PutUint16(data, 7)
+	data[2] = 1
+	data[3] = 2
+	order.PutUint32(data[4:], 1234)
+	order.PutUint32(data[8:], 99)
+	order.PutUint64(data[16:], 1<<40)
+
+	f, err := ParseFormat(strings.NewReader(format), EmbedCommonFields(), ByteOrder(order))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	wantHeader := CommonFields{Common_type: 7, Common_flags: 1, Common_preempt_count: 2, Common_pid: 1234}
+	check := func(src string, v reflect.Value) {
+		t.Helper()
+		header, ok := v.Elem().Field(0).Interface().(CommonFields)
+		if !ok {
+			t.Fatalf("unexpected header type from %s: %T", src, v.Elem().Field(0).Interface())
+		}
+		if header != wantHeader {
+			t.Errorf("unexpected header from %s: got:%+v want:%+v", src, header, wantHeader)
+		}
+		if got, _ := fieldByCName(v, "value"); got.Uint() != 99 {
+			t.Errorf("unexpected value from %s: got:%d want:99", src, got.Uint())
+		}
+	}
+
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	check("Unpack", dst)
+
+	u := NewUnpacker(EmbedCommonFields(), ByteOrder(order))
+	_, err = u.Register(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	_, v, err := u.Unpack(data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking with Unpacker: %v", err)
+	}
+	check("Unpacker", v)
+
+	buf := make([]byte, len(data))
+	n, err := Pack(buf, dst, f)
+	if err != nil {
+		t.Fatalf("unexpected error packing: %v", err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Errorf("unexpected packed record:\ngot: %#x\nwant:%#x", buf[:n], data)
+	}
+}
+
+func TestAllowOverlap(t *testing.T) {
+	const format = `name: union_test
+ID: 7030
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u64 addr;	offset:8;	size:8;	signed:0;
+	field:u32 port;	offset:8;	size:4;	signed:0;
+	field:u32 proto;	offset:16;	size:4;	signed:0;
+
+print fmt: "addr=%llx proto=%u", REC->addr, REC->proto
+`
+	_, err := ParseFormat(strings.NewReader(format))
+	wantErr := OffsetError{Field: "port", Offset: 8, Previous: "addr", End: 16}
+	if err != wantErr {
+		t.Errorf("unexpected error without AllowOverlap: got:%v want:%v", err, wantErr)
+	}
+
+	f, err := ParseFormat(strings.NewReader(format), AllowOverlap())
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Size != 20 {
+		t.Errorf("unexpected size: got:%d want:20", f.Size)
+	}
+	if _, ok := f.Type.FieldByName("Port"); ok {
+		t.Error("unexpected overlapping field in struct type")
+	}
+	port, ok := f.FieldByName("port")
+	if !ok {
+		t.Fatal("missing overlapping field in metadata")
+	}
+	if port.Index != nil || port.Type != reflect.TypeOf(uint32(0)) || port.Offset != 8 {
+		t.Errorf("unexpected overlapping field metadata: %+v", port)
+	}
+	wantWarnings := []Warning{{Index: -1, Name: "port", Category: OverlappingField}}
+	if !reflect.DeepEqual(f.Warnings, wantWarnings) {
+		t.Errorf("unexpected warnings: got:%v want:%v", f.Warnings, wantWarnings)
+	}
+
+	data := make([]byte, f.Size)
+	machine.PutUint64(data[8:], 0x1122334455667788)
+	machine.PutUint32(data[16:], 6)
+	v := reflect.NewAt(f.Type, unsafe.Pointer(&data[0])).Elem()
+	if got := v.FieldByName("Addr").Uint(); got != 0x1122334455667788 {
+		t.Errorf("unexpected addr: got:%#x", got)
+	}
+	if got := v.FieldByName("Proto").Uint(); got != 6 {
+		t.Errorf("unexpected proto: got:%d", got)
+	}
+	wantPort := uint32(0x55667788)
+	if machine == binary.BigEndian {
+		wantPort = 0x11223344
+	}
+	if got := machine.Uint32(data[port.Offset:]); got != wantPort {
+		t.Errorf("unexpected manually decoded port: got:%#x want:%#x", got, wantPort)
+	}
+	if got, err := Sprint(f, v.Addr()); err != nil || got != "addr=1122334455667788 proto=6" {
+		t.Errorf("unexpected print result: got:%q err:%v", got, err)
+	}
+
+	// Formats with overlapping fields are always unpacked.
+	if !f.NeedsUnpack() {
+		t.Error("expected format with overlapping fields to need unpacking")
+	}
+	u := NewUnpacker(AllowOverlap())
+	_, err = u.Register(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	machine.PutUint16(data, 7030)
+	_, uv, err := u.Unpack(data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if uv.Elem().Type() != f.Unpacked {
+		t.Errorf("unexpected unpacked type: got:%s want:%s", uv.Elem().Type(), f.Unpacked)
+	}
+	if p := uv.Pointer(); p == uintptr(unsafe.Pointer(&data[0])) {
+		t.Error("unexpected aliasing of event data")
+	}
+	if got := uv.Elem().FieldByName("Addr").Uint(); got != 0x1122334455667788 {
+		t.Errorf("unexpected unpacked addr: got:%#x", got)
+	}
+	if got := uv.Elem().FieldByName("Proto").Uint(); got != 6 {
+		t.Errorf("unexpected unpacked proto: got:%d", got)
+	}
+}
+
+func TestUnpackBatch(t *testing.T) {
+	test := unpackTests[0]
+	f, err := ParseFormat(strings.NewReader(test.format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	const n = 3
+	srcs := make([][]byte, n)
+	dst := make([]reflect.Value, n)
+	for i := range srcs {
+		srcs[i] = test.data
+		dst[i] = reflect.New(f.Unpacked)
+	}
+	err = UnpackBatch(dst, srcs, f)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking batch: %v", err)
+	}
+	for i, d := range dst {
+		got := d.Elem().Interface()
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected result for record %d:\ngot: %#v\nwant:%#v", i, got, test.want)
+		}
+	}
+
+	srcs[1] = test.data[:f.Size-1]
+	err = UnpackBatch(dst, srcs, f)
+	var berr *BatchError
+	if !errors.As(err, &berr) || berr.Index != 1 || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("unexpected error for short record: %v", err)
+	}
+
+	err = UnpackBatch(dst[:1], srcs, f)
+	if err == nil {
+		t.Error("expected error for mismatched batch length")
+	}
+}
+
+func BenchmarkUnpackBatch(b *testing.B) {
+	const n = 64
+	for _, test := range unpackTests[:2] {
+		f, err := ParseFormat(strings.NewReader(test.format))
+		if err != nil {
+			b.Fatalf("unexpected error parsing format %q: %v", test.name, err)
+		}
+		srcs := make([][]byte, n)
+		dst := make([]reflect.Value, n)
+		for i := range srcs {
+			srcs[i] = test.data
+			dst[i] = reflect.New(f.Unpacked)
+		}
+		b.Run(test.name+"/loop", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for j, data := range srcs {
+					err := f.Unpack(dst[j], data)
+					if err != nil {
+						b.Fatalf("unexpected error for unpacking %q: %v", test.name, err)
+					}
+				}
+			}
+		})
+		b.Run(test.name+"/batch", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := UnpackBatch(dst, srcs, f)
+				if err != nil {
+					b.Fatalf("unexpected error for unpacking %q: %v", test.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordLen(t *testing.T) {
+	const format = `name: record_len_test
+ID: 7032
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc char[] name;	offset:8;	size:4;	signed:1;
+	field:__rel_loc u8[] buf;	offset:12;	size:4;	signed:0;
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		dataLoc  uint32
+		relLoc   uint32
+		size     int
+		want     int
+		wantFull bool
+	}{
+		{name: "empty", size: 16, want: 16, wantFull: true},
+		{name: "data_loc at end", dataLoc: 4<<16 | 28, size: 32, want: 32, wantFull: true},
+		{name: "rel_loc at end", dataLoc: 4<<16 | 16, relLoc: 12<<16 | 4, size: 32, want: 32, wantFull: true},
+		{name: "truncated", dataLoc: 4<<16 | 16, relLoc: 12<<16 | 4, size: 30, want: 32},
+	}
+	for _, test := range tests {
+		data := make([]byte, test.size)
+		machine.PutUint32(data[8:], test.dataLoc)
+		machine.PutUint32(data[12:], test.relLoc)
+		got, err := f.RecordLen(data)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("unexpected record length for %s: got:%d want:%d", test.name, got, test.want)
+		}
+		if full := got <= len(data); full != test.wantFull {
+			t.Errorf("unexpected capture state for %s: got:%t want:%t", test.name, full, test.wantFull)
+		}
+	}
+
+	_, err = f.RecordLen(make([]byte, 12))
+	var derr *DataError
+	if !errors.As(err, &derr) {
+		t.Errorf("unexpected error for short data: %v", err)
+	}
+}
+
+func TestParseAllLenient(t *testing.T) {
+	const invalid = `# broken capture
+name: invalid_test
+ID: 7036
+format:
+	field:unsigned short common_type;	offset:0;	size:two;	signed:0;
+`
+	input := strings.Join([]string{
+		"dump of events\n",
+		unpackTests[0].format,
+		invalid,
+		"system: kprobes\n" + sysReadFormat,
+		unpackTests[1].format,
+	}, "\n")
+	formats, errs := ParseAllLenient(strings.NewReader(input))
+	if len(formats) != 4 || len(errs) != len(formats) {
+		t.Fatalf("unexpected number of results: formats=%d errs=%d", len(formats), len(errs))
+	}
+	wantNames := []string{"do_sys_open_test", "", "sys_read_test", "gvt_command"}
+	for i, name := range wantNames {
+		if name == "" {
+			if errs[i] == nil || formats[i] != nil {
+				t.Errorf("expected error for block %d: format=%v err=%v", i, formats[i], errs[i])
+			} else if !strings.Contains(errs[i].Error(), "invalid_test") {
+				t.Errorf("error for block %d does not name the format: %v", i, errs[i])
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("unexpected error for block %d: %v", i, errs[i])
+			continue
+		}
+		if formats[i].Name != name {
+			t.Errorf("unexpected name for block %d: got:%s want:%s", i, formats[i].Name, name)
+		}
+	}
+	if got := formats[2].Header["system"]; got != "kprobes" {
+		t.Errorf("unexpected system header for sys_read_test: %q", got)
+	}
+	if formats[0].Header != nil {
+		t.Errorf("unexpected header for do_sys_open_test: %v", formats[0].Header)
+	}
+}
+
+func TestSplitFormats(t *testing.T) {
+	input := strings.Join([]string{
+		unpackTests[0].format,
+		"system: kprobes\n" + sysReadFormat,
+		unpackTests[1].format,
+	}, "\n")
+	blocks, err := SplitFormats(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected error splitting formats: %v", err)
+	}
+	var names []string
+	for _, b := range blocks {
+		names = append(names, b.Name)
+	}
+	wantNames := []string{"do_sys_open_test", "sys_read_test", "gvt_command"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("unexpected block names: got:%q want:%q", names, wantNames)
+	}
+
+	var parsed []*Format
+	for _, b := range blocks {
+		if b.Name != "sys_read_test" {
+			continue
+		}
+		f, err := ParseFormat(b.Format)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %v", b.Name, err)
+		}
+		parsed = append(parsed, f)
+	}
+	if len(parsed) != 1 {
+		t.Fatalf("unexpected number of parsed formats: %d", len(parsed))
+	}
+	want, err := ParseFormat(strings.NewReader("system: kprobes\n" + sysReadFormat))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if !reflect.DeepEqual(parsed[0], want) {
+		t.Errorf("unexpected format:\ngot: %#v\nwant:%#v", parsed[0], want)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	const format = `# captured from host-a
+system: kprobes
+name: header_test
+ enabled: 1
+ID: 7035
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:u32 value;	offset:4;	size:4;	signed:0;
+
+print fmt: "value=%u", REC->value
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Name != "header_test" || f.ID != 7035 {
+		t.Errorf("unexpected name and ID: %s %d", f.Name, f.ID)
+	}
+	want := map[string]string{"system": "kprobes", "enabled": "1"}
+	if !reflect.DeepEqual(f.Header, want) {
+		t.Errorf("unexpected header: got:%v want:%v", f.Header, want)
+	}
+
+	f, err = ParseFormat(strings.NewReader(unpackTests[0].format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Header != nil {
+		t.Errorf("unexpected header for format without extra lines: %v", f.Header)
+	}
+}
+
+func TestRecordSize(t *testing.T) {
+	const format = `name: record_size
+ID: 7070
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:u64 value;	offset:8;	size:8;	signed:0;
+	field:u8 state;	offset:16;	size:1;	signed:0;
+`
+	f, err := ParseFormat(strings.NewReader(format), RecordSize(24))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Size != 24 || f.GoSize != 24 {
+		t.Errorf("unexpected sizes: Size=%d GoSize=%d want 24", f.Size, f.GoSize)
+	}
+	last := f.Type.Field(f.Type.NumField() - 1)
+	if got, want := last.Tag.Get("bytes"), "[17:24]"; got != want {
+		t.Errorf("unexpected trailing padding: got:%q want:%q", got, want)
+	}
+	if f.NeedsUnpack() {
+		t.Error("unexpected need for unpacking")
+	}
+
+	data := make([]byte, 24)
+	machine.PutUint64(data[8:], 1)
+	data[16] = 2
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if state, _ := fieldByCName(dst, "state"); state.Uint() != 2 {
+		t.Errorf("unexpected state: got:%d want:2", state.Uint())
+	}
+	err = f.Unpack(dst, data[:20])
+	if err == nil {
+		t.Error("expected error unpacking record shorter than record size")
+	}
+
+	_, err = ParseFormat(strings.NewReader(format), RecordSize(12))
+	if err == nil {
+		t.Error("expected error for record size before end of fields")
+	}
+	f, err = ParseFormat(strings.NewReader(format), RecordSize(0))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Size != 17 {
+		t.Errorf("unexpected size for ignored record size: got:%d want:17", f.Size)
+	}
+
+	fields := make([]Field, len(f.Fields))
+	copy(fields, f.Fields)
+	f, err = NewFormat("record_size", 7070, fields, RecordSize(24))
+	if err != nil {
+		t.Fatalf("unexpected error constructing format: %v", err)
+	}
+	if f.Size != 24 {
+		t.Errorf("unexpected size for constructed format: got:%d want:24", f.Size)
+	}
+}
+
+func TestUnpackEmpty(t *testing.T) {
+	f, err := ParseFormat(strings.NewReader("name: empty\nID: 7090\nformat:\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Size != 0 {
+		t.Errorf("unexpected size: got:%d want:0", f.Size)
+	}
+	for _, data := range [][]byte{nil, {}} {
+		err = f.Unpack(reflect.New(f.Unpacked), data)
+		if err != nil {
+			t.Errorf("unexpected error unpacking empty record %#v: %v", data, err)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	f, err := ParseFormat(strings.NewReader(formatTests[0].format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	want := []LayoutEntry{
+		{Start: 0, End: 2, Name: "common_type"},
+		{Start: 2, End: 3, Name: "common_flags"},
+		{Start: 3, End: 4, Name: "common_preempt_count"},
+		{Start: 4, End: 8, Name: "common_pid"},
+		{Start: 8, End: 12},
+		{Start: 12, End: 16, Name: "__probe_ip"},
+		{Start: 16, End: 20, Name: "__probe_nargs"},
+		{Start: 20, End: 24, Name: "dfd"},
+		{Start: 24, End: 28, Name: "filename"},
+		{Start: 28, End: 32, Name: "flags"},
+		{Start: 32, End: 36, Name: "mode"},
+	}
+	got := f.Layout()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected layout:\ngot: %+v\nwant:%+v", got, want)
+	}
+}
+
+func TestStrictBounds(t *testing.T) {
+	const format = `name: bounds_test
+ID: 7037
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc char[] name;	offset:8;	size:4;	signed:1;
+	field:u32 value;	offset:12;	size:4;	signed:0;
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		loc       uint32
+		wantErr   bool
+		wantEOF   bool
+		strictErr bool
+	}{
+		{name: "valid", loc: 4<<16 | 16},
+		{name: "empty", loc: 0},
+		{name: "into header", loc: 4<<16 | 4, strictErr: true},
+		{name: "straddling header", loc: 8<<16 | 12, strictErr: true},
+		{name: "past EOF", loc: 8<<16 | 16, wantErr: true, wantEOF: true},
+		{name: "beyond EOF", loc: 1<<16 | 64, wantErr: true, wantEOF: true},
+	}
+	for _, test := range tests {
+		data := make([]byte, 20)
+		machine.PutUint32(data[8:], test.loc)
+		copy(data[16:], "abc\x00")
+		for _, strict := range []bool{false, true} {
+			var opts []Option
+			if strict {
+				opts = append(opts, StrictBounds())
+			}
+			wantErr := test.wantErr || (strict && test.strictErr)
+
+			err := f.Unpack(reflect.New(f.Unpacked), data, opts...)
+			if (err != nil) != wantErr {
+				t.Errorf("unexpected error for %s strict=%t: %v", test.name, strict, err)
+			}
+			if test.wantEOF && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("expected io.ErrUnexpectedEOF for %s strict=%t: %v", test.name, strict, err)
+			}
+
+			// The package level Unpack applies the same checks.
+			src := reflect.NewAt(f.Type, unsafe.Pointer(&data[0]))
+			err = Unpack(reflect.New(f.Unpacked), src, f.Unaligned, data, opts...)
+			if (err != nil) != wantErr {
+				t.Errorf("unexpected error for %s strict=%t from Unpack: %v", test.name, strict, err)
+			}
+		}
+	}
+}
+
+func TestFormatOrder(t *testing.T) {
+	const format = `name: order_test
+ID: 7040
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u8 pad;	offset:8;	size:1;	signed:0;
+	field:s16 delta;	offset:9;	size:2;	signed:1;
+	field:__data_loc u16[] vals;	offset:12;	size:4;	signed:0;
+	field:u32 count;	offset:16;	size:4;	signed:0;
+`
+	// The same bytes decode differently under each byte order.
+	data := []byte{
+		0, 0, 0, 0, 0, 0, 0, 0, // common_type is set in the test's order
+		0, 0x01, 0x02, 0,
+		0, 0, 0, 0, // locator: offset=20 len=4 in the test's order
+		0x01, 0x02, 0x03, 0x04,
+		0x00, 0x01, 0x00, 0x02,
+	}
+	tests := []struct {
+		order     binary.ByteOrder
+		loc       []byte
+		wantDelta int16
+		wantCount uint32
+		wantVals  []uint16
+		wantLen   int
+	}{
+		{
+			order:     binary.LittleEndian,
+			loc:       []byte{0x14, 0x00, 0x04, 0x00},
+			wantDelta: 0x0201,
+			wantCount: 0x04030201,
+			wantVals:  []uint16{0x0100, 0x0200},
+			wantLen:   24,
+		},
+		{
+			order:     binary.BigEndian,
+			loc:       []byte{0x00, 0x04, 0x00, 0x14},
+			wantDelta: 0x0102,
+			wantCount: 0x01020304,
+			wantVals:  []uint16{0x0001, 0x0002},
+			wantLen:   24,
+		},
+	}
+	for _, test := range tests {
+		f, err := ParseFormat(strings.NewReader(format), ByteOrder(test.order))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		if f.Order != test.order {
+			t.Errorf("unexpected order: got:%v want:%v", f.Order, test.order)
+		}
+		data := append([]byte(nil), data...)
+		test.order.PutUint16(data, 7040)
+		copy(data[12:], test.loc)
+
+		err = f.Validate(data)
+		if err != nil {
+			t.Errorf("unexpected validation error for %v: %v", test.order, err)
+		}
+		n, err := f.RecordLen(data)
+		if err != nil || n != test.wantLen {
+			t.Errorf("unexpected record length for %v: got:%d err:%v want:%d", test.order, n, err, test.wantLen)
+		}
+		dst := reflect.New(f.Unpacked)
+		err = f.Unpack(dst, data)
+		if err != nil {
+			t.Fatalf("unexpected error unpacking for %v: %v", test.order, err)
+		}
+		check := func(src string, v reflect.Value) {
+			t.Helper()
+			if got, _ := fieldByCName(v, "common_type"); got.Uint() != 7040 {
+				t.Errorf("unexpected common_type for %v from %s: got:%d want:7040", test.order, src, got.Uint())
+			}
+			if got, _ := fieldByCName(v, "delta"); int16(got.Int()) != test.wantDelta {
+				t.Errorf("unexpected delta for %v from %s: got:%#x want:%#x", test.order, src, got.Int(), test.wantDelta)
+			}
+			if got, _ := fieldByCName(v, "count"); uint32(got.Uint()) != test.wantCount {
+				t.Errorf("unexpected count for %v from %s: got:%#x want:%#x", test.order, src, got.Uint(), test.wantCount)
+			}
+			if got, _ := fieldByCName(v, "vals"); !reflect.DeepEqual(got.Interface(), test.wantVals) {
+				t.Errorf("unexpected values for %v from %s: got:%#x want:%#x", test.order, src, got.Interface(), test.wantVals)
+			}
+		}
+		check("Unpack", dst)
+
+		u := NewUnpacker(ByteOrder(test.order))
+		_, err = u.Register(strings.NewReader(format))
+		if err != nil {
+			t.Fatalf("unexpected error registering format: %v", err)
+		}
+		_, v, err := u.Unpack(data)
+		if err != nil {
+			t.Fatalf("unexpected error unpacking with Unpacker for %v: %v", test.order, err)
+		}
+		check("Unpacker", v)
+
+		buf := make([]byte, len(data))
+		n, err = Pack(buf, dst, f)
+		if err != nil {
+			t.Fatalf("unexpected error packing for %v: %v", test.order, err)
+		}
+		if !bytes.Equal(buf[:n], data) {
+			t.Errorf("unexpected packed record for %v:\ngot: %#x\nwant:%#x", test.order, buf[:n], data)
+		}
+	}
+
+	// Records without unaligned fields or dynamic arrays in a
+	// byte order other than the host's must still be unpacked.
+	const fixed = `name: order_fixed
+ID: 820
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:u16 cpu;	offset:2;	size:2;	signed:0;
+	field:u32 value;	offset:4;	size:4;	signed:0;
+`
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		f, err := ParseFormat(strings.NewReader(fixed), ByteOrder(order))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		if got, want := f.NeedsUnpack(), order != machine; got != want {
+			t.Errorf("unexpected NeedsUnpack for %v: got:%t want:%t", order, got, want)
+		}
+		data := make([]byte, 8)
+		order.PutUint16(data, 820)
+		order.PutUint32(data[4:], 1)
+		u := NewUnpacker(ByteOrder(order))
+		_, err = u.Register(strings.NewReader(fixed))
+		if err != nil {
+			t.Fatalf("unexpected error registering format: %v", err)
+		}
+		_, v, err := u.Unpack(data)
+		if err != nil {
+			t.Fatalf("unexpected error unpacking for %v: %v", order, err)
+		}
+		if got, _ := fieldByCName(v, "common_type"); got.Uint() != 820 {
+			t.Errorf("unexpected common_type for %v: got:%d want:820", order, got.Uint())
+		}
+		if got, _ := fieldByCName(v, "value"); got.Uint() != 1 {
+			t.Errorf("unexpected value for %v: got:%d want:1", order, got.Uint())
+		}
+	}
+
+	// A Format without an Order uses the host byte order.
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Order != machine {
+		t.Errorf("unexpected default order: got:%v want:%v", f.Order, machine)
+	}
+}
+
+func TestRaw(t *testing.T) {
+	test := unpackTests[0]
+	f, err := ParseFormat(strings.NewReader(test.format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	header, dynamic, err := f.Raw(test.data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(header, test.data[:f.Size]) {
+		t.Errorf("unexpected header:\ngot: %v\nwant:%v", header, test.data[:f.Size])
+	}
+	want := map[string][]byte{"filename": []byte("file.text\x00")}
+	if !reflect.DeepEqual(dynamic, want) {
+		t.Errorf("unexpected dynamic data: got:%q want:%q", dynamic, want)
+	}
+
+	_, _, err = f.Raw(test.data[:f.Size+4])
+	var derr *DataError
+	if !errors.As(err, &derr) || derr.Field != "filename" {
+		t.Errorf("unexpected error for truncated data: %v", err)
+	}
+}
+
+// commonAliasFormat is a format with an aliased standard header field name.
+const commonAliasFormat = `name: common_alias
+ID: 7050
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_lazy_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u32 value;	offset:8;	size:4;	signed:0;
+`
+
+func TestCommonAliasEmbed(t *testing.T) {
+	f, err := ParseFormat(strings.NewReader(commonAliasFormat), EmbedCommonFields())
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Type.Field(0).Type != commonFieldsType {
+		t.Fatalf("common fields not embedded for aliased header: %s", f.Type)
+	}
+	field, ok := f.FieldByName("common_preempt_lazy_count")
+	if !ok {
+		t.Fatal("missing aliased field")
+	}
+	if want := []int{0, 2}; !reflect.DeepEqual(field.Index, want) {
+		t.Errorf("unexpected index for aliased field: got:%v want:%v", field.Index, want)
+	}
+}
+
+func TestCommon(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   func(order binary.ByteOrder) []byte
+	}{
+		{
+			name: "classic",
+			format: `name: common_classic
+ID: 7050
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u32 value;	offset:8;	size:4;	signed:0;
+`,
+			data: func(order binary.ByteOrder) []byte {
+				data := make([]byte, 12)
+				order.PutUint16(data[0:], 7050)
+				data[2] = 0x3
+				data[3] = 0x1
+				order.PutUint32(data[4:], uint32(0xffffffff)) // -1
+				return data
+			},
+		},
+		{
+			name: "preempt_rt",
+			format: `name: common_rt
+ID: 7050
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+	field:unsigned char common_migrate_disable;	offset:8;	size:1;	signed:0;
+	field:unsigned char common_preempt_lazy_count;	offset:9;	size:1;	signed:0;
+
+	field:u32 value;	offset:12;	size:4;	signed:0;
+`,
+			data: func(order binary.ByteOrder) []byte {
+				data := make([]byte, 16)
+				order.PutUint16(data[0:], 7050)
+				data[2] = 0x3
+				data[3] = 0x1
+				order.PutUint32(data[4:], uint32(0xffffffff))
+				data[8] = 1
+				data[9] = 2
+				return data
+			},
+		},
+		{
+			name: "lock_depth",
+			format: `name: common_lock_depth
+ID: 7050
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_lock_depth;	offset:4;	size:4;	signed:1;
+	field:int common_pid;	offset:8;	size:4;	signed:1;
+
+	field:u32 value;	offset:12;	size:4;	signed:0;
+`,
+			data: func(order binary.ByteOrder) []byte {
+				data := make([]byte, 16)
+				order.PutUint16(data[0:], 7050)
+				data[2] = 0x3
+				data[3] = 0x1
+				order.PutUint32(data[4:], 5)
+				order.PutUint32(data[8:], uint32(0xffffffff))
+				return data
+			},
+		},
+		{
+			name:   "aliased",
+			format: commonAliasFormat,
+			data: func(order binary.ByteOrder) []byte {
+				data := make([]byte, 12)
+				order.PutUint16(data[0:], 7050)
+				data[2] = 0x3
+				data[3] = 0x1
+				order.PutUint32(data[4:], uint32(0xffffffff))
+				return data
+			},
+		},
+	}
+	want := CommonFields{
+		Common_type:          7050,
+		Common_flags:         0x3,
+		Common_preempt_count: 0x1,
+		Common_pid:           -1,
+	}
+	for _, test := range tests {
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			f, err := ParseFormat(strings.NewReader(test.format), ByteOrder(order))
+			if err != nil {
+				t.Fatalf("unexpected error parsing %s format: %v", test.name, err)
+			}
+			data := test.data(order)
+			got, err := f.Common(data)
+			if err != nil {
+				t.Errorf("unexpected error for %s %v: %v", test.name, order, err)
+				continue
+			}
+			if got != want {
+				t.Errorf("unexpected common fields for %s %v:\ngot: %+v\nwant:%+v", test.name, order, got, want)
+			}
+
+			_, err = f.Common(data[:6])
+			var dataErr *DataError
+			if !errors.As(err, &dataErr) {
+				t.Errorf("expected DataError for short %s %v data: %v", test.name, order, err)
+			}
+		}
+	}
+
+	f, err := ParseFormat(strings.NewReader("name: no_common\nID: 7051\nformat:\n" +
+		"\tfield:unsigned int fd;\toffset:0;\tsize:4;\tsigned:0;\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	_, err = f.Common(make([]byte, 4))
+	if err == nil {
+		t.Error("expected error for format without common fields")
+	}
+}
+
+func TestNewFormat(t *testing.T) {
+	for _, test := range unpackTests {
+		parsed, err := ParseFormat(strings.NewReader(test.format))
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", test.name, err)
+			continue
+		}
+		f, err := NewFormat(parsed.Name, parsed.ID, parsed.Fields)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.name, err)
+			continue
+		}
+		if f.Type != parsed.Type || f.Unpacked != parsed.Unpacked {
+			t.Errorf("unexpected types for %q:\ngot: %v %v\nwant:%v %v", test.name, f.Type, f.Unpacked, parsed.Type, parsed.Unpacked)
+		}
+		if f.Size != parsed.Size || f.GoSize != parsed.GoSize {
+			t.Errorf("unexpected size for %q: got:%d/%d want:%d/%d", test.name, f.Size, f.GoSize, parsed.Size, parsed.GoSize)
+		}
+		if !reflect.DeepEqual(f.Unaligned, parsed.Unaligned) {
+			t.Errorf("unexpected unaligned fields for %q: got:%v want:%v", test.name, f.Unaligned, parsed.Unaligned)
+		}
+
+		dst := reflect.New(f.Unpacked)
+		err = f.Unpack(dst, test.data)
+		if err != nil {
+			t.Errorf("unexpected error unpacking %q: %v", test.name, err)
+			continue
+		}
+		if got := dst.Elem().Interface(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected result for %q:\ngot: %#v\nwant:%#v", test.name, got, test.want)
+		}
+	}
+
+	fields := []Field{
+		{Name: "common_type", CType: "unsigned short", Offset: 0, Size: 2},
+		{Name: "value", CType: "u64", Offset: 4, Size: 8},
+		{Name: "name", CType: "string", Offset: 12, Size: 4},
+	}
+	f, err := NewFormat("synthetic", 7060, fields)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fields[0].Type != nil || fields[2].CType != "string" {
+		t.Error("unexpected modification of fields")
+	}
+	if f.Fields[2].CType != "__data_loc char[]" {
+		t.Errorf("unexpected C type for string fetcharg: %q", f.Fields[2].CType)
+	}
+	if len(f.Unaligned.Fields) != 1 || !f.Unaligned.DynamicArray {
+		t.Errorf("unexpected unaligned fields: %+v", f.Unaligned)
+	}
+	if f.Size != 16 {
+		t.Errorf("unexpected size: got:%d want:16", f.Size)
+	}
+
+	for _, bad := range [][]Field{
+		{{Name: "x y", CType: "u32", Offset: 0, Size: 4}},
+		{{Name: "x", CType: "u32", Offset: 0, Size: 0}},
+		{{Name: "x", CType: "symbol", Offset: 0, Size: 8}},
+		{{Name: "x", CType: "u32", Offset: 4, Size: 4}, {Name: "y", CType: "u32", Offset: 0, Size: 4}},
+	} {
+		_, err := NewFormat("bad", 7061, bad)
+		if err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestAllowShort(t *testing.T) {
+	const format = `name: short_test
+ID: 7064
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u32 a;	offset:8;	size:4;	signed:0;
+	field:__data_loc char[] s;	offset:12;	size:4;	signed:1;
+	field:u64 b;	offset:16;	size:8;	signed:0;
+	field:__data_loc char[] t;	offset:24;	size:4;	signed:1;
+`
+	data := make([]byte, 36)
+	machine.PutUint16(data[0:], 7064)
+	machine.PutUint32(data[8:], 1)
+	machine.PutUint32(data[12:], 2<<16|28)
+	machine.PutUint64(data[16:], 2)
+	machine.PutUint32(data[24:], 4<<16|30)
+	copy(data[28:], "s\x00t\x00\x00\x00")
+
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	// Truncate the record part way through b.
+	short := data[:20]
+	err = f.Unpack(reflect.New(f.Unpacked), short)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF without AllowShort: %v", err)
+	}
+
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, short, AllowShort())
+	var truncated *TruncatedError
+	if !errors.As(err, &truncated) {
+		t.Fatalf("expected TruncatedError: %v", err)
+	}
+	// The data for s lies beyond the end of the short record.
+	wantErr := &TruncatedError{Len: 28, Size: 20, Fields: []string{"s", "b", "t"}}
+	if !reflect.DeepEqual(truncated, wantErr) {
+		t.Errorf("unexpected error:\ngot: %+v\nwant:%+v", truncated, wantErr)
+	}
+	want := map[string]interface{}{
+		"common_type": uint16(7064),
+		"a":           uint32(1),
+		"s":           []byte(nil),
+		"b":           uint64(0),
+		"t":           []byte(nil),
+	}
+	for name, w := range want {
+		field, _ := f.FieldByName(name)
+		got := dst.Elem().FieldByIndex(field.Index).Interface()
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("unexpected value for %s: got:%#v want:%#v", name, got, w)
+		}
+	}
+
+	// Dynamic arrays with data in the short record are decoded.
+	machine.PutUint32(data[12:], 2<<16|8)
+	err = f.Unpack(dst, data[:20], AllowShort())
+	if !errors.As(err, &truncated) {
+		t.Fatalf("expected TruncatedError: %v", err)
+	}
+	field, _ := f.FieldByName("s")
+	if got := dst.Elem().FieldByIndex(field.Index).Bytes(); !bytes.Equal(got, data[8:10]) {
+		t.Errorf("unexpected value for s: got:%v want:%v", got, data[8:10])
+	}
+
+	// Fast path formats are also decoded by an Unpacker.
+	const aligned = `name: short_aligned_test
+ID: 7065
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u32 a;	offset:8;	size:4;	signed:0;
+	field:u32 b;	offset:12;	size:4;	signed:0;
+`
+	u := NewUnpacker(AllowShort())
+	_, err = u.Register(strings.NewReader(aligned))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	rec := make([]byte, 14)
+	machine.PutUint16(rec[0:], 7065)
+	machine.PutUint32(rec[8:], 3)
+	_, v, err := u.Unpack(rec)
+	if !errors.As(err, &truncated) || !reflect.DeepEqual(truncated.Fields, []string{"b"}) {
+		t.Fatalf("unexpected error from Unpacker: %v", err)
+	}
+	if got := v.Elem().Field(4).Uint(); got != 3 {
+		t.Errorf("unexpected value for a from Unpacker: got:%d want:3", got)
+	}
+}
+
+func TestNeedsUnpack(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		want   bool
+	}{
+		{name: "do_sys_open", format: unpackTests[0].format, want: true},
+		{name: "sys_read", format: sysReadFormat, want: false},
+	}
+	for _, test := range tests {
+		f, err := ParseFormat(strings.NewReader(test.format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %v", test.name, err)
+		}
+		if got := f.NeedsUnpack(); got != test.want {
+			t.Errorf("unexpected result for %s: got:%t want:%t", test.name, got, test.want)
+		}
+		_, _, _, _, err = Struct(strings.NewReader(test.format))
+		if _, ok := err.(UnalignedFieldsError); ok != test.want {
+			t.Errorf("unexpected Struct error for %s: %v", test.name, err)
+		}
+	}
+}
+
+func TestDecodeOne(t *testing.T) {
+	for _, test := range unpackTests {
+		data := append([]byte(nil), test.data...)
+		name, got, err := DecodeOne(strings.NewReader(test.format), data)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.name, err)
+			continue
+		}
+		f, _ := ParseFormat(strings.NewReader(test.format))
+		if name != f.Name {
+			t.Errorf("unexpected name for %q: got:%q want:%q", test.name, name, f.Name)
+		}
+		for i := range data {
+			data[i] = 0xff
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected result for %q:\ngot: %#v\nwant:%#v", test.name, got, test.want)
+		}
+	}
+
+	_, _, err := DecodeOne(strings.NewReader(unpackTests[0].format), unpackTests[0].data[:8])
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF for short data: %v", err)
+	}
+}
+
+func TestAliasedFields(t *testing.T) {
+	f, err := ParseFormat(strings.NewReader(unpackTests[0].format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	want := []string{"filename"}
+	if got := f.AliasedFields(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected aliased fields for do_sys_open: got:%q want:%q", got, want)
+	}
+	// Check the claim against the unpacked value.
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, unpackTests[0].data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if n := dynamicAllocs(f, dst, unpackTests[0].data); n != 0 {
+		t.Errorf("unexpected number of copied dynamic arrays: %d", n)
+	}
+
+	const format = `name: aliased_test
+ID: 7067
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc char[] name;	offset:8;	size:4;	signed:1;
+	field:__data_loc u32[] vals;	offset:12;	size:4;	signed:0;
+	field:u32 count;	offset:16;	size:4;	signed:0;
+`
+	var other binary.ByteOrder = binary.BigEndian
+	if machine == binary.BigEndian {
+		other = binary.LittleEndian
+	}
+	for _, test := range []struct {
+		order binary.ByteOrder
+		want  []string
+	}{
+		{order: machine, want: []string{"name", "vals"}},
+		{order: other, want: []string{"name"}},
+	} {
+		f, err := ParseFormat(strings.NewReader(format), ByteOrder(test.order))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		if got := f.AliasedFields(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected aliased fields for %v: got:%q want:%q", test.order, got, test.want)
+		}
+	}
+}
+
+func TestFieldElem(t *testing.T) {
+	var format string
+	for _, test := range formatTests {
+		if test.name == "ath10k_htt_stats" {
+			format = test.format
+			break
+		}
+	}
+	if format == "" {
+		t.Fatal("missing ath10k_htt_stats format")
+	}
+	for _, test := range []struct {
+		format string
+		want   map[string]reflect.Type
+	}{
+		{
+			format: format,
+			want: map[string]reflect.Type{
+				"device": reflect.TypeOf(uint8(0)),
+				"driver": reflect.TypeOf(uint8(0)),
+				"buf":    reflect.TypeOf(uint8(0)),
+			},
+		},
+		{
+			format: unpackTests[1].format, // gvt_command
+			want: map[string]reflect.Type{
+				"raw_cmd": reflect.TypeOf(uint32(0)),
+			},
+		},
+	} {
+		f, err := ParseFormat(strings.NewReader(test.format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		for _, field := range f.Fields {
+			want := test.want[field.Name]
+			if field.Elem != want {
+				t.Errorf("unexpected element type for %s %s: got:%v want:%v", f.Name, field.Name, field.Elem, want)
+			}
+			if want != nil {
+				if got := f.Unpacked.FieldByIndex(field.Index).Type.Elem(); got != want {
+					t.Errorf("inconsistent unpacked element type for %s %s: got:%v want:%v", f.Name, field.Name, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	test := unpackTests[0] // do_sys_open
+	all, err := ParseFormat(strings.NewReader(test.format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	f, err := ParseFormat(strings.NewReader(test.format), SelectFields("common_pid", "flags"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Size != all.Size {
+		t.Errorf("unexpected size: got:%d want:%d", f.Size, all.Size)
+	}
+	if f.GoSize < f.Size {
+		t.Errorf("struct smaller than record: GoSize=%d Size=%d", f.GoSize, f.Size)
+	}
+	if f.NeedsUnpack() {
+		t.Error("unexpected need for unpacking without selected dynamic arrays")
+	}
+	var names []string
+	for i := 0; i < f.Type.NumField(); i++ {
+		if name, ok := f.Type.Field(i).Tag.Lookup("name"); ok {
+			names = append(names, name)
+		}
+	}
+	if want := []string{"common_pid", "flags"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("unexpected struct fields: got:%q want:%q", names, want)
+	}
+	for _, field := range f.Fields {
+		selected := field.Name == "common_pid" || field.Name == "flags"
+		if (field.Index != nil) != selected {
+			t.Errorf("unexpected index for %s: %v", field.Name, field.Index)
+		}
+		if selected {
+			if got := f.Type.FieldByIndex(field.Index).Offset; int(got) != field.Offset {
+				t.Errorf("unexpected offset for %s: got:%d want:%d", field.Name, got, field.Offset)
+			}
+		}
+	}
+
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, test.data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	pid, _ := fieldByCName(dst, "common_pid")
+	flags, _ := fieldByCName(dst, "flags")
+	if pid.Int() != 32705 || flags.Uint() != 0x88241 {
+		t.Errorf("unexpected values: common_pid=%d flags=%#x", pid.Int(), flags.Uint())
+	}
+}
+
+func BenchmarkFieldByName(b *testing.B) {
+	f, err := ParseFormat(strings.NewReader(unpackTests[1].format)) // gvt_command
+	if err != nil {
+		b.Fatalf("unexpected error parsing format: %v", err)
+	}
+	linear := *f
+	linear.byName = nil
+	for _, bench := range []struct {
+		name string
+		f    *Format
+	}{
+		{name: "linear", f: &linear},
+		{name: "cached", f: f},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, ok := bench.f.FieldByName("cmd_name")
+				if !ok {
+					b.Fatal("missing field")
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,11 @@
 
 // Package kprobe provides a way to dynamically generate structs corresponding
 // to linux kprobe event messages and deserialise message data.
+//
+// Formats of kprobe, kretprobe, uprobe and tracepoint events are supported.
+// Return probe formats hold the __probe_func and __probe_ret_ip fields in
+// place of the __probe_ip field of entry probes; see Format.IsReturnProbe
+// and RetField.
 package kprobe
 
 import "C" // C imports is required for obtaining C type size information.
@@ -11,10 +16,14 @@ import "C" // C imports is required for obtaining C type size information.
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"go/token"
 	"io"
 	"math"
+	"math/bits"
 	"reflect"
 	"strconv"
 	"strings"
@@ -30,7 +39,8 @@ type UnalignedFieldsError struct {
 	Fields    []int  // Fields is a list of unaligned fields.
 	Unaligned []bool // Unaligned[i] is true for field i if it is unaligned.
 
-	// DynamicArray indicates the struct has a __data_loc field.
+	// DynamicArray indicates the struct has a __data_loc or
+	// __rel_loc field.
 	DynamicArray bool
 }
 
@@ -44,23 +54,115 @@ func (e UnalignedFieldsError) Error() string {
 	return fmt.Sprintf("unaligned fields in struct: %d", e.Fields)
 }
 
+// OffsetError is returned when the offset of a field in a kprobe event
+// format is before the end of the preceding field.
+type OffsetError struct {
+	Field  string // Field is the C name of the field.
+	Offset int    // Offset is the offset of the field.
+
+	// Previous is the C name of the preceding field and End
+	// is the offset of its end. Previous is empty if Field
+	// is the first field.
+	Previous string
+	End      int
+}
+
+func (e OffsetError) Error() string {
+	if e.Previous == "" {
+		return fmt.Sprintf("invalid offset for field %s: %d", e.Field, e.Offset)
+	}
+	return fmt.Sprintf("invalid offset for field %s: %d is before end of %s at %d", e.Field, e.Offset, e.Previous, e.End)
+}
+
+// FieldCountError is returned by Unpack when the number of fields of the
+// destination struct does not match the number of fields of the source
+// struct, or of the unaligned field description.
+type FieldCountError struct {
+	// Unaligned indicates the count of the unaligned
+	// field description did not match the destination.
+	Unaligned bool
+
+	// Got is the number of fields of the destination,
+	// or of the unaligned field description if Unaligned
+	// is true, and Want is the number expected.
+	Got, Want int
+}
+
+func (e FieldCountError) Error() string {
+	if e.Unaligned {
+		return fmt.Sprintf("mismatched unaligned field count: %d != %d", e.Got, e.Want)
+	}
+	return fmt.Sprintf("mismatched field count: %d != %d", e.Got, e.Want)
+}
+
+// FieldSizeError is returned by Unpack when the size of an unaligned
+// destination field cannot hold the source field.
+type FieldSizeError struct {
+	Index   int // Index is the index of the field.
+	DstSize int // DstSize is the size of the destination field.
+	SrcSize int // SrcSize is the size of the source field.
+}
+
+func (e FieldSizeError) Error() string {
+	return fmt.Sprintf("mismatched size for field %d: %d != %d", e.Index, e.DstSize, e.SrcSize)
+}
+
+// FieldKindError is returned by Unpack when an unaligned field of the
+// packed source struct has a kind that cannot be unpacked. Unaligned
+// fields of the source must be byte arrays.
+type FieldKindError struct {
+	Index int          // Index is the index of the field.
+	Kind  reflect.Kind // Kind is the invalid kind of the source field.
+}
+
+func (e FieldKindError) Error() string {
+	return fmt.Sprintf("invalid kind for field %d: %v", e.Index, e.Kind)
+}
+
 // Struct returns a struct corresponding to the kprobe event format in r,
 // along with the probe's name and id. See StructPkg for details. Padding
 // fields use the kprobe package's package path.
-func Struct(r io.Reader) (typ reflect.Type, name string, id uint16, size int, err error) {
-	return StructPkg(r, pkgPath)
+func Struct(r io.Reader, opts ...Option) (typ reflect.Type, name string, id uint16, size int, err error) {
+	return StructPkg(r, pkgPath, opts...)
+}
+
+// StructAuto is like Struct, but if the data in r is gzip-compressed it is
+// transparently decompressed. Uncompressed data is parsed as by Struct.
+func StructAuto(r io.Reader, opts ...Option) (typ reflect.Type, name string, id uint16, size int, err error) {
+	r, err = decompress(r)
+	if err != nil {
+		return nil, "", 0, 0, err
+	}
+	return Struct(r, opts...)
+}
+
+// decompress returns a reader yielding the decompressed contents of r if r
+// holds gzip-compressed data, and the contents of r otherwise.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return br, nil
+	}
+	return gzip.NewReader(br)
 }
 
 // pkgPath is the dynamically determined package path for this package.
 var pkgPath = reflect.TypeOf(struct{ _ [0]byte }{}).Field(0).PkgPath
 
 // StructPkg returns a struct corresponding to the kprobe event format in r,
-// along with the probe's name and id. With padding fields using the package
-// path, pkg. StructPkg attempts to construct the struct with the same types as
-// specified by the event format, but in cases where this is not possible
-// due to alignment, the unaligned fields will be represented as byte arrays
-// of the same size and the field indices will be returned in an
-// UnalignedFieldsError.
+// along with the probe's name and id, with padding fields using the package
+// path, pkg, which must be a valid import path. StructPkg attempts to
+// construct the struct with the same types as specified by the event format,
+// but in cases where this is not possible due to alignment, the unaligned
+// fields will be represented as byte arrays of the same size and the field
+// indices will be returned in an UnalignedFieldsError. A field is aligned if
+// its offset is a multiple of the Go alignment of its type; for fixed-size
+// arrays this is the alignment of the element type, so arrays of byte-sized
+// elements such as u8[8] and char[40] are never unaligned.
 //
 // C type information and the original C field names are included in struct
 // field tags.
@@ -70,7 +172,8 @@ var pkgPath = reflect.TypeOf(struct{ _ [0]byte }{}).Field(0).PkgPath
 //  - unaligned: additional type information for packed fields.
 //
 // Padding fields will include a struct field tag, "bytes", indicating the byte
-// range of the message that the padding spans.
+// range of the message that the padding spans. Padding fields are named with
+// the blank identifier unless the WithPadName option is used.
 //
 // Structs referencing dynamic arrays or string data hold a 32 bit unsigned
 // value that points to the data with a ctyp field tag with the prefix
@@ -82,113 +185,499 @@ var pkgPath = reflect.TypeOf(struct{ _ [0]byte }{}).Field(0).PkgPath
 //   #define __get_dynamic_array_len(field)
 //     ((__entry->__data_loc_##field >> 16) & 0xffff)
 //
-func StructPkg(r io.Reader, pkg string) (typ reflect.Type, name string, id uint16, size int, err error) {
+// Fields with a ctyp field tag with the prefix __rel_loc are similar, but
+// the offset is relative to the end of the field:
+//
+//   #define __get_rel_dynamic_array(field)
+//     ((void *)__entry +
+//      offsetof(typeof(*__entry), __rel_loc_##field) +
+//      sizeof(__entry->__rel_loc_##field) +
+//      (__entry->__rel_loc_##field & 0xffff))
+//
+// The element type of a dynamic array is determined by its C type. Dynamic
+// arrays of plain char are represented as []byte irrespective of the signed
+// column of the format since they are usually strings. For other element
+// types, a signed column that is inconsistent with the C type is an error.
+// Dynamic arrays of 128 bit integers are represented as [][16]byte holding
+// the bytes of each element as they appear in the event data.
+//
+// The size of the fixed portion of an event record is the end of its final
+// field unless the RecordSize option gives the total size of the record, in
+// which case the struct is padded after the final field to that size.
+//
+// Lines of the format may be up to 1MiB long, allowing for long print fmt
+// lines; the limit may be changed with the MaxLineLen option.
+//
+// The parsing behaviour may be modified by the provided options. The
+// WithLogf option may be used to report the fields that cause the struct
+// to require unpacking as they are found.
+func StructPkg(r io.Reader, pkg string, opts ...Option) (typ reflect.Type, name string, id uint16, size int, err error) {
+	if !isImportPath(pkg) {
+		return nil, "", 0, 0, fmt.Errorf("invalid package path: %q", pkg)
+	}
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, "", 0, 0, err
+	}
+	f, err := parseFormat(r, pkg, cfg)
+	if err != nil {
+		if f != nil {
+			return nil, f.Name, f.ID, 0, err
+		}
+		return nil, "", 0, 0, err
+	}
+	if len(f.Unaligned.Fields) != 0 || f.Unaligned.DynamicArray {
+		err = f.Unaligned
+	}
+	return f.Type, f.Name, f.ID, f.Size, err
+}
+
+// isImportPath returns whether pkg is a plausible package import path.
+// Elements of the path must be non-empty and may only contain letters,
+// digits and the punctuation allowed in module paths.
+func isImportPath(pkg string) bool {
+	if pkg == "" {
+		return false
+	}
+	for _, elem := range strings.Split(pkg, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return false
+		}
+		for _, r := range elem {
+			switch {
+			case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			case strings.ContainsRune("-._~+", r):
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseFormat parses the kprobe event format in r, using pkg as the package
+// path for padding fields. If the error is the result of failing to generate
+// a correct struct type for a valid format, the returned Format holds the
+// name and ID of the event.
+func parseFormat(r io.Reader, pkg string, cfg *config) (*Format, error) {
+	var f Format
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, cfg.maxLineLen())
 	var (
-		fields    []reflect.StructField
-		unaligned UnalignedFieldsError
+		print    []string
+		inFormat bool
 	)
-	sc := bufio.NewScanner(r)
-	var i, padIdx, nextOffset int
-	seen := make(map[string]bool)
 	for sc.Scan() {
 		b := sc.Bytes()
+		if print != nil {
+			print = append(print, sc.Text())
+			continue
+		}
 		switch {
 		case bytes.HasPrefix(b, []byte("\tfield:")):
-			f := strings.Split(strings.TrimPrefix(sc.Text(), "\t"), "\t")
-			if len(f) != 4 {
-				return nil, "", 0, 0, fmt.Errorf("invalid field line: %q", b)
+			field, err := parseField(sc.Text())
+			if err != nil {
+				return nil, err
 			}
-			ctyp, field, err := fieldName(f[0])
+			f.Fields = append(f.Fields, field)
+		case bytes.HasPrefix(b, []byte("name: ")):
+			f.Name = string(bytes.TrimPrefix(b, []byte("name: ")))
+		case bytes.HasPrefix(b, []byte("ID: ")):
+			id, err := parseID(strings.TrimPrefix(sc.Text(), "ID: "))
 			if err != nil {
-				return nil, "", 0, 0, err
+				return nil, err
+			}
+			f.ID = id
+		case bytes.HasPrefix(b, []byte("print fmt: ")):
+			print = []string{string(bytes.TrimPrefix(b, []byte("print fmt: ")))}
+		case bytes.Equal(bytes.TrimSpace(b), []byte("format:")):
+			inFormat = true
+		case !inFormat:
+			key, val, ok := headerLine(sc.Text())
+			if !ok {
+				continue
 			}
-			if strings.HasPrefix(ctyp, "__data_loc") {
-				unaligned.DynamicArray = true
+			if f.Header == nil {
+				f.Header = make(map[string]string)
 			}
-			offset, err := offset(f[1])
+			f.Header[key] = val
+		}
+	}
+	err := sc.Err()
+	if err != nil {
+		return nil, err
+	}
+	f.Order = cfg.byteOrder()
+	f.PrintFmt = strings.TrimRight(strings.Join(print, "\n"), "\n")
+	f.print, _ = parsePrintFmt(f.PrintFmt)
+	if f.print != nil {
+		for _, arg := range f.print.args {
+			f.annotate(arg)
+			f.PrintFields = f.appendFieldRefs(f.PrintFields, arg)
+		}
+		f.label(f.print)
+	}
+
+	fields, err := f.layout(pkg, cfg.recordSize, cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = f.structOf(fields)
+	if err != nil {
+		return &f, err
+	}
+	return &f, nil
+}
+
+// structOf sets f's Type and GoSize to correspond to the struct fields
+// returned by f.layout, checking that the offsets of the constructed type
+// match the layout.
+func (f *Format) structOf(fields []reflect.StructField) error {
+	f.Type = reflect.StructOf(fields)
+	f.GoSize = int(f.Type.Size())
+	for _, want := range fields {
+		got, ok := fieldByNameOrPad(f.Type, want.Name, want.Tag.Get("pad"))
+		if !ok {
+			return fmt.Errorf("lost field %s", got.Name)
+		}
+		if got.Offset != want.Offset {
+			return fmt.Errorf("could not generate correct field offset for %s: %d != %d", got.Name, got.Offset, want.Offset)
+		}
+	}
+	return nil
+}
+
+// headerLine returns the key and value of a key: value header line. Comment
+// lines starting with # are not header lines.
+func headerLine(line string) (key, val string, ok bool) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	key, val, ok = strings.Cut(line, ":")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(val), true
+}
+
+// parseID parses the ID of a format. The ID may be decimal or hexadecimal
+// with a 0x prefix. Leading zeros of decimal IDs do not indicate octal.
+func parseID(s string) (uint16, error) {
+	s = strings.TrimSpace(s)
+	digits, base := s, 10
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		digits, base = s[2:], 16
+	}
+	id, err := strconv.ParseUint(digits, base, 16)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, fmt.Errorf("format id overflows uint16: %q", s)
+		}
+		return 0, fmt.Errorf("invalid format id: %q", s)
+	}
+	return uint16(id), nil
+}
+
+// parseField parses a field line of a kprobe format description. The
+// tab-separated columns of the line are identified by their key prefix,
+// so they may be in any order, and unknown columns are ignored.
+func parseField(line string) (Field, error) {
+	cols := make(map[string]string)
+	for _, col := range strings.Split(strings.TrimPrefix(line, "\t"), "\t") {
+		col = strings.TrimSpace(col)
+		key, _, ok := strings.Cut(col, ":")
+		if !ok {
+			continue
+		}
+		if _, dup := cols[key]; dup {
+			return Field{}, fmt.Errorf("duplicate %s column in field line: %q", key, line)
+		}
+		cols[key] = col
+	}
+	for _, key := range []string{"field", "offset", "size", "signed"} {
+		if _, ok := cols[key]; !ok {
+			return Field{}, fmt.Errorf("invalid field line: missing %s column: %q", key, line)
+		}
+	}
+	ctyp, name, err := fieldName(cols["field"])
+	if err != nil {
+		return Field{}, err
+	}
+	offset, err := offset(cols["offset"])
+	if err != nil {
+		return Field{}, err
+	}
+	size, signed, err := sizeSigned(cols["size"], cols["signed"])
+	if err != nil {
+		return Field{}, err
+	}
+	ctyp, err = fetchargType(ctyp)
+	if err != nil {
+		return Field{}, fmt.Errorf("field %s: %w", name, err)
+	}
+	return Field{Name: name, CType: ctyp, Offset: offset, Size: size, Signed: signed}, nil
+}
+
+// fetchargType returns the C type corresponding to the probe fetch argument
+// type, ctyp. The string and ustring fetch argument types used by kprobe and
+// uprobe events are held as dynamic char arrays and are returned as
+// "__data_loc char[]". The symbol, symstr and bitfield fetch argument types
+// are not supported. Other types are returned unaltered.
+func fetchargType(ctyp string) (string, error) {
+	switch {
+	case ctyp == "string", ctyp == "ustring":
+		return "__data_loc char[]", nil
+	case ctyp == "symbol", ctyp == "symstr", strings.HasPrefix(ctyp, "bitfield"), isBitfieldType(ctyp):
+		return "", fmt.Errorf("unsupported fetcharg type: %q", ctyp)
+	default:
+		return ctyp, nil
+	}
+}
+
+// isBitfieldType returns whether ctyp is a fetch argument bitfield type of
+// the form b<bit-width>@<bit-offset>/<container-size>.
+func isBitfieldType(ctyp string) bool {
+	if !strings.HasPrefix(ctyp, "b") {
+		return false
+	}
+	width, rest, ok := strings.Cut(ctyp[1:], "@")
+	if !ok {
+		return false
+	}
+	off, size, ok := strings.Cut(rest, "/")
+	if !ok {
+		return false
+	}
+	for _, s := range []string{width, off, size} {
+		if _, err := strconv.ParseUint(s, 10, 8); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// layout returns the struct fields, including padding, for the fields of f
+// and fills in the Index field of each field. It also sets the size and
+// alignment information for f. If recordSize is not zero, it is the total
+// size of the fixed portion of the record and the struct is padded from the
+// end of the final field to recordSize.
+func (f *Format) layout(pkg string, recordSize int, cfg *config) ([]reflect.StructField, error) {
+	var (
+		fields    []reflect.StructField
+		unaligned UnalignedFieldsError
+	)
+	var padIdx, nextOffset, size int
+	seen := make(map[string]bool)
+	start := 0
+	if cfg.embedCommon && hasCommonFields(f.Fields) {
+		fields = append(fields, reflect.StructField{
+			Name:      commonFieldsType.Name(),
+			Type:      commonFieldsType,
+			Anonymous: true,
+		})
+		seen[commonFieldsType.Name()] = true
+		for i := 0; i < commonFieldsType.NumField(); i++ {
+			common := commonFieldsType.Field(i)
+			seen[common.Name] = true
+			f.Fields[i].Index = []int{0, i}
+			f.Fields[i].Type = common.Type
+		}
+		start = commonFieldsType.NumField()
+		nextOffset = int(commonFieldsType.Size())
+		size = nextOffset
+	}
+	for i := start; i < len(f.Fields); i++ {
+		field := &f.Fields[i]
+		ctyp := field.CType
+		if cfg.selected != nil && !cfg.selected[field.Name] {
+			// The field is not selected, so leave it
+			// out and let padding cover its bytes.
+			var err error
+			field.Type, _, err = integerType(field.Size, field.Signed, ctyp, field.Offset, false, cfg)
 			if err != nil {
-				return nil, "", 0, 0, err
+				return nil, err
+			}
+			if end := field.Offset + field.Size; end > size {
+				size = end
 			}
-			typ, size, fallback, err := integerType(f[2], f[3], ctyp, offset, true)
+			continue
+		}
+		if elem, ok := dynamicElement(ctyp); ok {
+			unaligned.DynamicArray = true
+			err := checkDynamicSigned(elem, field.Signed)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", field.Name, err)
+			}
+			if typ, err := dynamicArray(elem); err == nil {
+				field.Elem = typ.Elem()
+			}
+		}
+		// Fields are preceded by explicit padding to their offset,
+		// so Go inserts alignment padding before a field exactly
+		// when its offset is not a multiple of the alignment of its
+		// type. integerType represents such fields as byte arrays,
+		// ensuring that the struct has the kernel's packed layout
+		// and that the field is reconstructed on the slow path.
+		typ, fallback, err := integerType(field.Size, field.Signed, ctyp, field.Offset, true, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.strict {
+			err = checkType(ctyp, field.Size, cfg)
 			if err != nil {
-				return nil, "", 0, 0, err
-			}
-			var tag reflect.StructTag
-			if fallback {
-				unaligned.Fields = append(unaligned.Fields, i+padIdx)
-				tag = reflect.StructTag(fmt.Sprintf(`ctyp:%q name:%q unaligned:"%s %s"`,
-					ctyp, field, f[2], f[3]))
-			} else {
-				tag = reflect.StructTag(fmt.Sprintf(`ctyp:%q name:%q`, ctyp, field))
-			}
-			pad := offset - nextOffset
-			if pad < 0 {
-				return nil, "", 0, 0, fmt.Errorf("invalid offset for field %d: %d", i, offset)
-			}
-			if pad > 0 {
-				fields = append(fields, reflect.StructField{
-					Name: "_",
-					Tag: reflect.StructTag(fmt.Sprintf(`pad:"%d" bytes:"[%d:%d]"`,
-						padIdx, nextOffset, nextOffset+pad)),
-					PkgPath: pkg,
-					Type:    reflect.ArrayOf(pad, reflect.TypeOf(uint8(0))),
-					Offset:  uintptr(nextOffset),
-				})
-				padIdx++
-			}
-			fname := export(field)
+				return nil, err
+			}
+		} else if cfg.logf != nil {
+			if err := checkType(ctyp, field.Size, cfg); err != nil {
+				cfg.log("%s: field %s: %v", f.Name, field.Name, err)
+			}
+		}
+		var tag reflect.StructTag
+		if fallback {
+			tag = reflect.StructTag(fmt.Sprintf(`ctyp:%q name:%q unaligned:"size:%d; signed:%d;"`,
+				ctyp, field.Name, field.Size, b2i(field.Signed)))
+		} else {
+			tag = reflect.StructTag(fmt.Sprintf(`ctyp:%q name:%q`, ctyp, field.Name))
+		}
+		pad := field.Offset - nextOffset
+		if pad < 0 && cfg.allowOverlap && field.Offset >= 0 {
+			// The field overlaps a preceding field, so it can
+			// not be represented in the struct. Record its Go
+			// type for manual decoding and leave it out.
+			fname := export(field.Name)
 			if seen[fname] {
-				return nil, "", 0, 0, fmt.Errorf("duplicate field name: %s", fname)
+				return nil, fmt.Errorf("duplicate field name: %s", fname)
 			}
 			seen[fname] = true
-			fields = append(fields, reflect.StructField{
-				Name:   fname,
-				Type:   typ,
-				Tag:    tag,
-				Offset: uintptr(offset),
-			})
-			nextOffset = offset + size
-			i++
-		case bytes.HasPrefix(b, []byte("name: ")):
-			name = string(bytes.TrimPrefix(b, []byte("name: ")))
-		case bytes.HasPrefix(b, []byte("ID: ")):
-			n, err := strconv.Atoi(strings.TrimPrefix(sc.Text(), "ID: "))
+			field.Type, _, err = integerType(field.Size, field.Signed, ctyp, field.Offset, false, cfg)
 			if err != nil {
-				return nil, "", 0, 0, err
+				return nil, err
+			}
+			f.Warnings = append(f.Warnings, Warning{Index: -1, Name: field.Name, Category: OverlappingField})
+			f.overlaps = true
+			cfg.log("%s: field %s: overlapping field at offset %d omitted from struct", f.Name, field.Name, field.Offset)
+			if end := field.Offset + field.Size; end > size {
+				size = end
 			}
-			if n > math.MaxUint16 {
-				return nil, "", 0, 0, fmt.Errorf("format id overflows uint16: %d", n)
+			continue
+		}
+		if pad < 0 {
+			err := OffsetError{Field: field.Name, Offset: field.Offset, End: nextOffset}
+			if i > 0 {
+				err.Previous = f.Fields[i-1].Name
+			}
+			return nil, err
+		}
+		if pad > 0 {
+			padField, err := padField(padIdx, pkg, cfg, seen)
+			if err != nil {
+				return nil, err
 			}
-			id = uint16(n)
+			padField.Tag = reflect.StructTag(fmt.Sprintf(`pad:"%d" bytes:"[%d:%d]"`,
+				padIdx, nextOffset, nextOffset+pad))
+			padField.Type = reflect.ArrayOf(pad, reflect.TypeOf(uint8(0)))
+			padField.Offset = uintptr(nextOffset)
+			fields = append(fields, padField)
+			padIdx++
+		}
+		fname := export(field.Name)
+		if seen[fname] {
+			return nil, fmt.Errorf("duplicate field name: %s", fname)
+		}
+		seen[fname] = true
+		if fallback {
+			unaligned.Fields = append(unaligned.Fields, len(fields))
+			f.Warnings = append(f.Warnings, Warning{Index: len(fields), Name: field.Name, Category: UnalignedField})
+			cfg.log("%s: field %s: unaligned %s at offset %d represented as %s", f.Name, field.Name, ctyp, field.Offset, typ)
+		}
+		if _, ok := dynamicElement(ctyp); ok {
+			f.Warnings = append(f.Warnings, Warning{Index: len(fields), Name: field.Name, Category: DynamicArrayField})
+			cfg.log("%s: field %s: dynamic array %s", f.Name, field.Name, ctyp)
+		}
+		field.Index = []int{len(fields)}
+		field.Type = typ
+		fields = append(fields, reflect.StructField{
+			Name:   fname,
+			Type:   typ,
+			Tag:    tag,
+			Offset: uintptr(field.Offset),
+		})
+		nextOffset = field.Offset + field.Size
+		if nextOffset > size {
+			size = nextOffset
 		}
 	}
-	err = sc.Err()
-	if err != nil {
-		return nil, "", 0, 0, err
+	if cfg.selected != nil && recordSize == 0 {
+		// Pad the struct over any trailing fields that
+		// were not selected.
+		recordSize = size
 	}
-	typ = reflect.StructOf(fields)
-	for _, want := range fields {
-		got, ok := fieldByNameOrPad(typ, want.Name, want.Tag.Get("pad"))
-		if !ok {
-			return nil, name, id, 0, fmt.Errorf("lost field %s", got.Name)
+	if recordSize != 0 {
+		if recordSize < size {
+			return nil, fmt.Errorf("invalid record size: %d is before end of fields at %d", recordSize, size)
 		}
-		if got.Offset != want.Offset {
-			return nil, name, id, 0, fmt.Errorf("could not generate correct field offset for %s: %d != %d", got.Name, got.Offset, want.Offset)
+		if pad := recordSize - nextOffset; pad > 0 {
+			padField, err := padField(padIdx, pkg, cfg, seen)
+			if err != nil {
+				return nil, err
+			}
+			padField.Tag = reflect.StructTag(fmt.Sprintf(`pad:"%d" bytes:"[%d:%d]"`,
+				padIdx, nextOffset, recordSize))
+			padField.Type = reflect.ArrayOf(pad, reflect.TypeOf(uint8(0)))
+			padField.Offset = uintptr(nextOffset)
+			fields = append(fields, padField)
 		}
+		size = recordSize
 	}
 	if len(unaligned.Fields) != 0 || unaligned.DynamicArray {
 		unaligned.Unaligned = make([]bool, len(fields))
 		for _, i := range unaligned.Fields {
 			unaligned.Unaligned[i] = true
 		}
-		err = unaligned
+	}
+	f.Unaligned = unaligned
+
+	f.byName = make(map[string]int, len(f.Fields))
+	for i, field := range f.Fields {
+		if _, ok := f.byName[field.Name]; !ok {
+			f.byName[field.Name] = i
+		}
 	}
 
 	// We cannot use unsafe.Sizeof or reflect Type.Size to determine
 	// the struct size because the finale field may be padded.
-	size = nextOffset
+	f.Size = size
+
+	return fields, nil
+}
 
-	return typ, name, id, size, err
+// padField returns a named padding field for the padding with index i. The
+// field is named with the blank identifier unless the configuration holds
+// a padding naming function. Unexported padding fields use the package path
+// pkg.
+//
+// Padding is represented as blank or unexported byte array fields, which
+// reflect.StructOf accepts and lays out at their natural offsets from Go
+// 1.18, the minimum Go version supported by this package. The offsets of
+// the generated struct types are checked against the format by structOf.
+func padField(i int, pkg string, cfg *config, seen map[string]bool) (reflect.StructField, error) {
+	if cfg.padName == nil {
+		return reflect.StructField{Name: "_", PkgPath: pkg}, nil
+	}
+	name := cfg.padName(i)
+	if !isIdentifier(name) || name == "_" {
+		return reflect.StructField{}, fmt.Errorf("invalid padding field name: %q", name)
+	}
+	if seen[name] {
+		return reflect.StructField{}, fmt.Errorf("duplicate field name: %s", name)
+	}
+	seen[name] = true
+	if token.IsExported(name) {
+		return reflect.StructField{Name: name}, nil
+	}
+	return reflect.StructField{Name: name, PkgPath: pkg}, nil
 }
 
 // fieldByNameOrPad returns the struct field with the given name or if
@@ -210,21 +699,32 @@ func fieldByNameOrPad(typ reflect.Type, name, pad string) (reflect.StructField,
 }
 
 // UnpackedStructFor returns an unpacked struct type equivalent to typ, which must
-// have been create with a call to Struct.
-func UnpackedStructFor(typ reflect.Type) (reflect.Type, error) {
+// have been create with a call to Struct. Options affecting type resolution
+// should match those used to create typ.
+func UnpackedStructFor(typ reflect.Type, opts ...Option) (reflect.Type, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return unpackedStructFor(typ, cfg)
+}
+
+func unpackedStructFor(typ reflect.Type, cfg *config) (reflect.Type, error) {
 	fields := make([]reflect.StructField, typ.NumField())
 	for i := range fields {
 		f := typ.Field(i)
+		if _, ok := f.Tag.Lookup("pad"); ok {
+			f.Type = reflect.ArrayOf(0, reflect.TypeOf(uint8(0)))
+			fields[i] = f
+			continue
+		}
 		if !f.IsExported() {
-			if f.Name == "_" {
-				f.Type = reflect.ArrayOf(0, reflect.TypeOf(uint8(0)))
-			}
 			fields[i] = f
 			continue
 		}
 
-		if ctyp := f.Tag.Get("ctyp"); strings.HasPrefix(ctyp, "__data_loc") {
-			typ, err := dynamicArray(strings.TrimPrefix(ctyp, "__data_loc "))
+		if elem, ok := dynamicElement(f.Tag.Get("ctyp")); ok {
+			typ, err := dynamicArray(elem)
 			if err != nil {
 				return nil, err
 			}
@@ -235,6 +735,9 @@ func UnpackedStructFor(typ reflect.Type) (reflect.Type, error) {
 
 		unaligned, ok := f.Tag.Lookup("unaligned")
 		if !ok {
+			if cfg.widen(f.Tag.Get("ctyp")) {
+				f.Type = widenedType(f.Type)
+			}
 			fields[i] = f
 			continue
 		}
@@ -246,11 +749,17 @@ func UnpackedStructFor(typ reflect.Type) (reflect.Type, error) {
 		if !ok {
 			return nil, fmt.Errorf("missing ctyp tag for unaligned field %s: %#q", f.Name, f.Tag)
 		}
-		var err error
-		f.Type, _, _, err = integerType(tf[0], tf[1], ctyp, int(f.Offset), false)
+		size, signed, err := sizeSigned(tf[0], tf[1])
+		if err != nil {
+			return nil, err
+		}
+		f.Type, _, err = integerType(size, signed, ctyp, int(f.Offset), false, cfg)
 		if err != nil {
 			return nil, err
 		}
+		if cfg.widen(ctyp) {
+			f.Type = widenedType(f.Type)
+		}
 		f.Tag = f.Tag[:strings.Index(string(f.Tag), " unaligned")]
 		fields[i] = f
 	}
@@ -279,8 +788,97 @@ func init() {
 // event message, required for unpacking dynamic array data. Dynamic arrays
 // and strings do not have any terminating null bytes removed. If data is
 // used during unpacking, the destination struct retains a reference to the
+// memory in data; use UnpackCopy if data will be reused, or Clone to detach
+// an unpacked value from data after the fact.
+//
+// Single byte C bool fields are represented as Go bool fields and any
+// non-zero value in the event record is unpacked as true.
+//
+// Unaligned integer fields may be unpacked into wider integer fields of a
+// dst type constructed by the caller. Signed values are sign-extended from
+// the width of the field in the event record.
+//
+// The dst value may be reused across calls to avoid allocating a destination
+// for each event. Every field of dst is overwritten, with empty dynamic
+// arrays set to nil, so no values from a previous event are retained. Slices
+// held by dst from a previous call are not modified.
+//
+// Integer fields and arrays, multi-byte elements of dynamic arrays, the
+// dynamic array locators and reconstructed unaligned fields are decoded
+// using the byte order set by the ByteOrder option, defaulting to the host
+// byte order. When the byte order matches the host, multi-byte dynamic
+// arrays alias data; otherwise they are decoded into newly allocated slices.
+// Fields of non-integer types provided by a type map are copied from src in
+// host byte order.
+func Unpack(dst, src reflect.Value, unaligned UnalignedFieldsError, data []byte, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	return unpack(dst, src, unaligned, data, cfg)
+}
+
+// UnpackCopy is like Unpack, but dynamic arrays and strings are always copied
+// into newly allocated slices, so dst does not retain any reference to the
 // memory in data.
-func Unpack(dst, src reflect.Value, unaligned UnalignedFieldsError, data []byte) error {
+func UnpackCopy(dst, src reflect.Value, unaligned UnalignedFieldsError, data []byte, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	cfg.copy = true
+	return unpack(dst, src, unaligned, data, cfg)
+}
+
+// Clone returns a deep copy of the struct or pointer to struct, v, such as
+// a value returned by Unpacker.Unpack or unpacked by Unpack. Slice fields
+// of the copy are given newly allocated backing arrays, so the returned
+// value does not retain any reference to the memory of the event data v
+// was unpacked from and remains valid after that data is reused. If v is a
+// pointer, the returned value is a pointer to a new struct.
+func Clone(v reflect.Value) reflect.Value {
+	ptr := v.Kind() == reflect.Ptr
+	if ptr {
+		v = v.Elem()
+	}
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	detachSlices(c)
+	if ptr {
+		return c.Addr()
+	}
+	return c
+}
+
+// detachSlices replaces the slices held in the settable value v, and in any
+// struct or array fields of v, with copies.
+func detachSlices(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(s, v)
+		for i := 0; i < s.Len(); i++ {
+			detachSlices(s.Index(i))
+		}
+		v.Set(s)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			detachSlices(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				detachSlices(f)
+			}
+		}
+	}
+}
+
+func unpack(dst, src reflect.Value, unaligned UnalignedFieldsError, data []byte, cfg *config) error {
+	order := cfg.byteOrder()
 	if !isStructPointer(dst) {
 		return fmt.Errorf("invalid type: %T", dst)
 	}
@@ -292,10 +890,10 @@ func Unpack(dst, src reflect.Value, unaligned UnalignedFieldsError, data []byte)
 	src = src.Elem()
 	nSrc := src.NumField()
 	if nDst != nSrc {
-		return fmt.Errorf("mismatched field count: %d != %d", nDst, nSrc)
+		return FieldCountError{Got: nDst, Want: nSrc}
 	}
 	if unaligned.Unaligned != nil && len(unaligned.Unaligned) != nDst {
-		return fmt.Errorf("mismatched unaligned field count: %d != %d", len(unaligned.Unaligned), nDst)
+		return FieldCountError{Unaligned: true, Got: len(unaligned.Unaligned), Want: nDst}
 	}
 	dstTyp := dst.Type()
 	srcTyp := src.Type()
@@ -306,119 +904,440 @@ func Unpack(dst, src reflect.Value, unaligned UnalignedFieldsError, data []byte)
 		if !dstTyp.Field(i).IsExported() || !srcTyp.Field(i).IsExported() {
 			continue
 		}
-		if ctyp := srcTyp.Field(i).Tag.Get("ctyp"); strings.HasPrefix(ctyp, "__data_loc") {
+		if _, ok := srcTyp.Field(i).Tag.Lookup("pad"); ok {
+			continue
+		}
+		ctyp := srcTyp.Field(i).Tag.Get("ctyp")
+		if elem, ok := dynamicElement(ctyp); ok {
 			typ := srcTyp.Field(i).Type
 			if typ.Kind() != reflect.Uint32 {
 				return fmt.Errorf("invalid type for dynamic array: %s", typ)
 			}
-			v := src.Field(i).Uint()
-			off := int(v & 0xffff)
-			n := int(v >> 16)
+			v := uint32(src.Field(i).Uint())
+			if order != machine {
+				v = bits.ReverseBytes32(v)
+			}
+			off, n := dynamicLocation(ctyp, v, int(srcTyp.Field(i).Offset))
+			class, ok := dynamicClass(elem)
+			if !ok {
+				return fmt.Errorf("unsupported dynamic array element type: %s", elem)
+			}
+			if length, ok := cfg.lengths[srcTyp.Field(i).Tag.Get("name")]; ok {
+				l, err := lengthFieldValue(src, length, cfg.fieldOrder(length, order))
+				if err != nil {
+					return fmt.Errorf("field %s: %w", srcTyp.Field(i).Tag.Get("name"), err)
+				}
+				n = l * class.size
+			}
+			if limit := cfg.maxDynamicLen(); n > limit {
+				return fmt.Errorf("dynamic data too long for field %s: len=%d exceeds limit of %d", srcTyp.Field(i).Tag.Get("name"), n, limit)
+			}
 			if off > len(data) || off+n > len(data) {
 				return fmt.Errorf("invalid dynamic data indexes: offset=%d len=%d", off, n)
 			}
-			data := data[off:]
+			if cfg.strictBounds && n != 0 && off < fixedSize(srcTyp) {
+				return fmt.Errorf("dynamic data overlaps fixed record: offset=%d len=%d record size=%d", off, n, fixedSize(srcTyp))
+			}
+			if n%class.size != 0 {
+				return fmt.Errorf("invalid dynamic data length for %s: len=%d is not a multiple of element size %d", elem, n, class.size)
+			}
+			data := data[off : off+n]
 			if len(data) == 0 {
+				dst.Field(i).Set(reflect.Zero(dst.Field(i).Type()))
 				continue
 			}
-			class := dynamicArrayTypes[strings.TrimPrefix(ctyp, "__data_loc ")]
-			if class.signed {
-				switch class.size {
-				case 1:
-					s8 := unsafe.Slice((*int8)(unsafe.Pointer(&data[0])), n)
-					dst.Field(i).Set(reflect.ValueOf(s8))
-				case 2:
-					s16 := unsafe.Slice((*int16)(unsafe.Pointer(&data[0])), n/2)
-					dst.Field(i).Set(reflect.ValueOf(s16))
-				case 4:
-					s32 := unsafe.Slice((*uint32)(unsafe.Pointer(&data[0])), n/4)
-					dst.Field(i).Set(reflect.ValueOf(s32))
-				case 8:
-					s64 := unsafe.Slice((*uint64)(unsafe.Pointer(&data[0])), n/8)
-					dst.Field(i).Set(reflect.ValueOf(s64))
-				default:
-					panic(fmt.Sprintf("invalid typeclass size: %d", class.size))
-				}
-			} else {
-				switch class.size {
-				case 1:
-					dst.Field(i).SetBytes(data[:n])
-				case 2:
-					u16 := unsafe.Slice((*uint16)(unsafe.Pointer(&data[0])), n/2)
-					dst.Field(i).Set(reflect.ValueOf(u16))
-				case 4:
-					u32 := unsafe.Slice((*uint32)(unsafe.Pointer(&data[0])), n/4)
-					dst.Field(i).Set(reflect.ValueOf(u32))
-				case 8:
-					u64 := unsafe.Slice((*uint64)(unsafe.Pointer(&data[0])), n/8)
-					dst.Field(i).Set(reflect.ValueOf(u64))
-				default:
-					panic(fmt.Sprintf("invalid typeclass size: %d", class.size))
-				}
+			arr, err := dynamicArrayValue(class, data, cfg.fieldOrder(srcTyp.Field(i).Tag.Get("name"), order), cfg.copy)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", srcTyp.Field(i).Tag.Get("name"), err)
+			}
+			if arr.Type() != dst.Field(i).Type() {
+				return fmt.Errorf("mismatched type for field %d: %s != %s", i, dst.Field(i).Type(), arr.Type())
+			}
+			dst.Field(i).Set(arr)
+			continue
+		}
+		if isBool(srcTyp.Field(i).Type) && srcTyp.Field(i).Type == dstTyp.Field(i).Type {
+			copyBools(dst.Field(i), src.Field(i))
+			continue
+		}
+		if isWidened(srcTyp.Field(i).Type, dstTyp.Field(i).Type) {
+			v := reflect.New(srcTyp.Field(i).Type).Elem()
+			v.Set(src.Field(i))
+			if fieldOrder := cfg.fieldOrder(srcTyp.Field(i).Tag.Get("name"), order); fieldOrder != machine {
+				swapBytes(v)
 			}
+			// Conversion zero-extends unsigned values
+			// and sign-extends signed values.
+			dst.Field(i).Set(v.Convert(dstTyp.Field(i).Type))
 			continue
 		}
 		if !src.Field(i).Type().AssignableTo(dst.Field(i).Type()) {
 			return fmt.Errorf("mismatched type for field %d: %s != %s", i, dst.Field(i).Type(), src.Field(i).Type())
 		}
 		dst.Field(i).Set(src.Field(i))
+		if fieldOrder := cfg.fieldOrder(srcTyp.Field(i).Tag.Get("name"), order); fieldOrder != machine {
+			swapBytes(dst.Field(i))
+		}
 	}
 	for _, u := range unaligned.Fields {
+		order := cfg.fieldOrder(srcTyp.Field(u).Tag.Get("name"), order)
 		dstU := dst.Field(u)
 		dstSize := dstU.Type().Size()
 		srcU := src.Field(u)
 		srcSize := srcU.Type().Size()
-		if dstSize != srcSize {
-			return fmt.Errorf("mismatched size for field %d: %d != %d", u, dstSize, srcSize)
+		// Integer fields may be widened, but other types
+		// must have the same size.
+		widen := isInteger(dstU.Type()) && dstSize > srcSize
+		if dstSize != srcSize && !widen {
+			return FieldSizeError{Index: u, DstSize: int(dstSize), SrcSize: int(srcSize)}
 		}
-		srcIface := srcU.Interface()
-		var val uint64
 		switch dstU.Kind() {
-		case reflect.Uint16, reflect.Uint32, reflect.Uint64:
-			switch srcSize {
-			case 2:
-				b := srcIface.([2]byte)
-				val = uint64(machine.Uint16(b[:]))
-			case 4:
-				b := srcIface.([4]byte)
-				val = uint64(machine.Uint32(b[:]))
-			case 8:
-				b := srcIface.([8]byte)
-				val = machine.Uint64(b[:])
-			}
-			dstU.SetUint(val)
-		case reflect.Int16, reflect.Int32, reflect.Int64:
-			switch srcSize {
-			case 2:
-				b := srcIface.([2]byte)
-				val = uint64(machine.Uint16(b[:]))
-			case 4:
-				b := srcIface.([4]byte)
-				val = uint64(machine.Uint32(b[:]))
-			case 8:
-				b := srcIface.([8]byte)
-				val = machine.Uint64(b[:])
-			}
-			dstU.SetInt(int64(val))
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if srcU.Kind() != reflect.Array || srcU.Type().Elem().Kind() != reflect.Uint8 {
+				return FieldKindError{Index: u, Kind: srcU.Kind()}
+			}
+			b := unsafe.Slice((*byte)(unsafe.Pointer(srcU.UnsafeAddr())), srcSize)
+			dstU.SetUint(decodeUint(b, int(srcSize), order))
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if srcU.Kind() != reflect.Array || srcU.Type().Elem().Kind() != reflect.Uint8 {
+				return FieldKindError{Index: u, Kind: srcU.Kind()}
+			}
+			b := unsafe.Slice((*byte)(unsafe.Pointer(srcU.UnsafeAddr())), srcSize)
+			// Sign-extend from the width of the source.
+			shift := 64 - 8*srcSize
+			dstU.SetInt(int64(decodeUint(b, int(srcSize), order)<<shift) >> shift)
+		case reflect.Bool:
+			if srcU.Kind() != reflect.Array || srcU.Type().Elem().Kind() != reflect.Uint8 {
+				return FieldKindError{Index: u, Kind: srcU.Kind()}
+			}
+			dstU.SetBool(srcU.Index(0).Uint() != 0)
+		case reflect.Array:
+			if isBool(dstU.Type()) {
+				for j := 0; j < dstU.Len(); j++ {
+					dstU.Index(j).SetBool(srcU.Index(j).Uint() != 0)
+				}
+				break
+			}
+			if !isInteger(dstU.Type().Elem()) {
+				// Types provided by a type map are copied
+				// in host byte order.
+				dstU.Set(reflect.NewAt(dstU.Type(), unsafe.Pointer(srcU.UnsafeAddr())).Elem())
+				break
+			}
+			// Reconstruct integer arrays element by element,
+			// sign-extending signed elements from their width.
+			b := unsafe.Slice((*byte)(unsafe.Pointer(srcU.UnsafeAddr())), srcSize)
+			size := int(dstU.Type().Elem().Size())
+			shift := 64 - 8*size
+			for j := 0; j < dstU.Len(); j++ {
+				val := decodeUint(b[j*size:], size, order)
+				switch elem := dstU.Index(j); elem.Kind() {
+				case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					elem.SetInt(int64(val<<shift) >> shift)
+				default:
+					elem.SetUint(val)
+				}
+			}
 		default:
-			return fmt.Errorf("invalid kind for field %d: %v", u, dstU.Kind())
+			if srcU.Kind() != reflect.Array || srcU.Type().Elem().Kind() != reflect.Uint8 {
+				return FieldKindError{Index: u, Kind: srcU.Kind()}
+			}
+			// Types provided by a type map are copied in host
+			// byte order.
+			dstU.Set(reflect.NewAt(dstU.Type(), unsafe.Pointer(srcU.UnsafeAddr())).Elem())
 		}
 	}
 	return nil
 }
 
+// lengthFieldValue returns the value of the integer field of the packed
+// struct src with the given C name, as it would be unpacked. Fields are
+// decoded in the given byte order, which should be the host byte order if
+// src is an unpacked value.
+func lengthFieldValue(src reflect.Value, name string, order binary.ByteOrder) (int, error) {
+	v, ok := fieldByCName(src, name)
+	if !ok {
+		return 0, fmt.Errorf("no length field %s", name)
+	}
+	var (
+		size   int
+		signed bool
+	)
+	switch v.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		size = int(v.Type().Size())
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = int(v.Type().Size())
+		signed = true
+	case reflect.Array:
+		size = v.Len()
+		if v.Type().Elem().Kind() != reflect.Uint8 || (size != 1 && size != 2 && size != 4 && size != 8) {
+			return 0, fmt.Errorf("invalid type for length field %s: %s", name, v.Type())
+		}
+	default:
+		return 0, fmt.Errorf("invalid type for length field %s: %s", name, v.Type())
+	}
+	b := unsafe.Slice((*byte)(unsafe.Pointer(v.UnsafeAddr())), size)
+	l := decodeUint(b, size, order)
+	if signed {
+		shift := 64 - 8*size
+		if n := int64(l<<shift) >> shift; n < 0 {
+			return 0, fmt.Errorf("invalid length in %s: %d", name, n)
+		}
+	}
+	if l > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid length in %s: %d", name, l)
+	}
+	return int(l), nil
+}
+
+// fixedSize returns the offset of the end of the last field of the packed
+// struct type typ, excluding any trailing padding.
+func fixedSize(typ reflect.Type) int {
+	var size int
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if end := int(f.Offset + f.Type.Size()); end > size {
+			size = end
+		}
+	}
+	return size
+}
+
+// isInteger returns whether typ is an integer type.
+func isInteger(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	default:
+		return false
+	}
+}
+
+// isWidened returns whether the scalar integer type dst is wider than the
+// scalar integer type src with the same signedness.
+func isWidened(src, dst reflect.Type) bool {
+	return src != dst && isInteger(src) && isInteger(dst) && dst.Size() > src.Size() &&
+		isSigned(src) == isSigned(dst)
+}
+
+// isSigned returns whether the integer type typ is signed.
+func isSigned(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	default:
+		return false
+	}
+}
+
+// isLongType returns whether ctyp is a scalar C long or unsigned long
+// type, or a kernel typedef of one whose size depends on the architecture.
+func isLongType(ctyp string) bool {
+	switch ctyp {
+	case "size_t", "ssize_t":
+		return true
+	}
+	var long int
+	for _, w := range strings.Fields(ctyp) {
+		switch w {
+		case "long":
+			long++
+		case "signed", "unsigned", "int":
+		default:
+			return false
+		}
+	}
+	return long == 1
+}
+
+// widenedType returns the 64-bit integer type with the signedness of the
+// integer type typ. Other types are returned unaltered.
+func widenedType(typ reflect.Type) reflect.Type {
+	if !isInteger(typ) || typ.Kind() == reflect.Uintptr {
+		return typ
+	}
+	return integerTypes[typeClass{8, isSigned(typ)}]
+}
+
+// isBool returns whether typ is bool or an array of bool.
+func isBool(typ reflect.Type) bool {
+	if typ.Kind() == reflect.Array {
+		typ = typ.Elem()
+	}
+	return typ.Kind() == reflect.Bool
+}
+
+// copyBools sets the bool or array of bool, dst, from the corresponding
+// addressable src, treating any non-zero byte as true.
+func copyBools(dst, src reflect.Value) {
+	if src.Kind() == reflect.Array {
+		for j := 0; j < src.Len(); j++ {
+			copyBools(dst.Index(j), src.Index(j))
+		}
+		return
+	}
+	dst.SetBool(*(*byte)(unsafe.Pointer(src.UnsafeAddr())) != 0)
+}
+
+// swapBytes reverses the byte order of the integer value, the elements
+// of the integer array, or the fields of the embedded CommonFields struct,
+// v. Other values, including structs provided by a type map, are not
+// altered.
+func swapBytes(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(reverseBytes(v.Uint(), int(v.Type().Size())))
+	case reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(reverseBytes(uint64(v.Int()), int(v.Type().Size()))))
+	case reflect.Array:
+		for j := 0; j < v.Len(); j++ {
+			swapBytes(v.Index(j))
+		}
+	case reflect.Struct:
+		if v.Type() != commonFieldsType {
+			return
+		}
+		for j := 0; j < v.NumField(); j++ {
+			swapBytes(v.Field(j))
+		}
+	}
+}
+
+// reverseBytes returns the low size bytes of v in reverse order.
+func reverseBytes(v uint64, size int) uint64 {
+	switch size {
+	case 2:
+		return uint64(bits.ReverseBytes16(uint16(v)))
+	case 4:
+		return uint64(bits.ReverseBytes32(uint32(v)))
+	case 8:
+		return bits.ReverseBytes64(v)
+	default:
+		return v
+	}
+}
+
+// decodeUint returns the unsigned integer of the given size in bytes held
+// at the start of b.
+func decodeUint(b []byte, size int, order binary.ByteOrder) uint64 {
+	switch size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(order.Uint16(b))
+	case 4:
+		return uint64(order.Uint32(b))
+	default:
+		return order.Uint64(b)
+	}
+}
+
+// dynamicArrayValue returns a slice holding the elements of class in data.
+// If order is the host byte order or the elements are single bytes, and
+// detach is false, the returned slice aliases data, otherwise the elements
+// are decoded into a newly allocated slice. Sixteen byte elements are held
+// as byte arrays in the order they appear in data.
+func dynamicArrayValue(class typeClass, data []byte, order binary.ByteOrder, detach bool) (reflect.Value, error) {
+	n := len(data) / class.size
+	hostOrder := class.size == 1 || class.size == 16 || order == machine
+	if hostOrder && !detach {
+		p := unsafe.Pointer(&data[0])
+		switch class {
+		case typeClass{1, true}:
+			return reflect.ValueOf(unsafe.Slice((*int8)(p), n)), nil
+		case typeClass{2, true}:
+			return reflect.ValueOf(unsafe.Slice((*int16)(p), n)), nil
+		case typeClass{4, true}:
+			return reflect.ValueOf(unsafe.Slice((*int32)(p), n)), nil
+		case typeClass{8, true}:
+			return reflect.ValueOf(unsafe.Slice((*int64)(p), n)), nil
+		case typeClass{1, false}:
+			return reflect.ValueOf(data), nil
+		case typeClass{2, false}:
+			return reflect.ValueOf(unsafe.Slice((*uint16)(p), n)), nil
+		case typeClass{4, false}:
+			return reflect.ValueOf(unsafe.Slice((*uint32)(p), n)), nil
+		case typeClass{8, false}:
+			return reflect.ValueOf(unsafe.Slice((*uint64)(p), n)), nil
+		case typeClass{16, true}, typeClass{16, false}:
+			return reflect.ValueOf(unsafe.Slice((*[16]byte)(p), n)), nil
+		default:
+			return reflect.Value{}, fmt.Errorf("invalid dynamic array element size: %d", class.size)
+		}
+	}
+
+	elem, ok := dynamicElementType(class)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("invalid dynamic array element size: %d", class.size)
+	}
+	s := reflect.MakeSlice(reflect.SliceOf(elem), n, n)
+	if hostOrder {
+		v, err := dynamicArrayValue(class, data, order, false)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		reflect.Copy(s, v)
+		return s, nil
+	}
+	for i := 0; i < n; i++ {
+		b := data[i*class.size:]
+		var v uint64
+		switch class.size {
+		case 2:
+			v = uint64(order.Uint16(b))
+		case 4:
+			v = uint64(order.Uint32(b))
+		case 8:
+			v = order.Uint64(b)
+		default:
+			return reflect.Value{}, fmt.Errorf("invalid dynamic array element size: %d", class.size)
+		}
+		if class.signed {
+			s.Index(i).SetInt(int64(v))
+		} else {
+			s.Index(i).SetUint(v)
+		}
+	}
+	return s, nil
+}
+
+// dynamicElementType returns the Go type of dynamic array elements of
+// class and whether the class is valid. Sixteen byte elements are
+// represented as [16]byte.
+func dynamicElementType(class typeClass) (reflect.Type, bool) {
+	if class.size == 16 {
+		return uint128Type, true
+	}
+	typ, ok := integerTypes[class]
+	return typ, ok
+}
+
+// dynamicClass returns the class of the elements of the dynamic array C
+// type elem, without the __data_loc or __rel_loc prefix. Leading underscores
+// are ignored, so __s8[] and s8[] are the same type.
+func dynamicClass(elem string) (typeClass, bool) {
+	class, ok := dynamicArrayTypes[strings.TrimLeft(elem, "_")]
+	return class, ok
+}
+
 func isStructPointer(v reflect.Value) bool {
 	return v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct
 }
 
 // dynamicArray returns a []T corresponding to the given ctyp[]. ctyp is expected
-// to be just the C type, without the __data_loc prefix.
+// to be just the C type, without the __data_loc or __rel_loc prefix.
 func dynamicArray(ctyp string) (reflect.Type, error) {
-	class, ok := dynamicArrayTypes[strings.TrimLeft(ctyp, "_")]
+	class, ok := dynamicClass(ctyp)
 	if !ok {
 		return nil, fmt.Errorf("unsupported dynamic array element type: %s", ctyp)
 	}
-	return reflect.SliceOf(integerTypes[class]), nil
+	elem, ok := dynamicElementType(class)
+	if !ok {
+		return nil, fmt.Errorf("invalid dynamic array element size for %s: %d", ctyp, class.size)
+	}
+	return reflect.SliceOf(elem), nil
 }
 
 // export converts a string to an exported Go label.
@@ -445,19 +1364,53 @@ func export(s string) string {
 func fieldName(s string) (ctyp, field string, err error) {
 	s = strings.TrimPrefix(s, "field:")
 	s = strings.TrimSuffix(s, ";")
+	desc := s
+	// Collapse runs of whitespace and remove whitespace around
+	// array brackets so that "unsigned  long x [ 2 ]" is treated
+	// as "unsigned long x[2]".
+	s = strings.Join(strings.Fields(s), " ")
+	s = strings.NewReplacer(" [", "[", "[ ", "[", " ]", "]").Replace(s)
 	i := strings.LastIndex(s, " ")
 	if i < 0 {
-		return "", "", fmt.Errorf("invalid field description: %q", s)
+		return "", "", fmt.Errorf("invalid field description: %q", desc)
 	}
 	ctyp = s[:i]
 	field = s[i+1:]
+	for strings.HasPrefix(field, "*") {
+		ctyp += "*"
+		field = field[1:]
+	}
+	if idx := strings.Index(ctyp, "*"); idx >= 0 {
+		// Normalise pointer types, so "void * argv[4]"
+		// and "void *argv[4]" are both "void*[4]".
+		ctyp = strings.TrimRight(ctyp[:idx], " ") + strings.ReplaceAll(ctyp[idx:], " ", "")
+	}
 	if idx := strings.Index(field, "["); idx >= 0 {
 		ctyp += field[idx:]
 		field = field[:idx]
 	}
+	if !isIdentifier(field) {
+		return "", "", fmt.Errorf("invalid field name in field description: %q", desc)
+	}
 	return ctyp, field, nil
 }
 
+// isIdentifier returns whether s is a valid C identifier.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i != 0 && '0' <= c && c <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // offset parses the offset field from a kprobe format description.
 func offset(s string) (int, error) {
 	s = strings.TrimPrefix(s, "offset:")
@@ -470,35 +1423,78 @@ func offset(s string) (int, error) {
 // the field field, according to https://www.kernel.org/doc/html/latest/trace/kprobetrace.html.
 // If the alignment of the resulting type is inconsistent with the provided
 // offset and aligned is true, a byte array of the same length is constructed
-// and fallback is returned true.
-func integerType(size, signed, ctyp string, offset int, aligned bool) (typ reflect.Type, bytes int, fallback bool, err error) {
+// and fallback is returned true. Types in the configuration's type map take
+// precedence over the builtin integer types. Elements of arrays of pointers
+// are represented as uintptr when the pointer size matches the host's, and
+// single byte bool values are represented as bool.
+func integerType(bytes int, signed bool, ctyp string, offset int, aligned bool, cfg *config) (typ reflect.Type, fallback bool, err error) {
+	if bytes <= 0 {
+		return nil, false, fmt.Errorf("invalid size for %s: size=%d", ctyp, bytes)
+	}
+	n, dynamic, err := arraySize(ctyp)
+	if err != nil {
+		return nil, false, err
+	}
+	if n == 0 || bytes%n != 0 {
+		return nil, false, fmt.Errorf("invalid size for array: size=%d elements=%d", bytes, n)
+	}
+	if cfg.charBytes && baseType(ctyp) == "char" && strings.HasSuffix(ctyp, "]") {
+		signed = false
+	}
+	typ = integerTypes[typeClass{bytes / n, signed && !dynamic}]
+	if n > 1 && strings.HasSuffix(baseType(ctyp), "*") && bytes/n == int(uintptrType.Size()) {
+		typ = uintptrType
+	}
+	if baseType(ctyp) == "bool" && bytes/n == 1 && !dynamic {
+		typ = boolType
+	}
+	if mapped, ok := cfg.types[baseType(ctyp)]; ok && !dynamic {
+		if int(mapped.Size())*n != bytes {
+			return nil, false, fmt.Errorf("invalid size for %s mapped to %s: size=%d elements=%d", ctyp, mapped, bytes, n)
+		}
+		typ = mapped
+	}
+	if typ == nil {
+		if n > 1 {
+			return nil, false, fmt.Errorf("unsupported element size for %s: element size=%d must be 1, 2, 4 or 8", ctyp, bytes/n)
+		}
+		return nil, false, fmt.Errorf("unsupported size for %s: size=%d", ctyp, bytes)
+	}
+	// Arrays have the alignment of their elements, so the
+	// element type determines whether the field is aligned.
+	if aligned && offset%typ.Align() != 0 {
+		return reflect.ArrayOf(bytes, integerTypes[typeClass{1, false}]), true, nil
+	}
+	if n > 1 {
+		typ = reflect.ArrayOf(n, typ)
+	}
+	return typ, false, nil
+}
+
+// sizeSigned parses the size and signed fields from a kprobe format
+// description.
+func sizeSigned(size, signed string) (bytes int, isSigned bool, err error) {
 	size = strings.TrimPrefix(size, "size:")
 	size = strings.TrimSuffix(size, ";")
 	bytes, err = strconv.Atoi(size)
 	if err != nil {
-		return nil, 0, false, fmt.Errorf("invalid size: %w", err)
+		return 0, false, fmt.Errorf("invalid size: %w", err)
 	}
 	signed = strings.TrimPrefix(signed, "signed:")
 	signed = strings.TrimSuffix(signed, ";")
 	s, err := strconv.Atoi(signed)
 	if err != nil {
-		return nil, 0, false, fmt.Errorf("invalid size: %w", err)
-	}
-	n, dynamic, err := arraySize(ctyp)
-	if err != nil {
-		return nil, 0, false, err
-	}
-	if bytes%n != 0 {
-		return nil, 0, false, fmt.Errorf("invalid size for array: size=%d elements=%d", bytes, n)
-	}
-	typ = integerTypes[typeClass{bytes / n, s == 1 && !dynamic}]
-	if aligned && offset%typ.Align() != 0 {
-		return reflect.ArrayOf(bytes, integerTypes[typeClass{1, false}]), bytes, true, nil
+		return 0, false, fmt.Errorf("invalid size: %w", err)
 	}
-	if n > 1 {
-		typ = reflect.ArrayOf(n, typ)
+	return bytes, s == 1, nil
+}
+
+// b2i returns 1 if b is true and 0 otherwise.
+func b2i(b bool) int {
+	if b {
+		return 1
 	}
-	return typ, bytes, false, nil
+	return 0
 }
 
 // arraySize returns the number of elements in an array according to the syntax
@@ -515,7 +1511,7 @@ func arraySize(ctyp string) (n int, dynamic bool, err error) {
 	}
 	c := strings.TrimPrefix(ctyp[:len(ctyp)-1], prefix)
 	if c == "" {
-		if !strings.HasPrefix(ctyp, "__data_loc ") {
+		if _, ok := dynamicElement(ctyp); !ok {
 			return 0, false, fmt.Errorf("invalid data type: %q", ctyp)
 		}
 		// We are a dynamic array.
@@ -525,11 +1521,98 @@ func arraySize(ctyp string) (n int, dynamic bool, err error) {
 	return n, false, err
 }
 
+// checkType returns an error if ctyp is not a known C type, or if a known
+// fixed-width type is inconsistent with the declared size in bytes.
+func checkType(ctyp string, size int, cfg *config) error {
+	if elem, ok := dynamicElement(ctyp); ok {
+		if _, ok := dynamicClass(elem); !ok {
+			return fmt.Errorf("unknown dynamic array element type: %q", ctyp)
+		}
+		return nil
+	}
+	n, _, err := arraySize(ctyp)
+	if err != nil {
+		return err
+	}
+	base := baseType(ctyp)
+	if _, ok := cfg.types[base]; ok {
+		return nil
+	}
+	if strings.HasSuffix(base, "*") {
+		// Pointer widths depend on the traced kernel.
+		return nil
+	}
+	width, ok := knownTypes[base]
+	if !ok {
+		return fmt.Errorf("unknown C type: %q", ctyp)
+	}
+	if width != 0 && width*n != size {
+		return fmt.Errorf("invalid size for %s: %d", ctyp, size)
+	}
+	return nil
+}
+
+// checkDynamicSigned returns an error if the signedness of the dynamic array
+// element type, elem, is not consistent with the signed column of the format.
+// Plain char arrays are always represented as []byte since they are most
+// often strings, so their signedness is not checked. Unknown element types
+// are not checked.
+func checkDynamicSigned(elem string, signed bool) error {
+	if strings.TrimLeft(elem, "_") == "char[]" {
+		return nil
+	}
+	class, ok := dynamicClass(elem)
+	if !ok || class.signed == signed {
+		return nil
+	}
+	return fmt.Errorf("inconsistent signedness for dynamic array of %s: signed:%d", elem, b2i(signed))
+}
+
+// baseType returns the C type of ctyp without any array suffix.
+func baseType(ctyp string) string {
+	if idx := strings.Index(ctyp, "["); idx >= 0 {
+		return strings.TrimSpace(ctyp[:idx])
+	}
+	return ctyp
+}
+
+// dynamicElement returns the element type of a dynamic array C type and
+// whether ctyp is a dynamic array. Dynamic arrays have either a __data_loc
+// or a __rel_loc prefix.
+func dynamicElement(ctyp string) (elem string, ok bool) {
+	for _, prefix := range []string{"__data_loc", "__rel_loc"} {
+		if strings.HasPrefix(ctyp, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(ctyp, prefix)), true
+		}
+	}
+	return "", false
+}
+
+// dynamicLocation returns the offset in the event record and the length of
+// the data referred to by the dynamic array locator, v, of a field with the
+// given C type at the given offset.
+func dynamicLocation(ctyp string, v uint32, offset int) (off, n int) {
+	off = int(v & 0xffff)
+	n = int(v >> 16)
+	if strings.HasPrefix(ctyp, "__rel_loc") {
+		// The offset is relative to the end of the 4 byte
+		// locator field.
+		off += offset + 4
+	}
+	return off, n
+}
+
 type typeClass struct {
 	size   int
 	signed bool
 }
 
+var (
+	uintptrType = reflect.TypeOf(uintptr(0))
+	boolType    = reflect.TypeOf(false)
+	uint128Type = reflect.TypeOf([16]byte{})
+)
+
 var integerTypes = map[typeClass]reflect.Type{
 	{1, true}: reflect.TypeOf(int8(0)),
 	{2, true}: reflect.TypeOf(int16(0)),
@@ -547,6 +1630,9 @@ var dynamicArrayTypes = map[string]typeClass{
 	"schar[]": {int(unsafe.Sizeof(C.schar(0))), true},
 	"uchar[]": {int(unsafe.Sizeof(C.uchar(0))), false},
 
+	"signed char[]":   {int(unsafe.Sizeof(C.schar(0))), true},
+	"unsigned char[]": {int(unsafe.Sizeof(C.uchar(0))), false},
+
 	"short[]":          {int(unsafe.Sizeof(C.short(0))), true},
 	"signed short[]":   {int(unsafe.Sizeof(C.short(0))), true},
 	"unsigned short[]": {int(unsafe.Sizeof(C.ushort(0))), false},
@@ -568,4 +1654,110 @@ var dynamicArrayTypes = map[string]typeClass{
 	"u16[]": {2, false},
 	"u32[]": {4, false},
 	"u64[]": {8, false},
+
+	"s128[]": {16, true},
+	"u128[]": {16, false},
+}
+
+// knownTypes is the set of scalar C types accepted in strict mode, mapped
+// to their width in bytes. A zero width indicates that the width depends
+// on the architecture of the traced kernel. The integer types include the
+// spellings written by the compiler, such as "long unsigned int", as well
+// as those written in kernel source, such as "unsigned long".
+var knownTypes = map[string]int{
+	"char":          1,
+	"signed char":   1,
+	"unsigned char": 1,
+
+	"short":              2,
+	"signed short":       2,
+	"unsigned short":     2,
+	"short int":          2,
+	"signed short int":   2,
+	"short signed int":   2,
+	"unsigned short int": 2,
+	"short unsigned int": 2,
+
+	"int":          4,
+	"signed int":   4,
+	"unsigned int": 4,
+	"signed":       4,
+	"unsigned":     4,
+
+	"long":              0,
+	"signed long":       0,
+	"unsigned long":     0,
+	"long int":          0,
+	"signed long int":   0,
+	"long signed int":   0,
+	"unsigned long int": 0,
+	"long unsigned int": 0,
+
+	"long long":              8,
+	"signed long long":       8,
+	"unsigned long long":     8,
+	"long long int":          8,
+	"signed long long int":   8,
+	"long long signed int":   8,
+	"unsigned long long int": 8,
+	"long long unsigned int": 8,
+
+	"s8":  1,
+	"s16": 2,
+	"s32": 4,
+	"s64": 8,
+
+	"u8":  1,
+	"u16": 2,
+	"u32": 4,
+	"u64": 8,
+
+	"__s8":  1,
+	"__s16": 2,
+	"__s32": 4,
+	"__s64": 8,
+
+	"__u8":  1,
+	"__u16": 2,
+	"__u32": 4,
+	"__u64": 8,
+
+	"int8_t":  1,
+	"int16_t": 2,
+	"int32_t": 4,
+	"int64_t": 8,
+
+	"uint8_t":  1,
+	"uint16_t": 2,
+	"uint32_t": 4,
+	"uint64_t": 8,
+
+	"size_t":    0,
+	"ssize_t":   0,
+	"uintptr_t": 0,
+	"ptrdiff_t": 0,
+	"off_t":     0,
+	"ino_t":     0,
+	"loff_t":    8,
+	"sector_t":  8,
+	"blkcnt_t":  8,
+	"time64_t":  8,
+	"ktime_t":   8,
+	"pid_t":     4,
+	"uid_t":     4,
+	"gid_t":     4,
+	"dev_t":     4,
+	"gfp_t":     4,
+	"fmode_t":   4,
+	"nlink_t":   4,
+	"clockid_t": 4,
+	"umode_t":   2,
+	"bool":      1,
+
+	"__be16": 2,
+	"__le16": 2,
+	"__be32": 4,
+	"__le32": 4,
+	"__be64": 8,
+	"__le64": 8,
 }
@@ -5,6 +5,7 @@
 package kprobe_test
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log"
 	"reflect"
@@ -132,3 +133,45 @@ format:
 	// src: &{Common_type:7090 Common_flags:0 Common_preempt_count:0 Common_pid:32705 Probe_ip:18446744072341004784 Dfd:2926421296 Filename:655392 Flags:557633 Mode:420}
 	// dst: &{Common_type:7090 Common_flags:0 Common_preempt_count:0 Common_pid:32705 Probe_ip:18446744072341004784 Dfd:2926421296 Filename:[102 105 108 101 46 116 101 120 116 0] Flags:557633 Mode:420}
 }
+
+func ExampleFormat_FieldByName() {
+	format := `name: do_sys_open
+ID: 7090
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:unsigned long __probe_ip;	offset:8;	size:8;	signed:0;
+	field:u32 dfd;	offset:16;	size:4;	signed:0;
+	field:__data_loc char[] filename;	offset:20;	size:4;	signed:1;
+	field:u32 flags;	offset:24;	size:4;	signed:0;
+	field:u32 mode;	offset:28;	size:4;	signed:0;
+`
+	f, err := kprobe.ParseFormat(strings.NewReader(format))
+	if err != nil {
+		log.Fatal(err)
+	}
+	pid, ok := f.FieldByName("common_pid")
+	if !ok {
+		log.Fatal("no common_pid field")
+	}
+	fmt.Printf("%s: %s offset=%d size=%d signed=%t\n", pid.Name, pid.Type, pid.Offset, pid.Size, pid.Signed)
+
+	data := []byte{
+		0xb2, 0x1b, 0x00, 0x00, 0xc1, 0x7f, 0x00, 0x00,
+		0xf0, 0xa1, 0x6d, 0xae, 0xff, 0xff, 0xff, 0xff,
+		0x30, 0xa5, 0x6d, 0xae, 0x20, 0x00, 0x0a, 0x00,
+		0x41, 0x82, 0x08, 0x00, 0xa4, 0x01, 0x00, 0x00,
+		0x66, 0x69, 0x6c, 0x65, 0x2e, 0x74, 0x65, 0x78,
+		0x74, 0x00, 0x00, 0x00,
+	}
+
+	// Read the pid directly from the event record.
+	fmt.Println(int32(binary.LittleEndian.Uint32(data[pid.Offset : pid.Offset+pid.Size])))
+
+	// Output:
+	// common_pid: int32 offset=4 size=4 signed=true
+	// 32705
+}
@@ -5,7 +5,13 @@
 package kprobe
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"reflect"
 	"strings"
 	"testing"
@@ -370,7 +376,31 @@ format:
 
 print fmt: ""%c"", REC->c
 `,
-		wantErr: errors.New("invalid offset for field 5: 8"),
+		wantErr: OffsetError{Field: "c", Offset: 8, Previous: "c", End: 9},
+	},
+	{
+		name: "backwards offset",
+		format: `name: fake
+ID: 1
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u64 a;	offset:8;	size:8;	signed:0;
+	field:u32 b;	offset:12;	size:4;	signed:0;
+`,
+		wantErr: OffsetError{Field: "b", Offset: 12, Previous: "a", End: 16},
+	},
+	{
+		name: "negative offset",
+		format: `name: fake
+ID: 1
+format:
+	field:unsigned short common_type;	offset:-2;	size:2;	signed:0;
+`,
+		wantErr: OffsetError{Field: "common_type", Offset: -2},
 	},
 }
 
@@ -578,3 +608,2134 @@ func TestUnpack(t *testing.T) {
 		}
 	}
 }
+
+var strictTests = []struct {
+	name    string
+	format  string
+	wantErr error
+}{
+	{
+		name: "typo",
+		format: `name: fake
+ID: 1
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u322 c;	offset:8;	size:4;	signed:0;
+`,
+		wantErr: errors.New(`unknown C type: "u322"`),
+	},
+	{
+		name: "size mismatch",
+		format: `name: fake
+ID: 1
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u32 c[2];	offset:8;	size:4;	signed:0;
+`,
+		wantErr: errors.New("invalid size for u32[2]: 4"),
+	},
+	{
+		name: "unknown dynamic",
+		format: `name: fake
+ID: 1
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc widget[] c;	offset:8;	size:4;	signed:0;
+`,
+		wantErr: errors.New(`unknown dynamic array element type: "__data_loc widget[]"`),
+	},
+}
+
+func TestStructStrict(t *testing.T) {
+	for _, test := range formatTests {
+		_, _, _, _, err := Struct(strings.NewReader(test.format), Strict())
+		if !reflect.DeepEqual(err, test.wantErr) {
+			t.Errorf("unexpected error for strict %q: got:%#v want:%#v",
+				test.name, err, test.wantErr)
+		}
+	}
+	for _, test := range strictTests {
+		_, _, _, _, err := Struct(strings.NewReader(test.format))
+		switch err.(type) {
+		case nil, UnalignedFieldsError:
+		default:
+			t.Errorf("unexpected error for permissive %q: %v", test.name, err)
+		}
+		_, _, _, _, err = Struct(strings.NewReader(test.format), Strict())
+		if !reflect.DeepEqual(err, test.wantErr) {
+			t.Errorf("unexpected error for strict %q: got:%#v want:%#v",
+				test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestStrictKernelTypes(t *testing.T) {
+	tests := []struct {
+		ctyp string
+		size int
+	}{
+		{ctyp: "short int", size: 2},
+		{ctyp: "unsigned short int", size: 2},
+		{ctyp: "short unsigned int", size: 2},
+		{ctyp: "signed", size: 4},
+		{ctyp: "long int", size: 8},
+		{ctyp: "long unsigned int", size: 8},
+		{ctyp: "unsigned long int", size: 8},
+		{ctyp: "long long int", size: 8},
+		{ctyp: "long long unsigned int", size: 8},
+		{ctyp: "umode_t", size: 2},
+		{ctyp: "ino_t", size: 8},
+		{ctyp: "sector_t", size: 8},
+		{ctyp: "ktime_t", size: 8},
+		{ctyp: "__be32", size: 4},
+	}
+	for _, test := range tests {
+		format := fmt.Sprintf(`name: fake
+ID: 1
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:%s c;	offset:8;	size:%d;	signed:0;
+`, test.ctyp, test.size)
+		_, err := ParseFormat(strings.NewReader(format), Strict())
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.ctyp, err)
+		}
+	}
+
+	// Known types are still checked against their size.
+	format := `name: fake
+ID: 1
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:umode_t c;	offset:2;	size:4;	signed:0;
+`
+	_, err := ParseFormat(strings.NewReader(format), Strict())
+	if err == nil || err.Error() != "invalid size for umode_t: 4" {
+		t.Errorf("unexpected error for mis-sized umode_t: %v", err)
+	}
+}
+
+type kernelTime int64
+
+func TestWithTypeMap(t *testing.T) {
+	const format = `name: fake
+ID: 1
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__kernel_time_t a;	offset:8;	size:8;	signed:1;
+	field:u32 b;	offset:16;	size:4;	signed:0;
+	field:__kernel_time_t c[2];	offset:20;	size:16;	signed:1;
+`
+	types := WithTypeMap(map[string]reflect.Type{"__kernel_time_t": reflect.TypeOf(kernelTime(0))})
+	srcTyp, _, _, _, err := Struct(strings.NewReader(format), types, Strict())
+	wantErr := UnalignedFieldsError{Fields: []int{6}, Unaligned: []bool{6: true}}
+	if !reflect.DeepEqual(err, wantErr) {
+		t.Fatalf("unexpected error: got:%#v want:%#v", err, wantErr)
+	}
+	checkStruct(t, "type map", srcTyp, struct {
+		Common_type          uint16     `ctyp:"unsigned short" name:"common_type"`
+		Common_flags         uint8      `ctyp:"unsigned char" name:"common_flags"`
+		Common_preempt_count uint8      `ctyp:"unsigned char" name:"common_preempt_count"`
+		Common_pid           int32      `ctyp:"int" name:"common_pid"`
+		A                    kernelTime `ctyp:"__kernel_time_t" name:"a"`
+		B                    uint32     `ctyp:"u32" name:"b"`
+		C                    [16]uint8  `ctyp:"__kernel_time_t[2]" name:"c" unaligned:"size:16; signed:1;"`
+	}{})
+
+	dstTyp, err := UnpackedStructFor(srcTyp, types)
+	if err != nil {
+		t.Fatalf("unexpected error for unpacked type: %v", err)
+	}
+	want := struct {
+		Common_type          uint16        `ctyp:"unsigned short" name:"common_type"`
+		Common_flags         uint8         `ctyp:"unsigned char" name:"common_flags"`
+		Common_preempt_count uint8         `ctyp:"unsigned char" name:"common_preempt_count"`
+		Common_pid           int32         `ctyp:"int" name:"common_pid"`
+		A                    kernelTime    `ctyp:"__kernel_time_t" name:"a"`
+		B                    uint32        `ctyp:"u32" name:"b"`
+		C                    [2]kernelTime `ctyp:"__kernel_time_t[2]" name:"c"`
+	}{A: -1, B: 2, C: [2]kernelTime{3, -4}}
+	checkStruct(t, "type map", dstTyp, want)
+
+	data := make([]byte, 36)
+	*(*kernelTime)(unsafe.Pointer(&data[8])) = want.A
+	*(*uint32)(unsafe.Pointer(&data[16])) = want.B
+	copy(data[20:], unsafe.Slice((*byte)(unsafe.Pointer(&want.C[0])), unsafe.Sizeof(want.C)))
+	src := reflect.NewAt(srcTyp, unsafe.Pointer(&data[0]))
+	dst := reflect.New(dstTyp)
+	err = Unpack(dst, src, wantErr, data)
+	if err != nil {
+		t.Fatalf("unexpected error for unpacking: %v", err)
+	}
+	got := dst.Elem().Interface()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected result:\ngot: %#v\nwant:%#v", got, want)
+	}
+
+	_, _, _, _, err = Struct(strings.NewReader(format), WithTypeMap(map[string]reflect.Type{"__kernel_time_t": reflect.TypeOf(int32(0))}))
+	wantErr2 := errors.New("invalid size for __kernel_time_t mapped to int32: size=8 elements=1")
+	if !reflect.DeepEqual(err, wantErr2) {
+		t.Errorf("unexpected error for mismatched size: got:%#v want:%#v", err, wantErr2)
+	}
+}
+
+func TestUnpackFieldErrors(t *testing.T) {
+	type (
+		pair struct {
+			A [4]uint8
+			B uint32
+		}
+		single struct {
+			A uint32
+		}
+		narrow struct {
+			A uint16
+			B uint32
+		}
+		word struct {
+			A uint32
+			B uint32
+		}
+		mapped struct {
+			A float32
+			B uint32
+		}
+	)
+	data := make([]byte, 8)
+	tests := []struct {
+		name      string
+		dst, src  reflect.Value
+		unaligned UnalignedFieldsError
+		want      error
+		wantMsg   string
+	}{
+		{
+			name:    "field count",
+			dst:     reflect.New(reflect.TypeOf(single{})),
+			src:     reflect.NewAt(reflect.TypeOf(pair{}), unsafe.Pointer(&data[0])),
+			want:    FieldCountError{Got: 1, Want: 2},
+			wantMsg: "mismatched field count: 1 != 2",
+		},
+		{
+			name:      "unaligned field count",
+			dst:       reflect.New(reflect.TypeOf(word{})),
+			src:       reflect.NewAt(reflect.TypeOf(pair{}), unsafe.Pointer(&data[0])),
+			unaligned: UnalignedFieldsError{Fields: []int{0}, Unaligned: []bool{true}},
+			want:      FieldCountError{Unaligned: true, Got: 1, Want: 2},
+			wantMsg:   "mismatched unaligned field count: 1 != 2",
+		},
+		{
+			name:      "field size",
+			dst:       reflect.New(reflect.TypeOf(narrow{})),
+			src:       reflect.NewAt(reflect.TypeOf(pair{}), unsafe.Pointer(&data[0])),
+			unaligned: UnalignedFieldsError{Fields: []int{0}, Unaligned: []bool{true, false}},
+			want:      FieldSizeError{Index: 0, DstSize: 2, SrcSize: 4},
+			wantMsg:   "mismatched size for field 0: 2 != 4",
+		},
+		{
+			name:      "field kind",
+			dst:       reflect.New(reflect.TypeOf(word{})),
+			src:       reflect.NewAt(reflect.TypeOf(word{}), unsafe.Pointer(&data[0])),
+			unaligned: UnalignedFieldsError{Fields: []int{0}, Unaligned: []bool{true, false}},
+			want:      FieldKindError{Index: 0, Kind: reflect.Uint32},
+			wantMsg:   "invalid kind for field 0: uint32",
+		},
+		{
+			// The kind of the source field is reported
+			// for destination types provided by a type map.
+			name:      "mapped field kind",
+			dst:       reflect.New(reflect.TypeOf(mapped{})),
+			src:       reflect.NewAt(reflect.TypeOf(word{}), unsafe.Pointer(&data[0])),
+			unaligned: UnalignedFieldsError{Fields: []int{0}, Unaligned: []bool{true, false}},
+			want:      FieldKindError{Index: 0, Kind: reflect.Uint32},
+			wantMsg:   "invalid kind for field 0: uint32",
+		},
+	}
+	for _, test := range tests {
+		err := Unpack(test.dst, test.src, test.unaligned, data)
+		if err == nil {
+			t.Errorf("expected error for %s", test.name)
+			continue
+		}
+		var ok bool
+		switch want := test.want.(type) {
+		case FieldCountError:
+			var got FieldCountError
+			ok = errors.As(err, &got) && got == want
+		case FieldSizeError:
+			var got FieldSizeError
+			ok = errors.As(err, &got) && got == want
+		case FieldKindError:
+			var got FieldKindError
+			ok = errors.As(err, &got) && got == want
+		}
+		if !ok {
+			t.Errorf("unexpected error for %s: got:%#v want:%#v", test.name, err, test.want)
+		}
+		if err.Error() != test.wantMsg {
+			t.Errorf("unexpected error message for %s: got:%q want:%q", test.name, err, test.wantMsg)
+		}
+	}
+}
+
+func TestUnpackByteOrder(t *testing.T) {
+	const format = `name: fake
+ID: 1
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc u32[] raw;	offset:8;	size:4;	signed:0;
+	field:__data_loc char[] str;	offset:12;	size:4;	signed:1;
+`
+	srcTyp, _, _, _, err := Struct(strings.NewReader(format))
+	unaligned, ok := err.(UnalignedFieldsError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dstTyp, err := UnpackedStructFor(srcTyp)
+	if err != nil {
+		t.Fatalf("unexpected error for unpacked type: %v", err)
+	}
+
+	data := []byte{
+		0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x08, 0x00, 0x10, 0x00, 0x03, 0x00, 0x18,
+		0x12, 0x34, 0x56, 0x78, 0x09, 0xab, 0xcd, 0xef,
+		'a', 'b', 0x00,
+	}
+	src := reflect.NewAt(srcTyp, unsafe.Pointer(&data[0]))
+	dst := reflect.New(dstTyp)
+	err = Unpack(dst, src, unaligned, data, ByteOrder(binary.BigEndian))
+	if err != nil {
+		t.Fatalf("unexpected error for unpacking: %v", err)
+	}
+	raw := dst.Elem().FieldByName("Raw").Interface()
+	wantRaw := []uint32{0x12345678, 0x09abcdef}
+	if !reflect.DeepEqual(raw, wantRaw) {
+		t.Errorf("unexpected dynamic array: got:%#x want:%#x", raw, wantRaw)
+	}
+	str := dst.Elem().FieldByName("Str").Interface()
+	wantStr := []byte("ab\x00")
+	if !reflect.DeepEqual(str, wantStr) {
+		t.Errorf("unexpected dynamic string: got:%q want:%q", str, wantStr)
+	}
+}
+
+func TestUnpackCopy(t *testing.T) {
+	for _, test := range unpackTests {
+		srcTyp, _, _, _, err := Struct(strings.NewReader(test.format))
+		var unaligned UnalignedFieldsError
+		if err != nil {
+			var ok bool
+			if unaligned, ok = err.(UnalignedFieldsError); !ok {
+				t.Errorf("unexpected error for aligned %q: %v", test.name, err)
+				continue
+			}
+		}
+		dstTyp, err := UnpackedStructFor(srcTyp)
+		if err != nil {
+			t.Errorf("unexpected error for unaligned %q: %v", test.name, err)
+			continue
+		}
+
+		data := append([]byte(nil), test.data...)
+		src := reflect.NewAt(srcTyp, unsafe.Pointer(&data[0]))
+		dst := reflect.New(dstTyp)
+		err = UnpackCopy(dst, src, unaligned, data)
+		if err != nil {
+			t.Errorf("unexpected error for unpacking %q: %v", test.name, err)
+		}
+		for i := range data {
+			data[i] = 0xff
+		}
+
+		got := dst.Elem().Interface()
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unexpected result for %q after overwriting data:\ngot: %#v\nwant:%#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	for _, test := range unpackTests {
+		srcTyp, _, _, _, err := Struct(strings.NewReader(test.format))
+		var unaligned UnalignedFieldsError
+		if err != nil {
+			var ok bool
+			if unaligned, ok = err.(UnalignedFieldsError); !ok {
+				t.Errorf("unexpected error for aligned %q: %v", test.name, err)
+				continue
+			}
+		}
+		dstTyp, err := UnpackedStructFor(srcTyp)
+		if err != nil {
+			t.Errorf("unexpected error for unaligned %q: %v", test.name, err)
+			continue
+		}
+
+		data := append([]byte(nil), test.data...)
+		src := reflect.NewAt(srcTyp, unsafe.Pointer(&data[0]))
+		dst := reflect.New(dstTyp)
+		err = Unpack(dst, src, unaligned, data)
+		if err != nil {
+			t.Errorf("unexpected error for unpacking %q: %v", test.name, err)
+		}
+		ptr := Clone(dst)
+		val := Clone(dst.Elem())
+		if ptr.Kind() != reflect.Ptr || ptr.Pointer() == dst.Pointer() {
+			t.Errorf("unexpected pointer clone for %q: %v", test.name, ptr.Type())
+		}
+		if val.Kind() != reflect.Struct {
+			t.Errorf("unexpected value clone for %q: %v", test.name, val.Type())
+		}
+		for i := range data {
+			data[i] = 0xff
+		}
+
+		for _, got := range []interface{}{ptr.Elem().Interface(), val.Interface()} {
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("unexpected result for %q after overwriting data:\ngot: %#v\nwant:%#v", test.name, got, test.want)
+			}
+		}
+	}
+}
+
+func BenchmarkUnpack(b *testing.B) {
+	for _, test := range unpackTests {
+		srcTyp, _, _, _, err := Struct(strings.NewReader(test.format))
+		unaligned, ok := err.(UnalignedFieldsError)
+		if err != nil && !ok {
+			b.Fatalf("unexpected error for aligned %q: %v", test.name, err)
+		}
+		dstTyp, err := UnpackedStructFor(srcTyp)
+		if err != nil {
+			b.Fatalf("unexpected error for unaligned %q: %v", test.name, err)
+		}
+		src := reflect.NewAt(srcTyp, unsafe.Pointer(&test.data[0]))
+		dst := reflect.New(dstTyp)
+
+		for _, unpack := range []struct {
+			name string
+			fn   func(dst, src reflect.Value, unaligned UnalignedFieldsError, data []byte, opts ...Option) error
+		}{
+			{name: "alias", fn: Unpack},
+			{name: "copy", fn: UnpackCopy},
+		} {
+			b.Run(test.name+"/"+unpack.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					err := unpack.fn(dst, src, unaligned, test.data)
+					if err != nil {
+						b.Fatalf("unexpected error for unpacking %q: %v", test.name, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestUnpackDynamicLength(t *testing.T) {
+	const format = `name: fake
+ID: 1
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc u32[] raw;	offset:8;	size:4;	signed:0;
+`
+	srcTyp, _, _, _, err := Struct(strings.NewReader(format))
+	unaligned, ok := err.(UnalignedFieldsError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dstTyp, err := UnpackedStructFor(srcTyp)
+	if err != nil {
+		t.Fatalf("unexpected error for unpacked type: %v", err)
+	}
+
+	data := make([]byte, 20)
+	*(*uint32)(unsafe.Pointer(&data[8])) = 12 | 6<<16
+	src := reflect.NewAt(srcTyp, unsafe.Pointer(&data[0]))
+	dst := reflect.New(dstTyp)
+	err = Unpack(dst, src, unaligned, data)
+	wantErr := errors.New("invalid dynamic data length for u32[]: len=6 is not a multiple of element size 4")
+	if !reflect.DeepEqual(err, wantErr) {
+		t.Errorf("unexpected error for odd length: got:%#v want:%#v", err, wantErr)
+	}
+}
+
+func TestCharArraysAsBytes(t *testing.T) {
+	const format = `name: fake
+ID: 1
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:char fixed[8];	offset:8;	size:8;	signed:1;
+	field:__data_loc char[] dynamic;	offset:16;	size:4;	signed:1;
+	field:signed char schars[4];	offset:20;	size:4;	signed:1;
+`
+	for _, test := range []struct {
+		opts []Option
+		want interface{}
+	}{
+		{
+			want: struct {
+				Common_type          uint16  `ctyp:"unsigned short" name:"common_type"`
+				Common_flags         uint8   `ctyp:"unsigned char" name:"common_flags"`
+				Common_preempt_count uint8   `ctyp:"unsigned char" name:"common_preempt_count"`
+				Common_pid           int32   `ctyp:"int" name:"common_pid"`
+				Fixed                [8]int8 `ctyp:"char[8]" name:"fixed"`
+				Dynamic              []uint8 `ctyp:"__data_loc char[]" name:"dynamic"`
+				Schars               [4]int8 `ctyp:"signed char[4]" name:"schars"`
+			}{},
+		},
+		{
+			opts: []Option{CharArraysAsBytes()},
+			want: struct {
+				Common_type          uint16   `ctyp:"unsigned short" name:"common_type"`
+				Common_flags         uint8    `ctyp:"unsigned char" name:"common_flags"`
+				Common_preempt_count uint8    `ctyp:"unsigned char" name:"common_preempt_count"`
+				Common_pid           int32    `ctyp:"int" name:"common_pid"`
+				Fixed                [8]uint8 `ctyp:"char[8]" name:"fixed"`
+				Dynamic              []uint8  `ctyp:"__data_loc char[]" name:"dynamic"`
+				Schars               [4]int8  `ctyp:"signed char[4]" name:"schars"`
+			}{},
+		},
+	} {
+		f, err := ParseFormat(strings.NewReader(format), test.opts...)
+		if err != nil {
+			t.Errorf("unexpected error for %d options: %v", len(test.opts), err)
+			continue
+		}
+		checkStruct(t, "char arrays", f.Unpacked, test.want)
+	}
+}
+
+func TestUnpackReuse(t *testing.T) {
+	test := unpackTests[0]
+	srcTyp, _, _, _, err := Struct(strings.NewReader(test.format))
+	unaligned, ok := err.(UnalignedFieldsError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dstTyp, err := UnpackedStructFor(srcTyp)
+	if err != nil {
+		t.Fatalf("unexpected error for unpacked type: %v", err)
+	}
+	dst := reflect.New(dstTyp)
+
+	src := reflect.NewAt(srcTyp, unsafe.Pointer(&test.data[0]))
+	err = Unpack(dst, src, unaligned, test.data)
+	if err != nil {
+		t.Fatalf("unexpected error for first unpacking: %v", err)
+	}
+	got := dst.Elem().Interface()
+	if !reflect.DeepEqual(got, test.want) {
+		t.Errorf("unexpected result for first event:\ngot: %#v\nwant:%#v", got, test.want)
+	}
+
+	// Second event has an empty filename and different scalar values.
+	data := make([]byte, 32)
+	*(*uint16)(unsafe.Pointer(&data[0])) = 0x1bb2
+	*(*int32)(unsafe.Pointer(&data[4])) = 1
+	*(*uint32)(unsafe.Pointer(&data[20])) = 32
+	src = reflect.NewAt(srcTyp, unsafe.Pointer(&data[0]))
+	err = Unpack(dst, src, unaligned, data)
+	if err != nil {
+		t.Fatalf("unexpected error for second unpacking: %v", err)
+	}
+	want := reflect.New(dstTyp).Elem()
+	want.Field(0).SetUint(0x1bb2)
+	want.Field(3).SetInt(1)
+	got = dst.Elem().Interface()
+	if !reflect.DeepEqual(got, want.Interface()) {
+		t.Errorf("unexpected result for second event:\ngot: %#v\nwant:%#v", got, want)
+	}
+}
+
+func TestPointerArrays(t *testing.T) {
+	const format = `name: sched_process_exec_args
+ID: 7024
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:void * argv[4];	offset:8;	size:%[1]d;	signed:0;
+	field:u32 argc;	offset:%[2]d;	size:4;	signed:0;
+	field:void *envp[2];	offset:%[3]d;	size:%[4]d;	signed:0;
+`
+	ptr := int(unsafe.Sizeof(uintptr(0)))
+	argc := 8 + 4*ptr
+	envp := argc + 4
+	f, err := ParseFormat(strings.NewReader(fmt.Sprintf(format, 4*ptr, argc, envp, 2*ptr)))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+
+	argvField, _ := f.Type.FieldByName("Argv")
+	if argvField.Type != reflect.TypeOf([4]uintptr{}) {
+		t.Errorf("unexpected type for argv: got:%v want:%v", argvField.Type, reflect.TypeOf([4]uintptr{}))
+	}
+	if got := argvField.Tag.Get("ctyp"); got != "void*[4]" {
+		t.Errorf("unexpected ctyp for argv: got:%q want:%q", got, "void*[4]")
+	}
+	envpField, _ := f.Type.FieldByName("Envp")
+	if envpField.Type != reflect.ArrayOf(2*ptr, reflect.TypeOf(uint8(0))) {
+		t.Errorf("unexpected type for misaligned envp: %v", envpField.Type)
+	}
+	if got := envpField.Tag.Get("ctyp"); got != "void*[2]" {
+		t.Errorf("unexpected ctyp for envp: got:%q want:%q", got, "void*[2]")
+	}
+	if !reflect.DeepEqual(f.Unaligned.Fields, []int{envpField.Index[0]}) {
+		t.Errorf("unexpected unaligned fields: %v", f.Unaligned.Fields)
+	}
+
+	data := make([]byte, envp+2*ptr)
+	argv := [4]uintptr{0x1000, 0x2000, 0x3000, 0}
+	copy(data[8:], unsafe.Slice((*byte)(unsafe.Pointer(&argv)), unsafe.Sizeof(argv)))
+	env := [2]uintptr{0xdead0000, 0xbeef0000}
+	copy(data[envp:], unsafe.Slice((*byte)(unsafe.Pointer(&env)), unsafe.Sizeof(env)))
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if got := dst.Elem().FieldByName("Argv").Interface(); got != argv {
+		t.Errorf("unexpected argv: got:%#x want:%#x", got, argv)
+	}
+	if got := dst.Elem().FieldByName("Envp").Interface(); got != env {
+		t.Errorf("unexpected envp: got:%#x want:%#x", got, env)
+	}
+}
+
+func TestDynamicArraySigned(t *testing.T) {
+	const format = `name: dynamic_signed
+ID: 7025
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc char[] %s;	offset:8;	size:4;	signed:%d;
+	field:__data_loc %s vals;	offset:12;	size:4;	signed:%d;
+`
+	tests := []struct {
+		charSigned int
+		elem       string
+		elemSigned int
+		wantChar   reflect.Type
+		wantElem   reflect.Type
+		wantErr    string
+	}{
+		{charSigned: 1, elem: "s32[]", elemSigned: 1, wantChar: reflect.TypeOf([]byte(nil)), wantElem: reflect.TypeOf([]int32(nil))},
+		{charSigned: 0, elem: "u16[]", elemSigned: 0, wantChar: reflect.TypeOf([]byte(nil)), wantElem: reflect.TypeOf([]uint16(nil))},
+		{
+			charSigned: 1, elem: "s32[]", elemSigned: 0,
+			wantErr: "field vals: inconsistent signedness for dynamic array of s32[]: signed:0",
+		},
+		{
+			charSigned: 1, elem: "u64[]", elemSigned: 1,
+			wantErr: "field vals: inconsistent signedness for dynamic array of u64[]: signed:1",
+		},
+	}
+	for _, test := range tests {
+		f, err := ParseFormat(strings.NewReader(fmt.Sprintf(format, "device", test.charSigned, test.elem, test.elemSigned)))
+		if err != nil {
+			if err.Error() != test.wantErr {
+				t.Errorf("unexpected error for %s signed:%d: got:%v want:%s", test.elem, test.elemSigned, err, test.wantErr)
+			}
+			continue
+		}
+		if test.wantErr != "" {
+			t.Errorf("expected error for %s signed:%d", test.elem, test.elemSigned)
+			continue
+		}
+		if got := f.Unpacked.Field(4).Type; got != test.wantChar {
+			t.Errorf("unexpected type for char[] signed:%d: got:%v want:%v", test.charSigned, got, test.wantChar)
+		}
+		if got := f.Unpacked.Field(5).Type; got != test.wantElem {
+			t.Errorf("unexpected type for %s signed:%d: got:%v want:%v", test.elem, test.elemSigned, got, test.wantElem)
+		}
+	}
+}
+
+func TestUnpackSignExtend(t *testing.T) {
+	const format = `name: sign_extend
+ID: 7026
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u8 pad;	offset:8;	size:1;	signed:0;
+	field:s16 delta;	offset:9;	size:2;	signed:1;
+	field:u16 count;	offset:11;	size:2;	signed:0;
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if !reflect.DeepEqual(f.Unaligned.Fields, []int{5, 6}) {
+		t.Fatalf("unexpected unaligned fields: %v", f.Unaligned.Fields)
+	}
+
+	// Construct a destination with widened delta and count fields.
+	fields := make([]reflect.StructField, f.Unpacked.NumField())
+	for i := range fields {
+		fields[i] = f.Unpacked.Field(i)
+	}
+	fields[5].Type = reflect.TypeOf(int32(0))
+	fields[6].Type = reflect.TypeOf(uint64(0))
+	dst := reflect.New(reflect.StructOf(fields))
+
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint16(data[9:], uint16(0xfffe)) // -2
+	binary.LittleEndian.PutUint16(data[11:], 0xfffe)
+	src := reflect.NewAt(f.Type, unsafe.Pointer(&data[0]))
+	err = Unpack(dst, src, f.Unaligned, data, ByteOrder(binary.LittleEndian))
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if got := dst.Elem().Field(5).Int(); got != -2 {
+		t.Errorf("unexpected signed value: got:%d want:%d", got, -2)
+	}
+	if got := dst.Elem().Field(6).Uint(); got != 0xfffe {
+		t.Errorf("unexpected unsigned value: got:%#x want:%#x", got, 0xfffe)
+	}
+
+	// Narrowing is not allowed.
+	fields[5].Type = reflect.TypeOf(int8(0))
+	err = Unpack(reflect.New(reflect.StructOf(fields)), src, f.Unaligned, data, ByteOrder(binary.LittleEndian))
+	if err == nil {
+		t.Error("expected error for narrowed destination")
+	}
+}
+
+func TestUnalignedSignedArray(t *testing.T) {
+	const format = `name: signed_array
+ID: 7031
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u8 pad;	offset:8;	size:1;	signed:0;
+	field:s16 deltas[3];	offset:9;	size:6;	signed:1;
+	field:u16 counts[3];	offset:15;	size:6;	signed:0;
+`
+	want := struct {
+		deltas [3]int16
+		counts [3]uint16
+	}{
+		deltas: [3]int16{-2, 1, -32768},
+		counts: [3]uint16{0xfffe, 1, 0x8000},
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		f, err := ParseFormat(strings.NewReader(format), ByteOrder(order))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		if !reflect.DeepEqual(f.Unaligned.Fields, []int{5, 6}) {
+			t.Fatalf("unexpected unaligned fields: %v", f.Unaligned.Fields)
+		}
+		if got := f.Type.Field(5).Tag.Get("unaligned"); got != "size:6; signed:1;" {
+			t.Errorf("unexpected unaligned tag for signed array: %q", got)
+		}
+		if got := f.Unpacked.Field(5).Type; got != reflect.TypeOf([3]int16{}) {
+			t.Errorf("unexpected unpacked type for signed array: %s", got)
+		}
+
+		data := make([]byte, 24)
+		for i, v := range want.deltas {
+			order.PutUint16(data[9+2*i:], uint16(v))
+		}
+		for i, v := range want.counts {
+			order.PutUint16(data[15+2*i:], v)
+		}
+		dst := reflect.New(f.Unpacked)
+		err = f.Unpack(dst, data, ByteOrder(order))
+		if err != nil {
+			t.Fatalf("unexpected error unpacking %s data: %v", order, err)
+		}
+		if got := dst.Elem().Field(5).Interface(); got != want.deltas {
+			t.Errorf("unexpected signed array for %s data: got:%v want:%v", order, got, want.deltas)
+		}
+		if got := dst.Elem().Field(6).Interface(); got != want.counts {
+			t.Errorf("unexpected unsigned array for %s data: got:%v want:%v", order, got, want.counts)
+		}
+	}
+}
+
+func TestUnalignedSignedScalar(t *testing.T) {
+	const format = `name: signed_scalar
+ID: 7066
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u8 pad;	offset:8;	size:1;	signed:0;
+	field:int ret;	offset:9;	size:4;	signed:1;
+	field:u32 laddr;	offset:13;	size:4;	signed:0;
+	field:s64 delta;	offset:17;	size:8;	signed:1;
+`
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		f, err := ParseFormat(strings.NewReader(format), ByteOrder(order))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		if !reflect.DeepEqual(f.Unaligned.Fields, []int{5, 6, 7}) {
+			t.Fatalf("unexpected unaligned fields: %v", f.Unaligned.Fields)
+		}
+		for _, want := range []struct {
+			index int
+			tag   string
+			typ   reflect.Type
+			wire  reflect.Type
+		}{
+			{index: 5, tag: "size:4; signed:1;", typ: reflect.TypeOf(int32(0)), wire: reflect.TypeOf([4]uint8{})},
+			{index: 6, tag: "size:4; signed:0;", typ: reflect.TypeOf(uint32(0)), wire: reflect.TypeOf([4]uint8{})},
+			{index: 7, tag: "size:8; signed:1;", typ: reflect.TypeOf(int64(0)), wire: reflect.TypeOf([8]uint8{})},
+		} {
+			i := want.index
+			if got := f.Type.Field(i).Type; got != want.wire {
+				t.Errorf("unexpected packed type for field %d: got:%s want:%s", i, got, want.wire)
+			}
+			if got := f.Type.Field(i).Tag.Get("unaligned"); got != want.tag {
+				t.Errorf("unexpected unaligned tag for field %d: got:%q want:%q", i, got, want.tag)
+			}
+			if got := f.Unpacked.Field(i).Type; got != want.typ {
+				t.Errorf("unexpected unpacked type for field %d: got:%s want:%s", i, got, want.typ)
+			}
+		}
+
+		data := make([]byte, 32)
+		order.PutUint32(data[9:], uint32(0xfffffff2))
+		order.PutUint32(data[13:], 0xfffffffe)
+		order.PutUint64(data[17:], uint64(0x8000000000000000))
+		dst := reflect.New(f.Unpacked)
+		err = f.Unpack(dst, data, ByteOrder(order))
+		if err != nil {
+			t.Fatalf("unexpected error unpacking %s data: %v", order, err)
+		}
+		if got := dst.Elem().Field(5).Int(); got != -14 {
+			t.Errorf("unexpected signed 32 bit value for %s data: got:%d want:-14", order, got)
+		}
+		if got := dst.Elem().Field(6).Uint(); got != 0xfffffffe {
+			t.Errorf("unexpected unsigned 32 bit value for %s data: got:%#x want:0xfffffffe", order, got)
+		}
+		if got := dst.Elem().Field(7).Int(); got != -1<<63 {
+			t.Errorf("unexpected signed 64 bit value for %s data: got:%d want:%d", order, got, -1<<63)
+		}
+	}
+}
+
+func TestWithPadName(t *testing.T) {
+	test := unpackTests[1]
+	base, err := ParseFormat(strings.NewReader(test.format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	baseDst := reflect.New(base.Unpacked)
+	err = base.Unpack(baseDst, test.data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+
+	for _, pattern := range []string{"_pad%d", "Pad%d"} {
+		f, err := ParseFormat(strings.NewReader(test.format), WithPadName(func(i int) string {
+			return fmt.Sprintf(pattern, i)
+		}))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format with %q: %v", pattern, err)
+		}
+		if f.Type.NumField() != base.Type.NumField() {
+			t.Fatalf("unexpected number of fields with %q: got:%d want:%d", pattern, f.Type.NumField(), base.Type.NumField())
+		}
+		var pads int
+		for i := 0; i < f.Type.NumField(); i++ {
+			got, want := f.Type.Field(i), base.Type.Field(i)
+			if got.Offset != want.Offset || got.Type != want.Type {
+				t.Errorf("unexpected field %d with %q: got:%+v want:%+v", i, pattern, got, want)
+			}
+			if want.Name != "_" {
+				continue
+			}
+			if wantName := fmt.Sprintf(pattern, pads); got.Name != wantName {
+				t.Errorf("unexpected padding name with %q: got:%s want:%s", pattern, got.Name, wantName)
+			}
+			if f.Unpacked.Field(i).Type.Size() != 0 {
+				t.Errorf("unexpected unpacked padding size with %q: %d", pattern, f.Unpacked.Field(i).Type.Size())
+			}
+			pads++
+		}
+		if pads != 2 {
+			t.Errorf("unexpected number of padding fields with %q: got:%d want:2", pattern, pads)
+		}
+
+		dst := reflect.New(f.Unpacked)
+		err = f.Unpack(dst, test.data)
+		if err != nil {
+			t.Fatalf("unexpected error unpacking with %q: %v", pattern, err)
+		}
+		for _, field := range f.Fields {
+			got := dst.Elem().FieldByIndex(field.Index).Interface()
+			want := baseDst.Elem().FieldByIndex(field.Index).Interface()
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("unexpected value for %s with %q: got:%v want:%v", field.Name, pattern, got, want)
+			}
+		}
+	}
+
+	for _, name := range []string{"pad", "x-y", "_"} {
+		name := name
+		_, err := ParseFormat(strings.NewReader(test.format), WithPadName(func(int) string { return name }))
+		if err == nil {
+			t.Errorf("expected error for padding name %q", name)
+		}
+	}
+}
+
+func TestDynamicArray128(t *testing.T) {
+	const format = `name: u128_array
+ID: 7033
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc u128[] addrs;	offset:8;	size:4;	signed:0;
+`
+	var want [][16]byte
+	data := make([]byte, 16)
+	for i := 0; i < 2; i++ {
+		var a [16]byte
+		for j := range a {
+			a[j] = byte(16*i + j)
+		}
+		want = append(want, a)
+		data = append(data, a[:]...)
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		order.PutUint32(data[8:], 32<<16|16)
+		f, err := ParseFormat(strings.NewReader(format), Strict(), ByteOrder(order))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		if got := f.Unpacked.Field(4).Type; got != reflect.TypeOf([][16]byte(nil)) {
+			t.Errorf("unexpected unpacked type: %s", got)
+		}
+		for _, unpack := range []struct {
+			name string
+			fn   func(dst, src reflect.Value, unaligned UnalignedFieldsError, data []byte, opts ...Option) error
+		}{
+			{name: "alias", fn: Unpack},
+			{name: "copy", fn: UnpackCopy},
+		} {
+			dst := reflect.New(f.Unpacked)
+			src := reflect.NewAt(f.Type, unsafe.Pointer(&data[0]))
+			err = unpack.fn(dst, src, f.Unaligned, data, ByteOrder(order))
+			if err != nil {
+				t.Fatalf("unexpected error for %s %s: %v", unpack.name, order, err)
+			}
+			got := dst.Elem().Field(4).Interface()
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("unexpected result for %s %s:\ngot: %v\nwant:%v", unpack.name, order, got, want)
+			}
+		}
+	}
+}
+
+func TestUnexpectedElementSize(t *testing.T) {
+	const header = `name: element_size
+ID: 7034
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+`
+	for _, field := range []string{
+		"\tfield:u8 x[2];\toffset:8;\tsize:6;\tsigned:0;\n",
+		"\tfield:u24 x;\toffset:8;\tsize:3;\tsigned:0;\n",
+		"\tfield:char x[0];\toffset:8;\tsize:0;\tsigned:1;\n",
+		"\tfield:u32 x;\toffset:8;\tsize:0;\tsigned:0;\n",
+		"\tfield:u32 x;\toffset:8;\tsize:-4;\tsigned:0;\n",
+		"\tfield:u16 x[3];\toffset:8;\tsize:0;\tsigned:0;\n",
+		"\tfield:u32 x[5];\toffset:8;\tsize:15;\tsigned:0;\n",
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("unexpected panic for %q: %v", field, r)
+				}
+			}()
+			_, err := ParseFormat(strings.NewReader(header + field))
+			if err == nil {
+				t.Errorf("expected error for %q", field)
+			}
+		}()
+	}
+
+	// Arrays with element sizes that are not a supported integer
+	// width are reported with the element size.
+	_, err := ParseFormat(strings.NewReader(header + "\tfield:u32 x[5];\toffset:8;\tsize:15;\tsigned:0;\n"))
+	if err == nil || !strings.Contains(err.Error(), "element size=3") {
+		t.Errorf("unexpected error for three byte elements: %v", err)
+	}
+
+	// Element sizes that are not produced by any known C type
+	// are reported as errors by the dynamic array decoder.
+	for _, detach := range []bool{false, true} {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("unexpected panic for detach=%t: %v", detach, r)
+				}
+			}()
+			_, err := dynamicArrayValue(typeClass{3, false}, make([]byte, 6), binary.LittleEndian, detach)
+			if err == nil {
+				t.Errorf("expected error for detach=%t", detach)
+			}
+		}()
+	}
+}
+
+func TestStructPkgPath(t *testing.T) {
+	for _, pkg := range []string{"", "/kprobe", "github.com//kprobe", "github.com/kortschak/kprobe ", "a/../b"} {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("unexpected panic for %q: %v", pkg, r)
+				}
+			}()
+			_, _, _, _, err := StructPkg(strings.NewReader(formatTests[0].format), pkg)
+			if err == nil {
+				t.Errorf("expected error for %q", pkg)
+			}
+		}()
+	}
+	for _, pkg := range []string{"main", "example.com/probes", "github.com/kortschak/kprobe"} {
+		typ, _, _, _, err := StructPkg(strings.NewReader(formatTests[0].format), pkg)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", pkg, err)
+			continue
+		}
+		if got := typ.Field(4).PkgPath; got != pkg {
+			t.Errorf("unexpected padding package path: got:%q want:%q", got, pkg)
+		}
+	}
+}
+
+func TestFetchargString(t *testing.T) {
+	const format = `name: uprobe_open
+ID: 7036
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:unsigned long __probe_ip;	offset:8;	size:8;	signed:0;
+	field:string path;	offset:16;	size:4;	signed:1;
+	field:ustring mode;	offset:20;	size:4;	signed:1;
+
+print fmt: "(%lx) path=\"%s\" mode=\"%s\"", REC->__probe_ip, __get_str(path), __get_str(mode)
+`
+	f, err := ParseFormat(strings.NewReader(format), Strict())
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	for _, name := range []string{"path", "mode"} {
+		field, _ := f.FieldByName(name)
+		if field.CType != "__data_loc char[]" {
+			t.Errorf("unexpected C type for %s: %q", name, field.CType)
+		}
+	}
+
+	data := make([]byte, 24)
+	machine.PutUint32(data[16:], 10<<16|24)
+	machine.PutUint32(data[20:], 2<<16|34)
+	data = append(data, "/etc/motd\x00r\x00"...)
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	for name, want := range map[string]string{"path": "/etc/motd", "mode": "r"} {
+		got, ok := CStringField(dst, name)
+		if !ok || got != want {
+			t.Errorf("unexpected value for %s: got:%q ok:%t want:%q", name, got, ok, want)
+		}
+	}
+
+	for _, typ := range []string{"symbol", "symstr", "b4@3/32", "bitfield"} {
+		_, err := ParseFormat(strings.NewReader(strings.Replace(format, "field:ustring mode", "field:"+typ+" mode", 1)))
+		want := fmt.Sprintf("field mode: unsupported fetcharg type: %q", typ)
+		if err == nil || err.Error() != want {
+			t.Errorf("unexpected error for %s: got:%v want:%s", typ, err, want)
+		}
+	}
+}
+
+func TestArrayAlignment(t *testing.T) {
+	const header = `name: array_alignment
+ID: 7039
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+`
+	tests := []struct {
+		fields        string
+		wantUnaligned []int
+	}{
+		{
+			fields: "\tfield:u8 flag;\toffset:8;\tsize:1;\tsigned:0;\n" +
+				"\tfield:u8 mac[8];\toffset:9;\tsize:8;\tsigned:0;\n",
+		},
+		{
+			fields: "\tfield:u8 flag;\toffset:8;\tsize:1;\tsigned:0;\n" +
+				"\tfield:char comm[40];\toffset:9;\tsize:40;\tsigned:1;\n",
+		},
+		{
+			fields: "\tfield:char comm[40];\toffset:8;\tsize:40;\tsigned:1;\n",
+		},
+		{
+			fields: "\tfield:u16 port;\toffset:8;\tsize:2;\tsigned:0;\n" +
+				"\tfield:u32 addrs[2];\toffset:12;\tsize:8;\tsigned:0;\n",
+		},
+		{
+			fields: "\tfield:u16 port;\toffset:8;\tsize:2;\tsigned:0;\n" +
+				"\tfield:u32 addrs[2];\toffset:10;\tsize:8;\tsigned:0;\n",
+			wantUnaligned: []int{5},
+		},
+	}
+	for _, test := range tests {
+		f, err := ParseFormat(strings.NewReader(header + test.fields))
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.fields, err)
+			continue
+		}
+		if !reflect.DeepEqual(f.Unaligned.Fields, test.wantUnaligned) {
+			t.Errorf("unexpected unaligned fields for %q: got:%v want:%v", test.fields, f.Unaligned.Fields, test.wantUnaligned)
+		}
+		last := f.Fields[len(f.Fields)-1]
+		if test.wantUnaligned == nil && f.Type.Field(last.Index[0]).Type.Kind() != reflect.Array {
+			t.Errorf("unexpected type for %s: %s", last.Name, f.Type.Field(last.Index[0]).Type)
+		}
+		if test.wantUnaligned == nil && last.Type != f.Unpacked.Field(last.Index[0]).Type {
+			t.Errorf("unexpected unpacked type for %s: got:%s want:%s", last.Name, f.Unpacked.Field(last.Index[0]).Type, last.Type)
+		}
+	}
+}
+
+func TestParseFieldColumns(t *testing.T) {
+	want := Field{Name: "dfd", CType: "u32", Offset: 16, Size: 4}
+	tests := []struct {
+		line    string
+		wantErr bool
+	}{
+		{line: "\tfield:u32 dfd;\toffset:16;\tsize:4;\tsigned:0;"},
+		{line: "\tfield:u32 dfd;\toffset:16;\tsize:4;\tsigned:0;\talign:4;"},
+		{line: "\tfield:u32 dfd;\tsigned:0;\tsize:4;\toffset:16;"},
+		{line: "\tfield:u32 dfd;\toffset:16;\tsize:4;\tsigned:0;\t"},
+		{line: "\tfield:u32 dfd;\toffset:16;\tsize:4;", wantErr: true},
+		{line: "\tfield:u32 dfd;\toffset:16;\toffset:20;\tsize:4;\tsigned:0;", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseField(test.line)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("expected error for %q", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected field for %q: got:%+v want:%+v", test.line, got, want)
+		}
+	}
+
+	format := strings.Replace(unpackTests[0].format, "signed:0;\n", "signed:0;\talign:4;\n", -1)
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format with extra column: %v", err)
+	}
+	base, err := ParseFormat(strings.NewReader(unpackTests[0].format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if !reflect.DeepEqual(f.Fields, base.Fields) {
+		t.Errorf("unexpected fields with extra column:\ngot: %+v\nwant:%+v", f.Fields, base.Fields)
+	}
+}
+
+func TestParseID(t *testing.T) {
+	tests := []struct {
+		id      string
+		want    uint16
+		wantErr string
+	}{
+		{id: "780", want: 780},
+		{id: "0x30c", want: 780},
+		{id: "0X30C", want: 780},
+		{id: "65535", want: 65535},
+		{id: "0xffff", want: 65535},
+		{id: "010", want: 10},
+		{id: "0x010", want: 16},
+		{id: "65536", wantErr: `format id overflows uint16: "65536"`},
+		{id: "0x10000", wantErr: `format id overflows uint16: "0x10000"`},
+		{id: "-1", wantErr: `invalid format id: "-1"`},
+		{id: "0xzz", wantErr: `invalid format id: "0xzz"`},
+		{id: "0x", wantErr: `invalid format id: "0x"`},
+		{id: "0o17", wantErr: `invalid format id: "0o17"`},
+		{id: "1_000", wantErr: `invalid format id: "1_000"`},
+	}
+	for _, test := range tests {
+		format := "name: id_test\nID: " + test.id + "\nformat:\n\tfield:unsigned short common_type;\toffset:0;\tsize:2;\tsigned:0;\n"
+		f, err := ParseFormat(strings.NewReader(format))
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("unexpected error for %q: got:%v want:%s", test.id, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.id, err)
+			continue
+		}
+		if f.ID != test.want {
+			t.Errorf("unexpected ID for %q: got:%d want:%d", test.id, f.ID, test.want)
+		}
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	tests := []struct {
+		desc      string
+		wantCType string
+		wantName  string
+		wantErr   string
+	}{
+		{desc: "field:unsigned long long val;", wantCType: "unsigned long long", wantName: "val"},
+		{desc: "field:unsigned long long x[2];", wantCType: "unsigned long long[2]", wantName: "x"},
+		{desc: "field:unsigned  long   long x[2];", wantCType: "unsigned long long[2]", wantName: "x"},
+		{desc: "field:unsigned long long x [2];", wantCType: "unsigned long long[2]", wantName: "x"},
+		{desc: "field:unsigned long long x[ 2 ];", wantCType: "unsigned long long[2]", wantName: "x"},
+		{desc: "field: int  common_pid ;", wantCType: "int", wantName: "common_pid"},
+		{desc: "field:__data_loc char [] filename;", wantCType: "__data_loc char[]", wantName: "filename"},
+		{desc: "field:void * argv [4];", wantCType: "void*[4]", wantName: "argv"},
+		{desc: "field:int;", wantErr: `invalid field description: "int"`},
+		{desc: "field:int 2x;", wantErr: `invalid field name in field description: "int 2x"`},
+		{desc: "field:int x-y;", wantErr: `invalid field name in field description: "int x-y"`},
+		{desc: "field:int [2];", wantErr: `invalid field description: "int [2]"`},
+	}
+	for _, test := range tests {
+		ctyp, name, err := fieldName(test.desc)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("unexpected error for %q: got:%v want:%s", test.desc, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.desc, err)
+			continue
+		}
+		if ctyp != test.wantCType || name != test.wantName {
+			t.Errorf("unexpected result for %q: got:(%q, %q) want:(%q, %q)",
+				test.desc, ctyp, name, test.wantCType, test.wantName)
+		}
+	}
+}
+
+func TestRelLoc(t *testing.T) {
+	const format = `name: rel_loc_test
+ID: 7027
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__rel_loc char[] name;	offset:8;	size:4;	signed:1;
+	field:u32 id;	offset:12;	size:4;	signed:0;
+
+print fmt: "name=%s id=%u", __get_rel_str(name), REC->id
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if !f.Unaligned.DynamicArray {
+		t.Error("expected dynamic array for __rel_loc field")
+	}
+	field, _ := f.Unpacked.FieldByName("Name")
+	if field.Type != reflect.TypeOf([]byte(nil)) {
+		t.Errorf("unexpected type for __rel_loc char[]: %v", field.Type)
+	}
+
+	data := make([]byte, 16, 22)
+	// The data follows the fixed record at offset 16, which is
+	// 4 bytes after the end of the locator field.
+	binary.LittleEndian.PutUint32(data[8:], 4|6<<16)
+	binary.LittleEndian.PutUint32(data[12:], 42)
+	data = append(data, "hello\x00"...)
+
+	err = f.Validate(data)
+	if err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data, ByteOrder(binary.LittleEndian))
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	name, ok := CStringField(dst, "name")
+	if !ok || name != "hello" {
+		t.Errorf("unexpected name: got:%q ok:%t", name, ok)
+	}
+	got, err := Sprint(f, dst)
+	if err != nil {
+		t.Fatalf("unexpected error printing: %v", err)
+	}
+	if want := "name=hello id=42"; got != want {
+		t.Errorf("unexpected print result: got:%q want:%q", got, want)
+	}
+
+	// An offset valid for __data_loc is out of range for __rel_loc.
+	binary.LittleEndian.PutUint32(data[8:], 16|6<<16)
+	err = f.Validate(data)
+	if err == nil {
+		t.Error("expected validation error for out of range __rel_loc")
+	}
+}
+
+func TestWithLengthField(t *testing.T) {
+	var format string
+	for _, test := range formatTests {
+		if test.name == "ath10k_htt_stats" {
+			format = test.format
+			break
+		}
+	}
+	if format == "" {
+		t.Fatal("missing ath10k_htt_stats format")
+	}
+
+	data := make([]byte, 40)
+	machine.PutUint32(data[8:], 4<<16|28)
+	machine.PutUint32(data[12:], 4<<16|32)
+	machine.PutUint64(data[16:], 3)
+	// The locator for buf does not hold its length.
+	machine.PutUint32(data[24:], 36)
+	copy(data[28:], "dev\x00drv\x00\x01\x02\x03")
+
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	field, _ := f.FieldByName("buf")
+
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if got := dst.Elem().FieldByIndex(field.Index).Bytes(); len(got) != 0 {
+		t.Errorf("unexpected buf without length field: %v", got)
+	}
+
+	err = f.Unpack(dst, data, WithLengthField("buf", "buf_len"))
+	if err != nil {
+		t.Fatalf("unexpected error unpacking with length field: %v", err)
+	}
+	if got, want := dst.Elem().FieldByIndex(field.Index).Bytes(), []byte{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected buf with length field: got:%v want:%v", got, want)
+	}
+
+	// Lengths that extend beyond the data are an error.
+	machine.PutUint64(data[16:], 5)
+	err = f.Unpack(dst, data, WithLengthField("buf", "buf_len"))
+	if err == nil {
+		t.Error("expected error for length beyond end of data")
+	}
+
+	err = f.Unpack(dst, data, WithLengthField("buf", "missing"))
+	if err == nil {
+		t.Error("expected error for missing length field")
+	}
+
+	// The length field is read in the byte order of the record.
+	var order binary.ByteOrder = binary.BigEndian
+	if machine == binary.BigEndian {
+		order = binary.LittleEndian
+	}
+	order.PutUint32(data[8:], 4<<16|28)
+	order.PutUint32(data[12:], 4<<16|32)
+	order.PutUint64(data[16:], 3)
+	order.PutUint32(data[24:], 36)
+	f, err = ParseFormat(strings.NewReader(format), ByteOrder(order))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	dst = reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data, WithLengthField("buf", "buf_len"))
+	if err != nil {
+		t.Fatalf("unexpected error unpacking with length field in %v: %v", order, err)
+	}
+	if got, want := dst.Elem().FieldByIndex(field.Index).Bytes(), []byte{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected buf with length field in %v: got:%v want:%v", order, got, want)
+	}
+}
+
+func TestSignedCharDynamicArray(t *testing.T) {
+	const format = `name: schar_test
+ID: 7063
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc schar[] a;	offset:8;	size:4;	signed:1;
+	field:__data_loc signed char[] b;	offset:12;	size:4;	signed:1;
+	field:__rel_loc __s8[] c;	offset:16;	size:4;	signed:1;
+`
+	data := make([]byte, 32)
+	machine.PutUint32(data[8:], 3<<16|20)
+	machine.PutUint32(data[12:], 3<<16|23)
+	machine.PutUint32(data[16:], 3<<16|6) // 20+6=26
+	copy(data[20:], []byte{0x80, 0xff, 0x01, 0xfe, 0x00, 0x7f, 0x81, 0x02, 0xff})
+	want := map[string][]int8{
+		"a": {-128, -1, 1},
+		"b": {-2, 0, 127},
+		"c": {-127, 2, -1},
+	}
+
+	for _, detach := range []bool{false, true} {
+		f, err := ParseFormat(strings.NewReader(format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		src := reflect.NewAt(f.Type, unsafe.Pointer(&data[0]))
+		dst := reflect.New(f.Unpacked)
+		if detach {
+			err = UnpackCopy(dst, src, f.Unaligned, data)
+		} else {
+			err = Unpack(dst, src, f.Unaligned, data)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error unpacking detach=%t: %v", detach, err)
+		}
+		for name, w := range want {
+			field, _ := f.FieldByName(name)
+			got := dst.Elem().FieldByIndex(field.Index).Interface()
+			if !reflect.DeepEqual(got, w) {
+				t.Errorf("unexpected value for %s detach=%t: got:%#v want:%#v", name, detach, got, w)
+			}
+		}
+	}
+}
+
+func TestStructAuto(t *testing.T) {
+	for _, test := range formatTests {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := io.WriteString(w, test.format)
+		if err != nil {
+			t.Fatalf("unexpected error compressing %q: %v", test.name, err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatalf("unexpected error compressing %q: %v", test.name, err)
+		}
+
+		wantTyp, wantName, wantID, wantSize, wantErr := Struct(strings.NewReader(test.format))
+		for _, input := range []struct {
+			name string
+			r    io.Reader
+		}{
+			{name: "plain", r: strings.NewReader(test.format)},
+			{name: "gzip", r: bytes.NewReader(buf.Bytes())},
+		} {
+			typ, name, id, size, err := StructAuto(input.r)
+			if typ != wantTyp || name != wantName || id != wantID || size != wantSize {
+				t.Errorf("unexpected result for %s %q: got:%v %q %d %d want:%v %q %d %d",
+					input.name, test.name, typ, name, id, size, wantTyp, wantName, wantID, wantSize)
+			}
+			if !reflect.DeepEqual(err, wantErr) {
+				t.Errorf("unexpected error for %s %q: got:%v want:%v", input.name, test.name, err, wantErr)
+			}
+		}
+	}
+
+	_, _, _, _, err := StructAuto(bytes.NewReader([]byte{0x1f, 0x8b, 0x08}))
+	if err == nil {
+		t.Error("expected error for truncated gzip data")
+	}
+	_, _, _, _, err = StructAuto(strings.NewReader(""))
+	if err != nil {
+		t.Errorf("unexpected error for empty input: %v", err)
+	}
+}
+
+func TestBool(t *testing.T) {
+	const format = `name: bool_test
+ID: 7028
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:bool enabled;	offset:8;	size:1;	signed:0;
+	field:bool mask[3];	offset:9;	size:3;	signed:0;
+	field:__data_loc char[] name;	offset:12;	size:4;	signed:1;
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	checkStruct(t, "bool", f.Unpacked, struct {
+		Common_type          uint16  `ctyp:"unsigned short" name:"common_type"`
+		Common_flags         uint8   `ctyp:"unsigned char" name:"common_flags"`
+		Common_preempt_count uint8   `ctyp:"unsigned char" name:"common_preempt_count"`
+		Common_pid           int32   `ctyp:"int" name:"common_pid"`
+		Enabled              bool    `ctyp:"bool" name:"enabled"`
+		Mask                 [3]bool `ctyp:"bool[3]" name:"mask"`
+		Name                 []uint8 `ctyp:"__data_loc char[]" name:"name"`
+	}{})
+
+	data := []byte{
+		0x5c, 0x1b, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0xff, 0x01, 0x00, 0x00, 0x00, 0x00,
+	}
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if !dst.Elem().Field(4).Bool() {
+		t.Error("expected non-zero bool to unpack as true")
+	}
+	wantMask := [3]bool{false, true, true}
+	if got := dst.Elem().Field(5).Interface(); got != wantMask {
+		t.Errorf("unexpected bool array: got:%v want:%v", got, wantMask)
+	}
+}
+
+func TestWithLogf(t *testing.T) {
+	const format = `name: logged
+ID: 7067
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u8 pad;	offset:8;	size:1;	signed:0;
+	field:u32 laddr;	offset:9;	size:4;	signed:0;
+	field:struct foo state;	offset:13;	size:1;	signed:0;
+	field:__data_loc char[] name;	offset:16;	size:4;	signed:1;
+`
+	var got []string
+	logf := func(format string, args ...interface{}) {
+		got = append(got, fmt.Sprintf(format, args...))
+	}
+	_, _, _, _, err := Struct(strings.NewReader(format), WithLogf(logf))
+	if _, ok := err.(UnalignedFieldsError); !ok {
+		t.Fatalf("unexpected error: got:%v want:UnalignedFieldsError", err)
+	}
+	want := []string{
+		"logged: field laddr: unaligned u32 at offset 9 represented as [4]uint8",
+		`logged: field state: unknown C type: "struct foo"`,
+		"logged: field name: dynamic array __data_loc char[]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected log messages:\ngot: %q\nwant:%q", got, want)
+	}
+
+	got = nil
+	_, _, _, _, err = Struct(strings.NewReader(format), WithLogf(logf), Strict())
+	if err == nil {
+		t.Fatal("expected error for unknown type in strict mode")
+	}
+	// Messages are emitted as fields are found, so fields
+	// before the failing field are still reported.
+	want = want[:1]
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected log messages in strict mode:\ngot: %q\nwant:%q", got, want)
+	}
+}
+
+func TestMaxDynamicLen(t *testing.T) {
+	const format = `name: dynamic_len
+ID: 7068
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:__data_loc char[] name;	offset:8;	size:4;	signed:1;
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	data := make([]byte, 20)
+	machine.PutUint32(data[8:], 8<<16|12)
+	copy(data[12:], "payload\x00")
+
+	for _, test := range []struct {
+		opts    []Option
+		wantErr bool
+	}{
+		{opts: nil},
+		{opts: []Option{MaxDynamicLen(0)}},
+		{opts: []Option{MaxDynamicLen(8)}},
+		{opts: []Option{MaxDynamicLen(7)}, wantErr: true},
+	} {
+		dst := reflect.New(f.Unpacked)
+		err = f.Unpack(dst, data, test.opts...)
+		if (err != nil) != test.wantErr {
+			t.Errorf("unexpected error for %d options: got:%v want error:%t", len(test.opts), err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got, _ := CStringField(dst, "name"); got != "payload" {
+			t.Errorf("unexpected name: got:%q want:%q", got, "payload")
+		}
+	}
+}
+
+func TestMaxLineLen(t *testing.T) {
+	// The default bufio.Scanner token size limit.
+	const defaultScannerLimit = 64 << 10
+
+	format := `name: long_print
+ID: 7069
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u32 value;	offset:8;	size:4;	signed:0;
+
+print fmt: "` + strings.Repeat("x", 2*defaultScannerLimit) + ` value=%u", REC->value
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format with long print fmt: %v", err)
+	}
+	if len(f.PrintFmt) <= defaultScannerLimit {
+		t.Errorf("unexpected print fmt length: %d", len(f.PrintFmt))
+	}
+	if !reflect.DeepEqual(f.PrintFields, []string{"value"}) {
+		t.Errorf("unexpected print fields: %q", f.PrintFields)
+	}
+
+	_, err = ParseFormat(strings.NewReader(format), MaxLineLen(defaultScannerLimit))
+	if !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("unexpected error for line longer than limit: got:%v want:%v", err, bufio.ErrTooLong)
+	}
+}
+
+func TestPackedLayout(t *testing.T) {
+	// Fields follow their predecessors without gaps, but Go
+	// would insert alignment padding before src and seq.
+	const format = `name: packed_layout
+ID: 7072
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u8 proto;	offset:8;	size:1;	signed:0;
+	field:u16 src;	offset:9;	size:2;	signed:0;
+	field:u8 addr[3];	offset:11;	size:3;	signed:0;
+	field:u16 port;	offset:14;	size:2;	signed:0;
+	field:u64 seq;	offset:16;	size:8;	signed:0;
+	field:u8 tail;	offset:24;	size:1;	signed:0;
+	field:u64 ack;	offset:25;	size:8;	signed:0;
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	for _, field := range f.Fields {
+		sf := f.Type.FieldByIndex(field.Index)
+		if int(sf.Offset) != field.Offset {
+			t.Errorf("unexpected Go offset for %s: got:%d want:%d", field.Name, sf.Offset, field.Offset)
+		}
+	}
+	var unaligned []string
+	for _, i := range f.Unaligned.Fields {
+		unaligned = append(unaligned, f.Type.Field(i).Tag.Get("name"))
+	}
+	if want := []string{"src", "ack"}; !reflect.DeepEqual(unaligned, want) {
+		t.Errorf("unexpected unaligned fields: got:%q want:%q", unaligned, want)
+	}
+	if !f.NeedsUnpack() {
+		t.Error("expected format to need unpacking")
+	}
+
+	data := make([]byte, f.Size)
+	data[8] = 6
+	machine.PutUint16(data[9:], 0xbeef)
+	copy(data[11:], []byte{1, 2, 3})
+	machine.PutUint16(data[14:], 80)
+	machine.PutUint64(data[16:], 1<<40)
+	data[24] = 7
+	machine.PutUint64(data[25:], 1<<50)
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	for name, want := range map[string]uint64{
+		"proto": 6, "src": 0xbeef, "port": 80, "seq": 1 << 40, "tail": 7, "ack": 1 << 50,
+	} {
+		v, _ := fieldByCName(dst, name)
+		if got := v.Uint(); got != want {
+			t.Errorf("unexpected value for %s: got:%#x want:%#x", name, got, want)
+		}
+	}
+}
+
+func TestFieldByteOrder(t *testing.T) {
+	const format = `name: net_header
+ID: 7073
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u32 len;	offset:8;	size:4;	signed:0;
+	field:u32 saddr;	offset:12;	size:4;	signed:0;
+	field:u8 proto;	offset:16;	size:1;	signed:0;
+	field:u16 dport;	offset:17;	size:2;	signed:0;
+	field:__data_loc u16[] words;	offset:20;	size:4;	signed:0;
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	data := make([]byte, 28)
+	machine.PutUint16(data[0:], 7073)
+	machine.PutUint32(data[8:], 20)
+	binary.BigEndian.PutUint32(data[12:], 0x7f000001)
+	data[16] = 6
+	binary.BigEndian.PutUint16(data[17:], 443)
+	machine.PutUint32(data[20:], 4<<16|24)
+	binary.BigEndian.PutUint16(data[24:], 0x4500)
+	binary.BigEndian.PutUint16(data[26:], 0x0054)
+
+	opts := []Option{
+		FieldByteOrder("saddr", binary.BigEndian),
+		FieldByteOrder("dport", binary.BigEndian),
+		FieldByteOrder("words", binary.BigEndian),
+	}
+	check := func(v reflect.Value) {
+		t.Helper()
+		for name, want := range map[string]uint64{
+			"len": 20, "saddr": 0x7f000001, "proto": 6, "dport": 443,
+		} {
+			v, _ := fieldByCName(v, name)
+			if got := v.Uint(); got != want {
+				t.Errorf("unexpected value for %s: got:%#x want:%#x", name, got, want)
+			}
+		}
+		words, _ := fieldByCName(v, "words")
+		if got, want := words.Interface(), []uint16{0x4500, 0x0054}; !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected words: got:%#x want:%#x", got, want)
+		}
+	}
+
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data, opts...)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	check(dst)
+
+	u := NewUnpacker(opts...)
+	_, err = u.Register(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	_, v, err := u.Unpack(data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking with unpacker: %v", err)
+	}
+	check(v)
+
+	// Events of formats that need no unpacking are unpacked
+	// rather than aliased when a field byte order is given.
+	aligned := format[:strings.Index(format, "\tfield:u8 proto")]
+	u = NewUnpacker(opts...)
+	_, err = u.Register(strings.NewReader(aligned))
+	if err != nil {
+		t.Fatalf("unexpected error registering aligned format: %v", err)
+	}
+	_, v, err = u.Unpack(data[:16])
+	if err != nil {
+		t.Fatalf("unexpected error unpacking aligned event: %v", err)
+	}
+	if saddr, _ := fieldByCName(v, "saddr"); saddr.Uint() != 0x7f000001 {
+		t.Errorf("unexpected saddr for aligned event: got:%#x want:0x7f000001", saddr.Uint())
+	}
+}
+
+func TestPadFieldOffsets(t *testing.T) {
+	for _, opts := range [][]Option{
+		nil,
+		{WithPadName(func(i int) string { return fmt.Sprintf("pad%d", i) })},
+		{WithPadName(func(i int) string { return fmt.Sprintf("Pad%d", i) })},
+	} {
+		f, err := ParseFormat(strings.NewReader(unpackTests[1].format), opts...)
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		var pads int
+		for i := 0; i < f.Type.NumField(); i++ {
+			field := f.Type.Field(i)
+			if _, ok := field.Tag.Lookup("pad"); !ok {
+				continue
+			}
+			pads++
+			var start, end int
+			_, err := fmt.Sscanf(field.Tag.Get("bytes"), "[%d:%d]", &start, &end)
+			if err != nil {
+				t.Fatalf("unexpected bytes tag for padding field %d: %q", i, field.Tag.Get("bytes"))
+			}
+			if int(field.Offset) != start || int(field.Type.Size()) != end-start {
+				t.Errorf("unexpected padding field %d layout: offset=%d size=%d want [%d:%d]",
+					i, field.Offset, field.Type.Size(), start, end)
+			}
+			if !field.IsExported() && field.PkgPath != pkgPath {
+				t.Errorf("unexpected package path for padding field %d: got:%q want:%q", i, field.PkgPath, pkgPath)
+			}
+		}
+		if pads != 2 {
+			t.Errorf("unexpected number of padding fields: got:%d want:2", pads)
+		}
+		for _, field := range f.Fields {
+			if got := f.Type.FieldByIndex(field.Index).Offset; int(got) != field.Offset {
+				t.Errorf("unexpected offset for %s: got:%d want:%d", field.Name, got, field.Offset)
+			}
+		}
+	}
+}
+
+func TestWidenLongs(t *testing.T) {
+	// The formats hold the same event as captured on 32-bit
+	// and 64-bit kernels.
+	const (
+		format32 = `name: widen_long
+ID: 7080
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned long addr;	offset:4;	size:4;	signed:0;
+	field:long delta;	offset:8;	size:4;	signed:1;
+	field:size_t len;	offset:12;	size:4;	signed:0;
+	field:unsigned long mask;	offset:17;	size:4;	signed:0;
+	field:unsigned long long total;	offset:24;	size:8;	signed:0;
+`
+		format64 = `name: widen_long
+ID: 7080
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned long addr;	offset:8;	size:8;	signed:0;
+	field:long delta;	offset:16;	size:8;	signed:1;
+	field:size_t len;	offset:24;	size:8;	signed:0;
+	field:unsigned long mask;	offset:33;	size:8;	signed:0;
+	field:unsigned long long total;	offset:48;	size:8;	signed:0;
+`
+	)
+	data32 := make([]byte, 32)
+	machine.PutUint16(data32, 7080)
+	machine.PutUint32(data32[4:], 0xfffffff0)
+	machine.PutUint32(data32[8:], uint32(0xfffffffe)) // -2
+	machine.PutUint32(data32[12:], 64)
+	machine.PutUint32(data32[17:], 0x80000001)
+	machine.PutUint64(data32[24:], 1<<40)
+
+	data64 := make([]byte, 56)
+	machine.PutUint16(data64, 7080)
+	machine.PutUint64(data64[8:], 0xfffffff0)
+	machine.PutUint64(data64[16:], 0xfffffffffffffffe) // -2
+	machine.PutUint64(data64[24:], 64)
+	machine.PutUint64(data64[33:], 0x80000001)
+	machine.PutUint64(data64[48:], 1<<40)
+
+	want := map[string]interface{}{
+		"addr":  uint64(0xfffffff0),
+		"delta": int64(-2),
+		"len":   uint64(64),
+		"mask":  uint64(0x80000001),
+		"total": uint64(1 << 40),
+	}
+	var unpacked [][]reflect.Type
+	for _, test := range []struct {
+		name   string
+		format string
+		data   []byte
+	}{
+		{name: "32-bit", format: format32, data: data32},
+		{name: "64-bit", format: format64, data: data64},
+	} {
+		f, err := ParseFormat(strings.NewReader(test.format), WidenLongs())
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s format: %v", test.name, err)
+		}
+		if test.name == "32-bit" && !f.NeedsUnpack() {
+			t.Errorf("expected %s format to need unpacking", test.name)
+		}
+
+		u := NewUnpacker(WidenLongs())
+		_, err = u.Register(strings.NewReader(test.format))
+		if err != nil {
+			t.Fatalf("unexpected error registering %s format: %v", test.name, err)
+		}
+		_, v, err := u.Unpack(test.data)
+		if err != nil {
+			t.Fatalf("unexpected error unpacking %s event: %v", test.name, err)
+		}
+		if v.Elem().Type() != f.Unpacked {
+			t.Errorf("unexpected %s event type: got:%s want:%s", test.name, v.Elem().Type(), f.Unpacked)
+		}
+		for name, val := range want {
+			got, ok := fieldByCName(v, name)
+			if !ok {
+				t.Errorf("missing %s field %s", test.name, name)
+				continue
+			}
+			if got.Interface() != val {
+				t.Errorf("unexpected %s field %s: got:%#v want:%#v", test.name, name, got.Interface(), val)
+			}
+		}
+
+		buf := make([]byte, len(test.data))
+		n, err := Pack(buf, v, f)
+		if err != nil {
+			t.Fatalf("unexpected error packing %s event: %v", test.name, err)
+		}
+		if !bytes.Equal(buf[:n], test.data[:f.Size]) {
+			t.Errorf("unexpected %s packed event:\ngot: %x\nwant:%x", test.name, buf[:n], test.data[:f.Size])
+		}
+
+		var types []reflect.Type
+		for _, name := range []string{"addr", "delta", "len", "mask", "total"} {
+			fv, _ := fieldByCName(v, name)
+			types = append(types, fv.Type())
+		}
+		unpacked = append(unpacked, types)
+	}
+	if !reflect.DeepEqual(unpacked[0], unpacked[1]) {
+		t.Errorf("field types differ between architectures: %s != %s", unpacked[0], unpacked[1])
+	}
+
+	// Without widening the 32-bit format uses 32-bit fields.
+	f, err := ParseFormat(strings.NewReader(format32))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	addr, _ := f.FieldByName("addr")
+	if got := f.Unpacked.Field(addr.Index[0]).Type; got != reflect.TypeOf(uint32(0)) {
+		t.Errorf("unexpected unwidened type for addr: %s", got)
+	}
+
+	// Fields of types provided by a type map are not widened.
+	type size32 uint32
+	f, err = ParseFormat(strings.NewReader(format32), WidenLongs(), WithTypeMap(map[string]reflect.Type{
+		"size_t": reflect.TypeOf(size32(0)),
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format with type map: %v", err)
+	}
+	for name, want := range map[string]reflect.Type{
+		"addr": reflect.TypeOf(uint64(0)),
+		"len":  reflect.TypeOf(size32(0)),
+	} {
+		field, _ := f.FieldByName(name)
+		if got := f.Unpacked.Field(field.Index[0]).Type; got != want {
+			t.Errorf("unexpected type for %s with type map: got:%s want:%s", name, got, want)
+		}
+	}
+
+	// Widened fields are decoded and packed in the byte order
+	// of the record.
+	var order binary.ByteOrder = binary.BigEndian
+	if machine == binary.BigEndian {
+		order = binary.LittleEndian
+	}
+	data := make([]byte, 32)
+	order.PutUint16(data, 7080)
+	order.PutUint32(data[4:], 0xfffffff0)
+	order.PutUint32(data[8:], uint32(0xfffffffe)) // -2
+	order.PutUint32(data[12:], 64)
+	order.PutUint32(data[17:], 0x80000001)
+	order.PutUint64(data[24:], 1<<40)
+	f, err = ParseFormat(strings.NewReader(format32), WidenLongs(), ByteOrder(order))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking in %v: %v", order, err)
+	}
+	for name, val := range want {
+		got, _ := fieldByCName(dst, name)
+		if got.Interface() != val {
+			t.Errorf("unexpected field %s in %v: got:%#v want:%#v", name, order, got.Interface(), val)
+		}
+	}
+	buf := make([]byte, len(data))
+	n, err := Pack(buf, dst, f)
+	if err != nil {
+		t.Fatalf("unexpected error packing in %v: %v", order, err)
+	}
+	if !bytes.Equal(buf[:n], data[:f.Size]) {
+		t.Errorf("unexpected packed event in %v:\ngot: %x\nwant:%x", order, buf[:n], data[:f.Size])
+	}
+
+	// Widened values that do not fit the width of the record
+	// are an error for both aligned and unaligned fields.
+	for name, val := range map[string]interface{}{
+		"addr":  uint64(1 << 32),
+		"delta": int64(-1<<31 - 1),
+		"mask":  uint64(1 << 32),
+	} {
+		v := reflect.New(f.Unpacked)
+		v.Elem().Set(dst.Elem())
+		field, _ := fieldByCName(v, name)
+		field.Set(reflect.ValueOf(val))
+		_, err = Pack(buf, v, f)
+		if err == nil || !strings.Contains(err.Error(), "overflows") {
+			t.Errorf("expected overflow error for %s=%v: %v", name, val, err)
+		}
+	}
+	for name, val := range map[string]interface{}{
+		"delta": int64(-1 << 31),
+		"mask":  uint64(1<<32 - 1),
+	} {
+		v := reflect.New(f.Unpacked)
+		v.Elem().Set(dst.Elem())
+		field, _ := fieldByCName(v, name)
+		field.Set(reflect.ValueOf(val))
+		_, err = Pack(buf, v, f)
+		if err != nil {
+			t.Errorf("unexpected error packing %s=%v: %v", name, val, err)
+		}
+	}
+}
+
+func TestBoolNeedsUnpack(t *testing.T) {
+	// The format has no dynamic arrays or unaligned fields, so only
+	// the bool fields require unpacking.
+	const format = `name: bool_only
+ID: 7081
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:bool enabled;	offset:2;	size:1;	signed:0;
+	field:bool mask[2];	offset:3;	size:2;	signed:0;
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if !f.NeedsUnpack() {
+		t.Error("expected format with bool fields to need unpacking")
+	}
+
+	data := make([]byte, 5)
+	machine.PutUint16(data, 7081)
+	data[2] = 2
+	data[4] = 0x80
+	u := NewUnpacker()
+	_, err = u.Register(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	_, v, err := u.Unpack(data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	enabled, _ := fieldByCName(v, "enabled")
+	if b := enabled.Bool(); !b || !b == true {
+		t.Errorf("unexpected enabled value: %v", enabled.Interface())
+	}
+	// Reading the byte underlying the unpacked bool gives
+	// its canonical value.
+	if got := *(*byte)(unsafe.Pointer(enabled.UnsafeAddr())); got != 1 {
+		t.Errorf("unexpected byte for unpacked true value: got:%d want:1", got)
+	}
+	mask, _ := fieldByCName(v, "mask")
+	if got, want := mask.Interface(), [2]bool{false, true}; got != want {
+		t.Errorf("unexpected mask: got:%v want:%v", got, want)
+	}
+
+	type boolOnly struct {
+		Common_type uint16
+		Enabled     bool
+		Mask        [2]bool
+	}
+	dst, err := DecodeTo[boolOnly](data, f)
+	if err != nil {
+		t.Fatalf("unexpected error decoding: %v", err)
+	}
+	if b := dst.Enabled; !b || !b == true || *(*byte)(unsafe.Pointer(&dst.Enabled)) != 1 {
+		t.Errorf("unexpected decoded enabled value: %v", dst.Enabled)
+	}
+}
@@ -6,72 +6,12 @@ package kprobe_test
 
 import (
 	"fmt"
-	"io"
 	"log"
-	"reflect"
 	"strings"
-	"unsafe"
 
 	"github.com/kortschak/kprobe"
 )
 
-// Unpacker is a minimal kprobe event handler.
-type Unpacker map[uint16]func(data []byte) (string, reflect.Value, error)
-
-// Register registers a kprobe event format and returns the event's name.
-func (u Unpacker) Register(format io.Reader) (name string, err error) {
-	srcTyp, name, id, size, err := kprobe.Struct(format)
-	if err == nil {
-		// Fast path with layout consistent between kprobe
-		// event and Go struct.
-		u[id] = func(data []byte) (string, reflect.Value, error) {
-			if len(data) < size {
-				return "", reflect.Value{}, io.ErrUnexpectedEOF
-			}
-			return name, reflect.NewAt(srcTyp, unsafe.Pointer(&data[0])), nil
-		}
-		return name, nil
-	}
-
-	var unaligned kprobe.UnalignedFieldsError
-	if err != nil {
-		var ok bool
-		if unaligned, ok = err.(kprobe.UnalignedFieldsError); !ok {
-			return "", err
-		}
-	}
-	dstTyp, err := kprobe.UnpackedStructFor(srcTyp)
-	if err != nil {
-		return "", err
-	}
-	// Slow path with either unaligned fields or dynamic arrays.
-	u[id] = func(data []byte) (string, reflect.Value, error) {
-		if len(data) < size {
-			return "", reflect.Value{}, io.ErrUnexpectedEOF
-		}
-		src := reflect.NewAt(srcTyp, unsafe.Pointer(&data[0]))
-		dst := reflect.New(dstTyp)
-		err = kprobe.Unpack(dst, src, unaligned, data)
-		return name, dst, err
-	}
-	return name, nil
-}
-
-// Unpack parses the provided date and returns the name of the event and
-// a pointer to a struct holding the event details. Struct fields are not
-// valid after the next write to data.
-func (u Unpacker) Unpack(data []byte) (string, reflect.Value, error) {
-	if len(data) < 2 {
-		return "", reflect.Value{}, io.ErrUnexpectedEOF
-	}
-	typ := *(*uint16)(unsafe.Pointer(&data[0]))
-	f, ok := u[typ]
-	if !ok {
-		return "", reflect.Value{}, fmt.Errorf("no unpacker for event id=%d", typ)
-	}
-	return f(data)
-}
-
 var formats = []string{
 	`name: do_sys_open
 ID: 7090
@@ -124,7 +64,7 @@ print fmt: "(%lx) arg1=0x%Lx arg2={0x%x,0x%x,0x%x,0x%x,0x%x,0x%x,0x%x,0x%x}", RE
 
 func Example_unpacker() {
 	// Perform one-time format registration.
-	u := make(Unpacker)
+	u := kprobe.NewUnpacker()
 	for _, f := range formats {
 		n, err := u.Register(strings.NewReader(f))
 		if err != nil {
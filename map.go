@@ -0,0 +1,167 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// ToMap returns the fields of the event in v as a map keyed by the C names
+// of the fields. The value v must be a struct, or pointer to struct, of the
+// Format's Unpacked type, or of its Type if the format needs no unpacking.
+// Fixed and dynamic arrays of plain char are rendered as NUL-trimmed strings
+// unless the RawCharArrays option is used. Integer fields displayed in
+// hexadecimal or octal by the print fmt are rendered as strings if the
+// PrintRadix option is used. Other fields hold their values in v, and slice
+// values alias the slices in v. Padding is not included, nor are fields that
+// are not present in the struct type.
+func ToMap(f *Format, v reflect.Value, opts ...Option) (map[string]interface{}, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("invalid type: %s", v.Type())
+	}
+	m := make(map[string]interface{}, len(f.Fields))
+	for _, field := range f.Fields {
+		fv, ok := eventField(v, field)
+		if !ok {
+			continue
+		}
+		m[field.Name] = fieldValue(f, field, fv, cfg)
+	}
+	return m, nil
+}
+
+// MarshalEventJSON returns the event in v encoded as a JSON object with the
+// fields of the event, keyed by their C names, in field declaration order.
+// Field values are rendered as they are by ToMap and encoded as for
+// json.Marshal, so char arrays are encoded as JSON strings unless the
+// RawCharArrays option is used.
+func MarshalEventJSON(f *Format, v reflect.Value, opts ...Option) ([]byte, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("invalid type: %s", v.Type())
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, field := range f.Fields {
+		fv, ok := eventField(v, field)
+		if !ok {
+			continue
+		}
+		if buf.Len() != 1 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(field.Name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		val, err := json.Marshal(fieldValue(f, field, fv, cfg))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// JSONStream writes decoded events to an io.Writer as newline-delimited
+// JSON. Each event is written as a single line holding a JSON object with
+// the name of the event and an object of its fields rendered as by
+// MarshalEventJSON:
+//
+//	{"name":"gvt_command","fields":{"common_type":2034,...}}
+//
+// A JSONStream is not safe for concurrent use.
+type JSONStream struct {
+	w       io.Writer
+	formats map[string]*Format
+	opts    []Option
+	buf     bytes.Buffer
+}
+
+// NewJSONStream returns a new JSONStream writing to w. The formats of the
+// events to be written are looked up by event name in formats, which is
+// used directly and must not be modified while the stream is in use. The
+// provided options are used to render event fields.
+func NewJSONStream(w io.Writer, formats map[string]*Format, opts ...Option) *JSONStream {
+	return &JSONStream{w: w, formats: formats, opts: opts}
+}
+
+// Encode writes the event with the given name and value, such as returned
+// by an Unpacker's Unpack method, to the stream. The value must be a struct,
+// or pointer to struct, of the Type or Unpacked type of the event's format.
+// Each event is written with a single call to the underlying writer.
+func (s *JSONStream) Encode(name string, v reflect.Value) error {
+	if !reflect.Indirect(v).IsValid() {
+		return fmt.Errorf("invalid value for %s", name)
+	}
+	f, ok := s.formats[name]
+	if !ok {
+		return fmt.Errorf("no format for %s", name)
+	}
+	typ := reflect.Indirect(v).Type()
+	if typ != f.Type && typ != f.Unpacked {
+		return fmt.Errorf("mismatched type for %s: %s is not %s or %s", name, typ, f.Type, f.Unpacked)
+	}
+	fields, err := MarshalEventJSON(f, v, s.opts...)
+	if err != nil {
+		return err
+	}
+	jsonName, err := json.Marshal(name)
+	if err != nil {
+		return err
+	}
+	s.buf.Reset()
+	s.buf.WriteString(`{"name":`)
+	s.buf.Write(jsonName)
+	s.buf.WriteString(`,"fields":`)
+	s.buf.Write(fields)
+	s.buf.WriteString("}\n")
+	_, err = s.w.Write(s.buf.Bytes())
+	return err
+}
+
+// eventField returns the value of field in the event struct v. It returns
+// false if the field is not present in the struct type.
+func eventField(v reflect.Value, field Field) (reflect.Value, bool) {
+	if len(field.Index) == 0 || field.Index[0] >= v.NumField() {
+		return reflect.Value{}, false
+	}
+	return v.FieldByIndex(field.Index), true
+}
+
+// fieldValue returns the rendered value of the event field fv described by
+// field of f.
+func fieldValue(f *Format, field Field, fv reflect.Value, cfg *config) interface{} {
+	if isCharArray(field.CType) && !cfg.rawChars {
+		if s, ok := cString(fv); ok {
+			return s
+		}
+	}
+	if spec, ok := f.radix[field.Name]; ok && cfg.printRadix {
+		if _, ok := integerBits(fv); ok {
+			s, err := spec.format(fv)
+			if err == nil {
+				return s
+			}
+		}
+	}
+	return fv.Interface()
+}
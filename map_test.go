@@ -0,0 +1,195 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestToMap(t *testing.T) {
+	test := sprintTests[3] // gvt_command
+	f, err := ParseFormat(strings.NewReader(test.format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, test.data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking data: %v", err)
+	}
+
+	m, err := ToMap(f, dst)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := m["cmd_name"], "MI_NOOP"; got != want {
+		t.Errorf("unexpected cmd_name: got:%#v want:%#v", got, want)
+	}
+	if got, want := m["cmd_len"], uint32(2); got != want {
+		t.Errorf("unexpected cmd_len: got:%#v want:%#v", got, want)
+	}
+	if got, want := m["raw_cmd"], []uint32{0x12345678, 0x9abcdef}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected raw_cmd: got:%#v want:%#v", got, want)
+	}
+	if len(m) != len(f.Fields) {
+		t.Errorf("unexpected number of fields: got:%d want:%d", len(m), len(f.Fields))
+	}
+
+	m, err = ToMap(f, dst, RawCharArrays())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	raw, ok := m["cmd_name"].([40]int8)
+	if !ok {
+		t.Fatalf("unexpected raw cmd_name type: %T", m["cmd_name"])
+	}
+	if got, want := string(int8sToBytes(raw[:8])), "MI_NOOP\x00"; got != want {
+		t.Errorf("unexpected raw cmd_name prefix: got:%q want:%q", got, want)
+	}
+
+	_, err = ToMap(f, reflect.ValueOf(1))
+	if err == nil {
+		t.Error("expected error for non-struct value")
+	}
+}
+
+func TestPrintRadix(t *testing.T) {
+	f, err := ParseFormat(strings.NewReader(unpackTests[0].format + "\nprint fmt: " + openFlagsPrintFmt + "\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, unpackTests[0].data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking data: %v", err)
+	}
+
+	m, err := ToMap(f, dst)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := m["mode"], uint32(0644); got != want {
+		t.Errorf("unexpected default mode: got:%#v want:%#v", got, want)
+	}
+
+	m, err = ToMap(f, dst, PrintRadix())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := m["mode"], "644"; got != want {
+		t.Errorf("unexpected octal mode: got:%#v want:%#v", got, want)
+	}
+	// flags is printed by __print_flags, not by a radix conversion.
+	if _, ok := m["flags"].(string); ok {
+		t.Errorf("unexpected string flags: %#v", m["flags"])
+	}
+
+	b, err := MarshalEventJSON(f, dst, PrintRadix())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(b), `"mode":"644"`) {
+		t.Errorf("unexpected JSON mode rendering: %s", b)
+	}
+}
+
+func TestMarshalEventJSON(t *testing.T) {
+	test := sprintTests[3] // gvt_command
+	f, err := ParseFormat(strings.NewReader(test.format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, test.data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking data: %v", err)
+	}
+
+	got, err := MarshalEventJSON(f, dst)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `{"common_type":0,"common_flags":0,"common_preempt_count":0,"common_pid":0,` +
+		`"vgpu_id":1,"ring_id":2,"ip_gma":48879,"buf_type":0,"buf_addr_type":0,"cmd_len":2,` +
+		`"workload":12648430,"raw_cmd":[305419896,162254319],"cmd_name":"MI_NOOP"}`
+	if string(got) != want {
+		t.Errorf("unexpected JSON:\ngot: %s\nwant:%s", got, want)
+	}
+
+	got, err = MarshalEventJSON(f, dst, RawCharArrays())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(got), `"cmd_name":[77,73,95,78,79,79,80,0,`) {
+		t.Errorf("unexpected raw cmd_name in JSON: %s", got)
+	}
+}
+
+func int8sToBytes(s []int8) []byte {
+	b := make([]byte, len(s))
+	for i, c := range s {
+		b[i] = byte(c)
+	}
+	return b
+}
+
+func TestJSONStream(t *testing.T) {
+	u := NewUnpacker()
+	formats := make(map[string]*Format)
+	for _, format := range []string{unpackTests[0].format, sprintTests[3].format} {
+		_, err := u.Register(strings.NewReader(format))
+		if err != nil {
+			t.Fatalf("unexpected error registering format: %v", err)
+		}
+		f, err := ParseFormat(strings.NewReader(format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		formats[f.Name] = f
+	}
+
+	var buf bytes.Buffer
+	s := NewJSONStream(&buf, formats)
+	for _, test := range []struct {
+		data []byte
+		id   uint16
+	}{
+		{data: unpackTests[0].data, id: 7021},
+		{data: sprintTests[3].data, id: 2034},
+	} {
+		// The test data do not hold the IDs of their formats.
+		data := append([]byte(nil), test.data...)
+		machine.PutUint16(data, test.id)
+		name, v, err := u.Unpack(data)
+		if err != nil {
+			t.Fatalf("unexpected error unpacking: %v", err)
+		}
+		err = s.Encode(name, v)
+		if err != nil {
+			t.Fatalf("unexpected error encoding %s: %v", name, err)
+		}
+	}
+
+	want := `{"name":"do_sys_open_test","fields":{"common_type":7021,"common_flags":0,"common_preempt_count":0,"common_pid":32705,` +
+		`"__probe_ip":18446744072341004784,"dfd":2926421296,"filename":"file.text","flags":557633,"mode":420}}` + "\n" +
+		`{"name":"gvt_command","fields":{"common_type":2034,"common_flags":0,"common_preempt_count":0,"common_pid":0,` +
+		`"vgpu_id":1,"ring_id":2,"ip_gma":48879,"buf_type":0,"buf_addr_type":0,"cmd_len":2,` +
+		`"workload":12648430,"raw_cmd":[305419896,162254319],"cmd_name":"MI_NOOP"}}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected stream:\ngot: %s\nwant:%s", got, want)
+	}
+
+	err := s.Encode("missing", reflect.ValueOf(struct{}{}))
+	if err == nil {
+		t.Error("expected error for unknown event")
+	}
+	err = s.Encode("gvt_command", reflect.ValueOf(struct{}{}))
+	if err == nil {
+		t.Error("expected error for mismatched type")
+	}
+}
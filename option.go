@@ -0,0 +1,449 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+)
+
+// Option is an option for kprobe format parsing.
+type Option func(*config)
+
+// config holds the behaviour selected by a set of options.
+type config struct {
+	strict bool
+	types  map[string]reflect.Type
+	order  binary.ByteOrder
+	copy   bool
+
+	charBytes    bool
+	embedCommon  bool
+	allowOverlap bool
+	strictBounds bool
+	allowShort   bool
+	rawChars     bool
+	printRadix   bool
+	widenLongs   bool
+
+	// maxLine is the maximum length of a line of a
+	// format. Zero indicates the default of maxLineLen.
+	maxLine int
+
+	// maxDynamic is the maximum length in bytes of
+	// a dynamic array. Zero indicates the default of
+	// maxDynamicLen.
+	maxDynamic int
+
+	// internSize is the capacity of the Unpacker
+	// string intern table. Zero disables interning.
+	internSize int
+
+	// recordSize is the total size of the fixed
+	// portion of a record. Zero indicates that the
+	// record ends with its final field.
+	recordSize int
+
+	padName func(int) string
+
+	// logf is the function called with parse
+	// diagnostics. It is nil if not set.
+	logf func(format string, args ...interface{})
+
+	// fieldOrders maps the C names of fields to
+	// the byte order used to decode them.
+	fieldOrders map[string]binary.ByteOrder
+
+	// selected is the set of C names of fields to
+	// include in struct types. All fields are included
+	// if it is nil.
+	selected map[string]bool
+
+	// lengths maps the C names of dynamic arrays
+	// to the C names of their length fields.
+	lengths map[string]string
+
+	err error
+}
+
+// newConfig returns the configuration resulting from applying opts.
+func newConfig(opts []Option) (*config, error) {
+	var cfg config
+	for _, o := range opts {
+		o(&cfg)
+	}
+	return &cfg, cfg.err
+}
+
+// log calls the configured logging function with the provided format and
+// arguments. It does nothing if no logging function is configured.
+func (cfg *config) log(format string, args ...interface{}) {
+	if cfg.logf != nil {
+		cfg.logf(format, args...)
+	}
+}
+
+// fieldOrder returns the byte order used to decode the field with the given
+// C name, defaulting to def.
+func (cfg *config) fieldOrder(name string, def binary.ByteOrder) binary.ByteOrder {
+	if order, ok := cfg.fieldOrders[name]; ok {
+		return order
+	}
+	return def
+}
+
+// maxLineLen is the default maximum length of a line of a format.
+const maxLineLen = 1 << 20
+
+// maxLineLen returns the configured maximum length of a line of a format.
+func (cfg *config) maxLineLen() int {
+	if cfg.maxLine <= 0 {
+		return maxLineLen
+	}
+	return cfg.maxLine
+}
+
+// maxDynamicLen is the default maximum length in bytes of dynamic array
+// data. It is the largest length that can be held in the 16 bit length of
+// a dynamic array locator, rounded up to 64KiB.
+const maxDynamicLen = 1 << 16
+
+// maxDynamicLen returns the configured maximum length in bytes of dynamic
+// array data.
+func (cfg *config) maxDynamicLen() int {
+	if cfg.maxDynamic <= 0 {
+		return maxDynamicLen
+	}
+	return cfg.maxDynamic
+}
+
+// byteOrder returns the configured byte order, defaulting to the host
+// byte order.
+func (cfg *config) byteOrder() binary.ByteOrder {
+	if cfg.order == nil {
+		return machine
+	}
+	return cfg.order
+}
+
+// widen returns whether fields of the C type ctyp are widened by the
+// WidenLongs option. Fields of types provided by a type map are not
+// widened.
+func (cfg *config) widen(ctyp string) bool {
+	if !cfg.widenLongs || !isLongType(ctyp) {
+		return false
+	}
+	_, mapped := cfg.types[baseType(ctyp)]
+	return !mapped
+}
+
+// Strict returns an option that causes parsing to fail when a field's C type
+// is not a known kernel type, or when the declared size of a field is not
+// consistent with its fixed-width C type. Pointer types and types with an
+// architecture-dependent width are only checked for being known. Without
+// Strict, unknown types are represented according to their declared size
+// and signedness.
+func Strict() Option {
+	return func(cfg *config) {
+		cfg.strict = true
+	}
+}
+
+// WithTypeMap returns an option that maps C types to Go types. The C types
+// in m are consulted before the builtin integer types and match the C type
+// of a field without any array suffix, so a mapped type is also used for
+// the elements of fixed-size arrays. The size of each mapped type must be
+// consistent with the declared size of the fields using it, and mapped
+// types must not contain pointers. Mapped types are not used for dynamic
+// array elements. Misaligned fields of a mapped type are reconstructed by
+// Unpack in host byte order.
+func WithTypeMap(m map[string]reflect.Type) Option {
+	return func(cfg *config) {
+		if cfg.types == nil {
+			cfg.types = make(map[string]reflect.Type)
+		}
+		for ctyp, typ := range m {
+			if hasPointers(typ) {
+				cfg.err = fmt.Errorf("invalid mapped type for %s: %s contains pointers", ctyp, typ)
+				continue
+			}
+			cfg.types[ctyp] = typ
+		}
+	}
+}
+
+// hasPointers returns whether values of typ hold pointers.
+func hasPointers(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Array:
+		return hasPointers(typ.Elem())
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if hasPointers(typ.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	case reflect.Ptr, reflect.UnsafePointer, reflect.Slice, reflect.String,
+		reflect.Map, reflect.Chan, reflect.Func, reflect.Interface:
+		return true
+	default:
+		return false
+	}
+}
+
+// WithLogf returns an option that causes parsing to call logf with a message
+// for each notable field that is found in a format: fields that are
+// unaligned and represented as byte arrays, dynamic arrays, fields that
+// overlap a preceding field when AllowOverlap is used, and fields with an
+// unknown C type or a size inconsistent with their C type when Strict is not
+// used. Messages describe why unpacking of a format's events may take the
+// slow path, and are emitted in addition to any UnalignedFieldsError or
+// Warnings reported by the parse. The arguments to logf are the same as for
+// fmt.Printf, and it is called synchronously during parsing.
+func WithLogf(logf func(format string, args ...interface{})) Option {
+	return func(cfg *config) {
+		cfg.logf = logf
+	}
+}
+
+// ByteOrder returns an option that sets the byte order used to decode
+// event data. The default is the host byte order.
+func ByteOrder(order binary.ByteOrder) Option {
+	return func(cfg *config) {
+		cfg.order = order
+	}
+}
+
+// FieldByteOrder returns an option that causes Unpack to decode the field
+// with the C name, field, in the given byte order irrespective of the byte
+// order of the rest of the record. This allows decoding of records holding
+// data copied verbatim from another source, such as network headers holding
+// fields in big-endian byte order. The option applies to integer fields,
+// arrays of integers and the elements of dynamic arrays, but not to the
+// locators of dynamic arrays or to fields of types provided by a type map.
+// An Unpacker using the option always unpacks events into a new value.
+func FieldByteOrder(field string, order binary.ByteOrder) Option {
+	return func(cfg *config) {
+		if cfg.fieldOrders == nil {
+			cfg.fieldOrders = make(map[string]binary.ByteOrder)
+		}
+		cfg.fieldOrders[field] = order
+	}
+}
+
+// WithLengthField returns an option that causes Unpack to take the number of
+// elements of the named dynamic array from the integer field with the C name
+// length, rather than from the length packed into the dynamic array's
+// locator. This allows decoding of events such as ath10k_htt_stats where an
+// explicit length field, buf_len, holds the true length of the dynamic
+// array, buf. The length field is read as it would be unpacked, and the
+// length is also used for the bytes passed to conversions bound to the array
+// by a Decoder. It is an error for the length to extend the array beyond the
+// end of the event data.
+func WithLengthField(array, length string) Option {
+	return func(cfg *config) {
+		if cfg.lengths == nil {
+			cfg.lengths = make(map[string]string)
+		}
+		cfg.lengths[array] = length
+	}
+}
+
+// SelectFields returns an option that includes only the fields with the
+// given C names in the struct types of a format, replacing the other fields
+// with padding of the same size, so that only the selected fields are
+// decoded. The struct types are padded to the size of the fixed portion of
+// the record. Fields that are not selected are retained in the Format's
+// Fields with a nil Index. Names that do not match a field are ignored. If
+// EmbedCommonFields is also used, all the common fields are included when
+// they are embedded.
+func SelectFields(names ...string) Option {
+	return func(cfg *config) {
+		cfg.selected = make(map[string]bool, len(names))
+		for _, name := range names {
+			cfg.selected[name] = true
+		}
+	}
+}
+
+// CharArraysAsBytes returns an option that represents fixed-size arrays of
+// plain C char as arrays of byte, consistent with the representation of
+// dynamic char arrays, rather than according to the signedness reported
+// by the format. Signed char and unsigned char arrays are not affected.
+func CharArraysAsBytes() Option {
+	return func(cfg *config) {
+		cfg.charBytes = true
+	}
+}
+
+// RawCharArrays returns an option that causes ToMap and MarshalEventJSON
+// to render fixed and dynamic arrays of plain char as their unpacked array
+// or slice values rather than as NUL-trimmed strings, for consumers that
+// need the bytes of the arrays.
+func RawCharArrays() Option {
+	return func(cfg *config) {
+		cfg.rawChars = true
+	}
+}
+
+// PrintRadix returns an option that causes ToMap and MarshalEventJSON to
+// render integer fields that the print fmt displays with a %x, %X or %o
+// conversion, such as bitmask and mode fields, as strings formatted by that
+// conversion rather than as numbers. So a mode field printed by mode=%o is
+// rendered as "644" rather than 420. Fields referred to by the print fmt
+// only within larger expressions are not affected.
+func PrintRadix() Option {
+	return func(cfg *config) {
+		cfg.printRadix = true
+	}
+}
+
+// EmbedCommonFields returns an option that represents the standard common
+// header fields of an event, common_type, common_flags, common_preempt_count
+// and common_pid, as an embedded CommonFields struct rather than as four
+// separate fields. Formats that do not start with the standard header at
+// its classic offsets are not affected; their header fields may be read
+// with Format.Common.
+func EmbedCommonFields() Option {
+	return func(cfg *config) {
+		cfg.embedCommon = true
+	}
+}
+
+// AllowOverlap returns an option that allows fields of a format to overlap
+// preceding fields, as they do for union members, rather than failing with
+// an OffsetError. The Go struct types of a Format cannot represent unions,
+// so an overlapping field is omitted from both the packed Type and the
+// Unpacked type, and is not decoded by Unpack. Overlapping fields are
+// retained in the Format's Fields with a nil Index and with the Go type of
+// their value in Type, and are reported by an OverlappingField warning.
+// Their values must be decoded manually from the event record using their
+// Offset and Size, or with a conversion bound by a Decoder.
+//
+// Since the fast path of an Unpacker aliases the event data as a value of
+// the packed Type, which cannot represent the union, formats with
+// overlapping fields report true from NeedsUnpack and their events are
+// always unpacked into a new value by the slow path.
+func AllowOverlap() Option {
+	return func(cfg *config) {
+		cfg.allowOverlap = true
+	}
+}
+
+// WithPadName returns an option that names the padding fields of generated
+// struct types with the names returned by fn, which is called with the index
+// of each padding field in order from zero. By default padding fields are
+// named with the blank identifier. Names must be valid identifiers that do
+// not collide with the names of other fields, and unexported names are
+// given the package path of the struct. Padding fields are identified by
+// their pad struct field tag irrespective of their name, and are not
+// filled by Unpack.
+func WithPadName(fn func(i int) string) Option {
+	return func(cfg *config) {
+		cfg.padName = fn
+	}
+}
+
+// AllowShort returns an option that allows Format.Unpack and Unpacker to
+// decode event records that are shorter than the fixed portion of the
+// record, for example because a perf sample was truncated. Only fields that
+// are fully contained in the data are decoded and other fields are left
+// zero. Dynamic arrays are decoded only if their data is also contained in
+// the data. Decoding a short record returns a *TruncatedError describing the
+// fields that were not decoded, along with the partially decoded value.
+// Without AllowShort, short records are an error wrapping
+// io.ErrUnexpectedEOF.
+func AllowShort() Option {
+	return func(cfg *config) {
+		cfg.allowShort = true
+	}
+}
+
+// WidenLongs returns an option that represents scalar long and unsigned
+// long fields, including size_t and ssize_t fields, as int64 and uint64
+// fields in the Unpacked struct type regardless of their size in the
+// format. These types are 4 bytes on 32-bit kernels and 8 bytes on 64-bit
+// kernels, so without WidenLongs the unpacked types of events captured
+// from different architectures differ. Unsigned values are zero-extended
+// and signed values are sign-extended. Formats with 4-byte long fields
+// always need unpacking when WidenLongs is used. Fields with types provided
+// by a type map are not widened.
+func WidenLongs() Option {
+	return func(cfg *config) {
+		cfg.widenLongs = true
+	}
+}
+
+// InternStrings returns an option that causes an Unpacker to intern the
+// decoded values of dynamic char array fields, such as file names and
+// command names, in a table holding up to n distinct values, evicting the
+// least recently used value when full. Events carrying an interned value
+// share a single copy of it rather than each holding their own, reducing
+// allocation and memory use for events that are retained. Interned values
+// are copies and do not alias the event data.
+//
+// Interned values are read-only. The same backing array is shared by every
+// event carrying the value, so writing to the bytes of an interned field
+// changes that field in all of those events. Callers that need to modify
+// the value must copy it first. Appending to an interned value always
+// allocates, and an interned value that has been modified is not handed
+// to later events.
+//
+// The option is ignored if n is not positive, and has no effect on
+// functions other than Unpacker.Unpack.
+func InternStrings(n int) Option {
+	return func(cfg *config) {
+		cfg.internSize = n
+	}
+}
+
+// RecordSize returns an option that sets the size of the fixed portion of
+// an event record to n bytes, for events whose kernel-side records are
+// padded beyond the end of their final field. The generated struct types
+// are padded after the final field to n bytes. It is an error for n to be
+// before the end of the final field. The option is ignored if n is not
+// positive.
+func RecordSize(n int) Option {
+	return func(cfg *config) {
+		if n > 0 {
+			cfg.recordSize = n
+		}
+	}
+}
+
+// MaxLineLen returns an option that sets the maximum length in bytes of a
+// line of a format to n. Parsing a format with a longer line, such as a
+// very long print fmt line, fails with an error wrapping bufio.ErrTooLong.
+// The default limit, used when n is not positive, is 1MiB.
+func MaxLineLen(n int) Option {
+	return func(cfg *config) {
+		cfg.maxLine = n
+	}
+}
+
+// MaxDynamicLen returns an option that limits the length of the data of a
+// dynamic array that Unpack will decode to n bytes. Unpacking an event with
+// a dynamic array longer than n bytes fails, so a malformed record cannot
+// cause a large slice to be constructed, for example from a corrupt length
+// field used with WithLengthField. The default limit, used when n is not
+// positive, is 64KiB, the kernel's limit for dynamic array data.
+func MaxDynamicLen(n int) Option {
+	return func(cfg *config) {
+		cfg.maxDynamic = n
+	}
+}
+
+// StrictBounds returns an option that causes unpacking to fail when the data
+// location of a non-empty dynamic array refers to data within the fixed
+// portion of the event record, which indicates a corrupt data location.
+// Data locations that refer beyond the end of the event data are always
+// an error.
+func StrictBounds() Option {
+	return func(cfg *config) {
+		cfg.strictBounds = true
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+// Pack writes the event record corresponding to v into dst in the layout
+// described by f and returns the number of bytes written. It is the inverse
+// of Format.Unpack. The value v must be a struct, or a pointer to a struct,
+// of f's Type or Unpacked type.
+//
+// If v is of f's Type, the fixed portion of the record is copied from v
+// unaltered, including any dynamic array locators, unless f's Type is also
+// its Unpacked type and f's byte order is not the host byte order. In that
+// case v holds host order values and is packed as an Unpacked value. If v
+// is of f's Unpacked type, the data of non-empty dynamic arrays is appended after the fixed
+// portion of the record in field order and the dynamic array locators are
+// set to refer to it. Padding is written as zero bytes.
+//
+// Integer fields and arrays, multi-byte elements of dynamic arrays, the
+// dynamic array locators and unaligned fields are written in f's byte
+// order, matching Unpack. Fields of non-integer types provided by a type
+// map are written in host byte order.
+//
+// If dst is too short to hold the record, Pack returns io.ErrShortBuffer.
+func Pack(dst []byte, v reflect.Value, f *Format) (int, error) {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return 0, fmt.Errorf("invalid type: %s", v.Type())
+	}
+	order := f.byteOrder()
+	switch typ := v.Type(); {
+	case typ == f.Unpacked && order != machine:
+		// Values of the Unpacked type are held in host byte
+		// order, so they must be swapped even when the Unpacked
+		// type is identical to the packed type.
+	case typ == f.Type:
+		if len(dst) < f.Size {
+			return 0, io.ErrShortBuffer
+		}
+		p := reflect.New(f.Type)
+		p.Elem().Set(v)
+		return copy(dst, unsafe.Slice((*byte)(unsafe.Pointer(p.Pointer())), f.Size)), nil
+	case typ == f.Unpacked:
+	default:
+		return 0, fmt.Errorf("mismatched type: %s is not %s or %s", typ, f.Type, f.Unpacked)
+	}
+
+	p := reflect.New(f.Type).Elem()
+	typ := f.Type
+	n := f.Size
+	var dynamic [][]byte
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if _, ok := field.Tag.Lookup("pad"); ok {
+			continue
+		}
+		src := v.Field(i)
+		ctyp := field.Tag.Get("ctyp")
+		if _, ok := dynamicElement(ctyp); ok {
+			if field.Type.Kind() != reflect.Uint32 {
+				return 0, fmt.Errorf("invalid type for dynamic array: %s", field.Type)
+			}
+			if src.Len() == 0 {
+				continue
+			}
+			b := dynamicArrayBytes(src, order)
+			off := n
+			if strings.HasPrefix(ctyp, "__rel_loc") {
+				off -= int(field.Offset) + 4
+			}
+			if off > 0xffff || len(b) > 0xffff {
+				return 0, fmt.Errorf("dynamic data too large for field %s: offset=%d len=%d", field.Tag.Get("name"), off, len(b))
+			}
+			loc := uint32(len(b))<<16 | uint32(off)
+			if order != machine {
+				loc = bits.ReverseBytes32(loc)
+			}
+			p.Field(i).SetUint(uint64(loc))
+			dynamic = append(dynamic, b)
+			n += len(b)
+			continue
+		}
+		if _, ok := field.Tag.Lookup("unaligned"); ok {
+			err := packUnaligned(p.Field(i), src, order)
+			if err != nil {
+				return 0, fmt.Errorf("field %s: %w", field.Tag.Get("name"), err)
+			}
+			continue
+		}
+		if isWidened(field.Type, src.Type()) {
+			v := reflect.New(field.Type).Elem()
+			if isSigned(field.Type) {
+				if v.OverflowInt(src.Int()) {
+					return 0, fmt.Errorf("value of field %s overflows %s: %d", field.Tag.Get("name"), field.Type, src.Int())
+				}
+			} else if v.OverflowUint(src.Uint()) {
+				return 0, fmt.Errorf("value of field %s overflows %s: %d", field.Tag.Get("name"), field.Type, src.Uint())
+			}
+			p.Field(i).Set(src.Convert(field.Type))
+			if order != machine {
+				swapBytes(p.Field(i))
+			}
+			continue
+		}
+		if !src.Type().AssignableTo(field.Type) {
+			return 0, fmt.Errorf("mismatched type for field %d: %s != %s", i, field.Type, src.Type())
+		}
+		p.Field(i).Set(src)
+		if order != machine {
+			swapBytes(p.Field(i))
+		}
+	}
+	if len(dst) < n {
+		return 0, io.ErrShortBuffer
+	}
+	off := copy(dst, unsafe.Slice((*byte)(unsafe.Pointer(p.UnsafeAddr())), f.Size))
+	for _, b := range dynamic {
+		off += copy(dst[off:], b)
+	}
+	return n, nil
+}
+
+// packUnaligned writes the value of the unpacked field src into the byte
+// array dst of the packed struct in the given byte order. It is an error
+// for the value of a widened integer field to overflow the width of dst.
+func packUnaligned(dst, src reflect.Value, order binary.ByteOrder) error {
+	if dst.Kind() != reflect.Array || dst.Type().Elem().Kind() != reflect.Uint8 {
+		return fmt.Errorf("invalid kind for unaligned field: %v", dst.Kind())
+	}
+	b := unsafe.Slice((*byte)(unsafe.Pointer(dst.UnsafeAddr())), dst.Len())
+	switch src.Kind() {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if len(b) < 8 && src.Uint()>>(8*len(b)) != 0 {
+			return fmt.Errorf("value overflows %d byte field: %d", len(b), src.Uint())
+		}
+		encodeUint(b, len(b), order, src.Uint())
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if shift := 64 - 8*len(b); shift > 0 && src.Int()<<shift>>shift != src.Int() {
+			return fmt.Errorf("value overflows %d byte field: %d", len(b), src.Int())
+		}
+		encodeUint(b, len(b), order, uint64(src.Int()))
+	case reflect.Bool:
+		b[0] = byte(b2i(src.Bool()))
+	case reflect.Array:
+		if int(src.Type().Size()) != len(b) {
+			return fmt.Errorf("mismatched size: %d != %d", src.Type().Size(), len(b))
+		}
+		if isBool(src.Type()) {
+			for j := 0; j < src.Len(); j++ {
+				b[j] = byte(b2i(src.Index(j).Bool()))
+			}
+			break
+		}
+		if !isInteger(src.Type().Elem()) {
+			copyHost(b, src)
+			break
+		}
+		size := int(src.Type().Elem().Size())
+		for j := 0; j < src.Len(); j++ {
+			switch elem := src.Index(j); elem.Kind() {
+			case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				encodeUint(b[j*size:], size, order, uint64(elem.Int()))
+			default:
+				encodeUint(b[j*size:], size, order, elem.Uint())
+			}
+		}
+	default:
+		// Types provided by a type map are copied in host
+		// byte order.
+		if int(src.Type().Size()) != len(b) {
+			return fmt.Errorf("mismatched size: %d != %d", src.Type().Size(), len(b))
+		}
+		copyHost(b, src)
+	}
+	return nil
+}
+
+// copyHost copies the in-memory representation of v into b.
+func copyHost(b []byte, v reflect.Value) {
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	copy(b, unsafe.Slice((*byte)(unsafe.Pointer(p.Pointer())), v.Type().Size()))
+}
+
+// dynamicArrayBytes returns the event data representation of the dynamic
+// array slice s in the given byte order. It is the inverse of
+// dynamicArrayValue.
+func dynamicArrayBytes(s reflect.Value, order binary.ByteOrder) []byte {
+	size := int(s.Type().Elem().Size())
+	b := make([]byte, s.Len()*size)
+	if size == 1 || size == 16 || order == machine {
+		copy(b, unsafe.Slice((*byte)(unsafe.Pointer(s.Pointer())), len(b)))
+		return b
+	}
+	for j := 0; j < s.Len(); j++ {
+		switch elem := s.Index(j); elem.Kind() {
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			encodeUint(b[j*size:], size, order, uint64(elem.Int()))
+		default:
+			encodeUint(b[j*size:], size, order, elem.Uint())
+		}
+	}
+	return b
+}
+
+// encodeUint writes the low size bytes of v to the start of b. It is the
+// inverse of decodeUint.
+func encodeUint(b []byte, size int, order binary.ByteOrder, v uint64) {
+	switch size {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		order.PutUint16(b, uint16(v))
+	case 4:
+		order.PutUint32(b, uint32(v))
+	default:
+		order.PutUint64(b, v)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestPack(t *testing.T) {
+	for _, test := range unpackTests {
+		host, err := ParseFormat(strings.NewReader(test.format))
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", test.name, err)
+			continue
+		}
+		dst := reflect.New(host.Unpacked)
+		err = host.Unpack(dst, test.data)
+		if err != nil {
+			t.Errorf("unexpected error unpacking %q: %v", test.name, err)
+			continue
+		}
+
+		for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+			f, err := ParseFormat(strings.NewReader(test.format), ByteOrder(order))
+			if err != nil {
+				t.Errorf("unexpected error parsing %q: %v", test.name, err)
+				continue
+			}
+
+			buf := make([]byte, len(test.data)+64)
+			n, err := Pack(buf, dst, f)
+			if err != nil {
+				t.Errorf("unexpected error packing %q %v: %v", test.name, order, err)
+				continue
+			}
+			n2, err := f.RecordLen(buf[:n])
+			if err != nil || n2 != n {
+				t.Errorf("unexpected record length for %q %v: got:%d want:%d err:%v", test.name, order, n2, n, err)
+			}
+
+			// The fixed fields, other than dynamic array
+			// locators, are written as they were read.
+			for _, e := range f.Layout() {
+				if e.Name == "" || order != machine {
+					continue
+				}
+				field, _ := f.FieldByName(e.Name)
+				if _, ok := dynamicElement(field.CType); ok {
+					continue
+				}
+				if !bytes.Equal(buf[e.Start:e.End], test.data[e.Start:e.End]) {
+					t.Errorf("unexpected bytes for %s of %q %v: got:%v want:%v", e.Name, test.name, order, buf[e.Start:e.End], test.data[e.Start:e.End])
+				}
+			}
+
+			got := reflect.New(f.Unpacked)
+			err = f.Unpack(got, buf[:n])
+			if err != nil {
+				t.Errorf("unexpected error unpacking packed %q %v: %v", test.name, order, err)
+				continue
+			}
+			if !reflect.DeepEqual(got.Elem().Interface(), dst.Elem().Interface()) {
+				t.Errorf("unexpected round trip result for %q %v:\ngot: %#v\nwant:%#v", test.name, order, got.Elem().Interface(), dst.Elem().Interface())
+			}
+
+			_, err = Pack(buf[:n-1], dst, f)
+			if !errors.Is(err, io.ErrShortBuffer) {
+				t.Errorf("expected io.ErrShortBuffer for short buffer for %q %v: %v", test.name, order, err)
+			}
+		}
+
+		// Packed values are copied unaltered.
+		src := reflect.NewAt(host.Type, unsafe.Pointer(&test.data[0]))
+		buf := make([]byte, host.Size)
+		n, err := Pack(buf, src, host)
+		if err != nil {
+			t.Errorf("unexpected error packing packed %q: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(buf[:n], test.data[:host.Size]) {
+			t.Errorf("unexpected packed bytes for %q:\ngot: %v\nwant:%v", test.name, buf[:n], test.data[:host.Size])
+		}
+	}
+
+	// Unaligned fields are reconstructed in the format's byte order.
+	const format = `name: pack_test
+ID: 7062
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u8 flag;	offset:8;	size:1;	signed:0;
+	field:s16 delta;	offset:9;	size:2;	signed:1;
+	field:u32 counts[2];	offset:11;	size:8;	signed:0;
+	field:bool ok;	offset:19;	size:1;	signed:0;
+	field:__rel_loc u16[] vals;	offset:20;	size:4;	signed:0;
+`
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		f, err := ParseFormat(strings.NewReader(format), ByteOrder(order))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		want := reflect.New(f.Unpacked)
+		for name, val := range map[string]interface{}{
+			"common_type": uint16(7062),
+			"common_pid":  int32(-1),
+			"flag":        uint8(1),
+			"delta":       int16(-2),
+			"counts":      [2]uint32{0x01020304, 0x05060708},
+			"ok":          true,
+			"vals":        []uint16{1, 0x0203, 0xfffe},
+		} {
+			field, _ := f.FieldByName(name)
+			want.Elem().FieldByIndex(field.Index).Set(reflect.ValueOf(val))
+		}
+		buf := make([]byte, 64)
+		n, err := Pack(buf, want, f)
+		if err != nil {
+			t.Errorf("unexpected error packing %v: %v", order, err)
+			continue
+		}
+		if n != f.Size+6 {
+			t.Errorf("unexpected packed length for %v: got:%d want:%d", order, n, f.Size+6)
+		}
+		if got := order.Uint16(buf[9:]); got != 0xfffe {
+			t.Errorf("unexpected packed delta for %v: %#x", order, got)
+		}
+		got := reflect.New(f.Unpacked)
+		err = f.Unpack(got, buf[:n])
+		if err != nil {
+			t.Errorf("unexpected error unpacking packed %v: %v", order, err)
+			continue
+		}
+		if !reflect.DeepEqual(got.Elem().Interface(), want.Elem().Interface()) {
+			t.Errorf("unexpected round trip result for %v:\ngot: %#v\nwant:%#v", order, got.Elem().Interface(), want.Elem().Interface())
+		}
+	}
+
+	f, err := ParseFormat(strings.NewReader(unpackTests[0].format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	_, err = Pack(make([]byte, 64), reflect.ValueOf(struct{ A int }{}), f)
+	if err == nil {
+		t.Error("expected error for mismatched type")
+	}
+}
+
+func TestPackAlignedOrder(t *testing.T) {
+	// The packed and unpacked types of a fully aligned format are
+	// identical, but values must still be swapped when packing.
+	const format = `name: pack_aligned
+ID: 7063
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:u32 count;	offset:8;	size:4;	signed:0;
+	field:s32 delta;	offset:12;	size:4;	signed:1;
+`
+	f, err := ParseFormat(strings.NewReader(format), ByteOrder(binary.BigEndian))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if f.Type != f.Unpacked {
+		t.Fatalf("expected identical packed and unpacked types: %s != %s", f.Type, f.Unpacked)
+	}
+	data := make([]byte, f.Size)
+	binary.BigEndian.PutUint16(data, 7063)
+	binary.BigEndian.PutUint32(data[4:], 1234)
+	binary.BigEndian.PutUint32(data[8:], 0x01020304)
+	binary.BigEndian.PutUint32(data[12:], 0xfffffffe)
+
+	v := reflect.New(f.Unpacked)
+	err = f.Unpack(v, data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if got, _ := fieldByCName(v, "count"); got.Uint() != 0x01020304 {
+		t.Errorf("unexpected count: got:%#x want:0x01020304", got.Uint())
+	}
+	if got, _ := fieldByCName(v, "delta"); got.Int() != -2 {
+		t.Errorf("unexpected delta: got:%d want:-2", got.Int())
+	}
+
+	buf := make([]byte, f.Size)
+	n, err := Pack(buf, v, f)
+	if err != nil {
+		t.Fatalf("unexpected error packing: %v", err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Errorf("unexpected packed record:\ngot: %#x\nwant:%#x", buf[:n], data)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// perfRecordSample is the PERF_RECORD_SAMPLE record type.
+	perfRecordSample = 9
+
+	// perfHeaderSize is the size of struct perf_event_header.
+	perfHeaderSize = 8
+)
+
+// PerfIter iterates over the raw kprobe event payloads held in a buffer of
+// perf records, such as the data of a perf_event_open mmap ring buffer page.
+// Each record is prefixed by a struct perf_event_header. PERF_RECORD_SAMPLE
+// records must have been collected with a sample_type of PERF_SAMPLE_RAW
+// only, so that the sample body is a 32 bit length followed by the raw
+// event data. Records of other types are skipped. Headers and lengths are
+// read in host byte order.
+//
+// A PerfIter is used in the same way as a bufio.Scanner:
+//
+//	it := kprobe.NewPerfIter(page)
+//	for it.Next() {
+//		name, v, err := u.Unpack(it.Raw())
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type PerfIter struct {
+	buf []byte
+	raw []byte
+	err error
+}
+
+// NewPerfIter returns a new PerfIter over the perf records in buf.
+func NewPerfIter(buf []byte) *PerfIter {
+	return &PerfIter{buf: buf}
+}
+
+// Next advances the iterator to the next sample record, which will then be
+// available through the Raw method. It returns false when there are no
+// more sample records or an invalid record is found. After Next returns
+// false, the Err method will return any error that occurred.
+func (it *PerfIter) Next() bool {
+	it.raw = nil
+	for it.err == nil && len(it.buf) != 0 {
+		if len(it.buf) < perfHeaderSize {
+			it.err = fmt.Errorf("short perf record header: %d bytes", len(it.buf))
+			return false
+		}
+		typ := machine.Uint32(it.buf)
+		size := int(machine.Uint16(it.buf[6:]))
+		if size < perfHeaderSize || size > len(it.buf) {
+			it.err = fmt.Errorf("invalid perf record size: %d with %d bytes remaining", size, len(it.buf))
+			return false
+		}
+		rec := it.buf[perfHeaderSize:size]
+		it.buf = it.buf[size:]
+		if typ != perfRecordSample {
+			continue
+		}
+		if len(rec) < 4 {
+			it.err = errors.New("short perf sample record")
+			return false
+		}
+		n := int(machine.Uint32(rec))
+		if n > len(rec)-4 {
+			it.err = fmt.Errorf("invalid perf sample raw size: %d with %d bytes in record", n, len(rec)-4)
+			return false
+		}
+		it.raw = rec[4 : 4+n]
+		return true
+	}
+	return false
+}
+
+// Raw returns the raw event data of the current sample record. The returned
+// slice aliases the buffer passed to NewPerfIter.
+func (it *PerfIter) Raw() []byte {
+	return it.raw
+}
+
+// Err returns the first error encountered by the iterator.
+func (it *PerfIter) Err() error {
+	return it.err
+}
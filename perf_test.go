@@ -0,0 +1,70 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"bytes"
+	"testing"
+)
+
+// perfRecord returns a perf record of the given type holding body.
+func perfRecord(typ uint32, body []byte) []byte {
+	rec := make([]byte, perfHeaderSize+len(body))
+	machine.PutUint32(rec, typ)
+	machine.PutUint16(rec[6:], uint16(len(rec)))
+	copy(rec[perfHeaderSize:], body)
+	return rec
+}
+
+// perfSample returns a PERF_RECORD_SAMPLE record holding raw, padded
+// to a multiple of eight bytes as it is by the kernel.
+func perfSample(raw []byte) []byte {
+	n := (4 + len(raw) + 7) &^ 7
+	body := make([]byte, n)
+	machine.PutUint32(body, uint32(n-4))
+	copy(body[4:], raw)
+	return perfRecord(perfRecordSample, body)
+}
+
+func TestPerfIter(t *testing.T) {
+	first := unpackTests[0].data
+	second := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+
+	var page []byte
+	page = append(page, perfSample(first)...)
+	page = append(page, perfRecord(2, make([]byte, 16))...) // PERF_RECORD_LOST
+	page = append(page, perfSample(second)...)
+
+	var got [][]byte
+	it := NewPerfIter(page)
+	for it.Next() {
+		got = append(got, it.Raw())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := [][]byte{first, second}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected number of records: got:%d want:%d", len(got), len(want))
+	}
+	for i := range got {
+		if !bytes.HasPrefix(got[i], want[i]) || len(got[i])-len(want[i]) >= 8 {
+			t.Errorf("unexpected raw data for record %d:\ngot: %v\nwant:%v", i, got[i], want[i])
+		}
+	}
+
+	for _, bad := range [][]byte{
+		page[:len(page)-1],
+		page[:4],
+		perfRecord(perfRecordSample, []byte{0xff, 0, 0, 0}),
+	} {
+		it := NewPerfIter(bad)
+		for it.Next() {
+		}
+		if it.Err() == nil {
+			t.Errorf("expected error for invalid buffer: %v", bad)
+		}
+	}
+}
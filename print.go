@@ -0,0 +1,939 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// printFormat is a parsed print fmt.
+type printFormat struct {
+	format string   // format is the unquoted format string.
+	args   []string // args are the argument expressions.
+}
+
+// parsePrintFmt parses the text of a print fmt.
+func parsePrintFmt(s string) (*printFormat, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, `"`) {
+		return nil, fmt.Errorf("invalid print fmt: %q", s)
+	}
+	var buf strings.Builder
+	end := -1
+loop:
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			i++
+			if i == len(s) {
+				break loop
+			}
+			switch s[i] {
+			case 'n':
+				buf.WriteByte('\n')
+			case 't':
+				buf.WriteByte('\t')
+			default:
+				buf.WriteByte(s[i])
+			}
+		case '"':
+			// Some emitters do not escape quotes within the format
+			// string, so only treat a quote as closing the string
+			// if it is followed by the argument list.
+			rest := strings.TrimLeft(s[i+1:], " \t\n")
+			if rest == "" || rest[0] == ',' {
+				end = i
+				break loop
+			}
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated print fmt string: %q", s)
+	}
+	args, err := splitArgs(strings.TrimPrefix(strings.TrimSpace(s[end+1:]), ","))
+	if err != nil {
+		return nil, err
+	}
+	return &printFormat{format: buf.String(), args: args}, nil
+}
+
+// splitArgs splits a C argument list on top-level commas.
+func splitArgs(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var (
+		args  []string
+		depth int
+		start int
+		quote bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote {
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				quote = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			quote = true
+		case '(', '{', '[':
+			depth++
+		case ')', '}', ']':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced argument list: %q", s)
+			}
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 || quote {
+		return nil, fmt.Errorf("unbalanced argument list: %q", s)
+	}
+	return append(args, strings.TrimSpace(s[start:])), nil
+}
+
+// Sprint returns the event in v rendered according to the print fmt of f,
+// mimicking the output of the kernel's trace_pipe. The value v must be a
+// struct, or pointer to struct, of the Format's Unpacked type, or of its
+// Type if the format needs no unpacking.
+//
+// Integer conversions are rendered according to their C length modifiers.
+// Pointer conversions, including kernel extensions such as %pS, are
+// rendered as unhashed hexadecimal addresses since kernel symbol and
+// pointer hashing information is not available. Arguments may refer to
+// fields directly with REC->field or REC->field[i], or via the __get_str,
+// __get_dynamic_array, __get_dynamic_array_len, __print_array,
+// __print_symbolic and __print_flags helpers, and the __rel_loc variants
+// of the __get helpers.
+func Sprint(f *Format, v reflect.Value) (string, error) {
+	pf := f.print
+	if pf == nil {
+		var err error
+		pf, err = parsePrintFmt(f.PrintFmt)
+		if err != nil {
+			return "", err
+		}
+	}
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return "", fmt.Errorf("invalid type: %s", v.Type())
+	}
+	p := printer{f: f, v: v}
+	return p.sprint(pf)
+}
+
+// Sprintkv returns the event in v rendered as space separated name=value
+// pairs in field declaration order, using the C names of the fields. The
+// value v must be a struct, or pointer to struct, of the Format's Unpacked
+// type, or of its Type if the format needs no unpacking. Char arrays,
+// including dynamic char arrays, are rendered as quoted strings, other
+// arrays as bracketed lists and integers in decimal. Padding is not
+// included, nor are fields that are not present in the struct type. If v
+// is not a struct, Sprintkv returns the empty string.
+func Sprintkv(f *Format, v reflect.Value) string {
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	var buf strings.Builder
+	for _, field := range f.Fields {
+		if len(field.Index) == 0 || field.Index[0] >= v.NumField() {
+			continue
+		}
+		if buf.Len() != 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(field.Name)
+		buf.WriteByte('=')
+		fv := v.FieldByIndex(field.Index)
+		if isCharArray(field.CType) {
+			if s, ok := cString(fv); ok {
+				buf.WriteString(strconv.Quote(s))
+				continue
+			}
+		}
+		switch fv.Kind() {
+		case reflect.Array, reflect.Slice:
+			buf.WriteByte('[')
+			for i := 0; i < fv.Len(); i++ {
+				if i != 0 {
+					buf.WriteByte(' ')
+				}
+				fmt.Fprint(&buf, fv.Index(i).Interface())
+			}
+			buf.WriteByte(']')
+		default:
+			fmt.Fprint(&buf, fv.Interface())
+		}
+	}
+	return buf.String()
+}
+
+// isCharArray returns whether ctyp is a fixed or dynamic array of plain char.
+func isCharArray(ctyp string) bool {
+	if elem, ok := dynamicElement(ctyp); ok {
+		ctyp = elem
+	}
+	return baseType(ctyp) == "char" && strings.HasSuffix(ctyp, "]")
+}
+
+// printer renders print fmt values from an event.
+type printer struct {
+	f *Format
+	v reflect.Value
+}
+
+// sprint renders the event according to pf.
+func (p printer) sprint(pf *printFormat) (string, error) {
+	var buf strings.Builder
+	args := pf.args
+	format := pf.format
+	for {
+		i := strings.IndexByte(format, '%')
+		if i < 0 {
+			buf.WriteString(format)
+			break
+		}
+		buf.WriteString(format[:i])
+		format = format[i:]
+		if strings.HasPrefix(format, "%%") {
+			buf.WriteByte('%')
+			format = format[2:]
+			continue
+		}
+		spec, n, err := parseConversion(format)
+		if err != nil {
+			return "", err
+		}
+		format = format[n:]
+		if spec.width == "*" {
+			if len(args) == 0 {
+				return "", fmt.Errorf("missing argument for %s", spec.text)
+			}
+			w, err := p.eval(args[0])
+			if err != nil {
+				return "", err
+			}
+			args = args[1:]
+			bits, ok := integerBits(w)
+			if !ok {
+				return "", fmt.Errorf("invalid width argument for %s", spec.text)
+			}
+			spec.width = strconv.Itoa(int(int32(bits)))
+		}
+		if len(args) == 0 {
+			return "", fmt.Errorf("missing argument for %s", spec.text)
+		}
+		v, err := p.eval(args[0])
+		if err != nil {
+			return "", err
+		}
+		args = args[1:]
+		s, err := spec.format(v)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(s)
+	}
+	return buf.String(), nil
+}
+
+// stripCasts returns expr without any enclosing parentheses or leading
+// casts.
+func stripCasts(expr string) (string, error) {
+	expr = strings.TrimSpace(expr)
+	for strings.HasPrefix(expr, "(") {
+		end := closingParen(expr)
+		if end < 0 {
+			return "", fmt.Errorf("unbalanced expression: %q", expr)
+		}
+		if end == len(expr)-1 {
+			// Parenthesised expression.
+			expr = strings.TrimSpace(expr[1:end])
+			continue
+		}
+		// Cast; the conversion determines the rendering.
+		expr = strings.TrimSpace(expr[end+1:])
+	}
+	return expr, nil
+}
+
+// eval returns the value of a print fmt argument expression.
+func (p printer) eval(expr string) (reflect.Value, error) {
+	expr, err := stripCasts(expr)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	if strings.HasPrefix(expr, "REC->") {
+		name := strings.TrimPrefix(expr, "REC->")
+		var idx string
+		if i := strings.Index(name, "["); i >= 0 && strings.HasSuffix(name, "]") {
+			idx = strings.TrimSpace(name[i+1 : len(name)-1])
+			name = strings.TrimSpace(name[:i])
+		}
+		v, err := p.field(name)
+		if err != nil || idx == "" {
+			return v, err
+		}
+		i, err := strconv.Atoi(idx)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("invalid index in %q: %w", expr, err)
+		}
+		if (v.Kind() != reflect.Array && v.Kind() != reflect.Slice) || i < 0 || i >= v.Len() {
+			return reflect.Value{}, fmt.Errorf("invalid index in %q", expr)
+		}
+		return v.Index(i), nil
+	}
+
+	if fn, args, ok := call(expr); ok {
+		switch fn {
+		case "__get_str", "__get_dynamic_array", "__get_rel_str", "__get_rel_dynamic_array":
+			if len(args) != 1 {
+				return reflect.Value{}, fmt.Errorf("invalid argument count for %s: %d", fn, len(args))
+			}
+			return p.field(args[0])
+		case "__get_dynamic_array_len", "__get_rel_dynamic_array_len":
+			if len(args) != 1 {
+				return reflect.Value{}, fmt.Errorf("invalid argument count for %s: %d", fn, len(args))
+			}
+			v, err := p.field(args[0])
+			if err != nil {
+				return v, err
+			}
+			if v.Kind() != reflect.Slice {
+				return reflect.Value{}, fmt.Errorf("invalid dynamic array: %s", args[0])
+			}
+			return reflect.ValueOf(uint64(v.Len()) * uint64(v.Type().Elem().Size())), nil
+		case "__print_array":
+			if len(args) != 3 {
+				return reflect.Value{}, fmt.Errorf("invalid argument count for %s: %d", fn, len(args))
+			}
+			return p.printArray(args[0], args[1], args[2])
+		case "__print_symbolic":
+			if len(args) < 1 {
+				return reflect.Value{}, fmt.Errorf("invalid argument count for %s: %d", fn, len(args))
+			}
+			return p.printSymbolic(args[0], args[1:])
+		case "__print_flags":
+			if len(args) < 2 {
+				return reflect.Value{}, fmt.Errorf("invalid argument count for %s: %d", fn, len(args))
+			}
+			return p.printFlags(args[0], args[1], args[2:])
+		default:
+			return reflect.Value{}, fmt.Errorf("unsupported print fmt helper: %s", fn)
+		}
+	}
+
+	n, err := strconv.ParseInt(expr, 0, 64)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("unsupported print fmt argument: %q", expr)
+	}
+	return reflect.ValueOf(n), nil
+}
+
+// field returns the value of the field with the given C name.
+func (p printer) field(name string) (reflect.Value, error) {
+	field, ok := p.f.FieldByName(name)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("no field %s", name)
+	}
+	if field.Index == nil {
+		return reflect.Value{}, fmt.Errorf("field %s is not present in struct", name)
+	}
+	return p.v.FieldByIndex(field.Index), nil
+}
+
+// printArray renders an array in the style of the kernel's __print_array.
+func (p printer) printArray(array, count, size string) (reflect.Value, error) {
+	a, err := p.eval(array)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if a.Kind() != reflect.Slice && a.Kind() != reflect.Array {
+		return reflect.Value{}, fmt.Errorf("invalid array argument: %q", array)
+	}
+	c, err := p.eval(count)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	n, ok := integerBits(c)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("invalid count argument: %q", count)
+	}
+	s, err := p.eval(size)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	elSize, ok := integerBits(s)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("invalid size argument: %q", size)
+	}
+	if n > uint64(a.Len()) {
+		n = uint64(a.Len())
+	}
+	var buf strings.Builder
+	buf.WriteByte('{')
+	for i := 0; i < int(n); i++ {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		e, ok := integerBits(a.Index(i))
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("invalid array element type: %s", a.Type().Elem())
+		}
+		switch elSize {
+		case 1, 2, 4, 8:
+			fmt.Fprintf(&buf, "0x%x", e&mask(int(elSize)*8))
+		default:
+			fmt.Fprintf(&buf, "BAD SIZE:%d 0x%x", elSize, uint8(e))
+		}
+	}
+	buf.WriteByte('}')
+	return reflect.ValueOf(buf.String()), nil
+}
+
+// printSymbolic renders a value in the style of the kernel's
+// __print_symbolic.
+func (p printer) printSymbolic(val string, mapping []string) (reflect.Value, error) {
+	v, err := p.eval(val)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	bits, ok := integerBits(v)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("invalid symbolic value argument: %q", val)
+	}
+	syms, err := parseSymbols(mapping)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	for _, s := range syms {
+		if s.Value == bits {
+			return reflect.ValueOf(s.Name), nil
+		}
+	}
+	return reflect.ValueOf(fmt.Sprintf("0x%x", bits)), nil
+}
+
+// printFlags renders a value in the style of the kernel's __print_flags.
+func (p printer) printFlags(val, delim string, mapping []string) (reflect.Value, error) {
+	v, err := p.eval(val)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	bits, ok := integerBits(v)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("invalid flags value argument: %q", val)
+	}
+	d, err := strconv.Unquote(strings.TrimSpace(delim))
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("invalid flags delimiter: %q", delim)
+	}
+	syms, err := parseSymbols(mapping)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return reflect.ValueOf(printFlags(bits, d, syms)), nil
+}
+
+// parseSymbols parses a list of {value, "name"} symbol mappings.
+func parseSymbols(mapping []string) ([]Symbol, error) {
+	syms := make([]Symbol, 0, len(mapping))
+	for _, m := range mapping {
+		if !strings.HasPrefix(m, "{") || !strings.HasSuffix(m, "}") {
+			return nil, fmt.Errorf("invalid symbol mapping: %q", m)
+		}
+		parts, err := splitArgs(m[1 : len(m)-1])
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid symbol mapping: %q", m)
+		}
+		val, err := stripCasts(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		var v uint64
+		if strings.HasPrefix(val, "-") {
+			n, err := strconv.ParseInt(val, 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid symbol value in %q: %w", m, err)
+			}
+			v = uint64(n)
+		} else {
+			v, err = strconv.ParseUint(val, 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid symbol value in %q: %w", m, err)
+			}
+		}
+		name, err := strconv.Unquote(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid symbol name in %q: %w", m, err)
+		}
+		syms = append(syms, Symbol{Value: v, Name: name})
+	}
+	return syms, nil
+}
+
+// annotate attaches symbol and flag mappings from print fmt helpers in expr to
+// the fields of f that they refer to. Expressions that cannot be parsed
+// are ignored.
+func (f *Format) annotate(expr string) {
+	expr, err := stripCasts(expr)
+	if err != nil {
+		return
+	}
+	fn, args, ok := call(expr)
+	if !ok {
+		return
+	}
+	switch {
+	case fn == "__print_symbolic" && len(args) != 0:
+		field, ok := f.fieldRef(args[0])
+		syms, err := parseSymbols(args[1:])
+		if ok && err == nil {
+			field.Symbols = syms
+		}
+	case fn == "__print_flags" && len(args) > 1:
+		field, ok := f.fieldRef(args[0])
+		delim, errDelim := strconv.Unquote(args[1])
+		syms, err := parseSymbols(args[2:])
+		if ok && errDelim == nil && err == nil {
+			field.Flags = syms
+			field.FlagDelim = delim
+		}
+	}
+	for _, arg := range args {
+		f.annotate(arg)
+	}
+}
+
+// label attaches display labels from the format string of pf to the fields
+// of f that are printed by its conversions. A conversion is labelled when
+// the text preceding it ends with an identifier followed by '=' and an
+// optional prefix without spaces, such as size= in size=%u or sock= in
+// sock=0x%Lx, and its argument refers to a single field. The first label
+// found for a field is used. Format strings that cannot be parsed are
+// ignored.
+//
+// The first %x, %X or %o conversion of each field that is printed directly,
+// without being part of a larger expression, is also recorded in f.radix.
+func (f *Format) label(pf *printFormat) {
+	args := pf.args
+	format := pf.format
+	for {
+		i := strings.IndexByte(format, '%')
+		if i < 0 {
+			return
+		}
+		text := format[:i]
+		format = format[i:]
+		if strings.HasPrefix(format, "%%") {
+			format = format[2:]
+			continue
+		}
+		spec, n, err := parseConversion(format)
+		if err != nil {
+			return
+		}
+		format = format[n:]
+		if spec.width == "*" {
+			if len(args) == 0 {
+				return
+			}
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			return
+		}
+		arg := args[0]
+		args = args[1:]
+
+		switch spec.verb {
+		case 'x', 'X', 'o':
+			fld, ok := f.fieldRef(arg)
+			if !ok {
+				break
+			}
+			if _, ok := f.radix[fld.Name]; !ok {
+				if f.radix == nil {
+					f.radix = make(map[string]conversion)
+				}
+				f.radix[fld.Name] = spec
+			}
+		}
+
+		label := textLabel(text)
+		if label == "" {
+			continue
+		}
+		refs := f.appendFieldRefs(nil, arg)
+		if len(refs) != 1 {
+			continue
+		}
+		for i := range f.Fields {
+			if f.Fields[i].Name == refs[0] && f.Fields[i].Label == "" {
+				f.Fields[i].Label = label
+			}
+		}
+	}
+}
+
+// textLabel returns the label at the end of the print fmt text preceding
+// a conversion, or the empty string if there is none.
+func textLabel(text string) string {
+	i := strings.LastIndexByte(text, '=')
+	if i < 0 || strings.ContainsAny(text[i+1:], " \t\n") {
+		return ""
+	}
+	text = text[:i]
+	j := len(text)
+	for j > 0 && isIdentPart(text[j-1]) {
+		j--
+	}
+	if j == len(text) || !isIdentStart(text[j]) {
+		return ""
+	}
+	return text[j:]
+}
+
+// fieldRef returns a pointer to the field of f referred to by the REC->field
+// expression, expr.
+func (f *Format) fieldRef(expr string) (*Field, bool) {
+	ref, err := stripCasts(expr)
+	if err != nil || !strings.HasPrefix(ref, "REC->") {
+		return nil, false
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(ref, "REC->"))
+	for i := range f.Fields {
+		if f.Fields[i].Name == name {
+			return &f.Fields[i], true
+		}
+	}
+	return nil, false
+}
+
+// appendFieldRefs appends the names of the fields of f referred to in the
+// print fmt argument expression, expr, to dst if they are not already in
+// dst. Fields are referred to either as REC->field, with an optional index
+// expression, or as the argument of a __get helper such as __get_str.
+func (f *Format) appendFieldRefs(dst []string, expr string) []string {
+	add := func(name string) {
+		if _, ok := f.FieldByName(name); !ok {
+			return
+		}
+		for _, n := range dst {
+			if n == name {
+				return
+			}
+		}
+		dst = append(dst, name)
+	}
+	for i := 0; i < len(expr); {
+		if !isIdentStart(expr[i]) {
+			// Skip whole numbers so that the digits
+			// of a literal are not taken as names.
+			if isIdentPart(expr[i]) {
+				for i < len(expr) && isIdentPart(expr[i]) {
+					i++
+				}
+				continue
+			}
+			i++
+			continue
+		}
+		j := i
+		for j < len(expr) && isIdentPart(expr[j]) {
+			j++
+		}
+		ident := expr[i:j]
+		switch {
+		case ident == "REC" && strings.HasPrefix(expr[j:], "->"):
+			k := j + len("->")
+			l := k
+			for l < len(expr) && isIdentPart(expr[l]) {
+				l++
+			}
+			add(expr[k:l])
+			j = l
+		case strings.HasPrefix(ident, "__get_"):
+			rest := strings.TrimLeft(expr[j:], " ")
+			if !strings.HasPrefix(rest, "(") {
+				break
+			}
+			rest = strings.TrimLeft(rest[1:], " ")
+			l := 0
+			for l < len(rest) && isIdentPart(rest[l]) {
+				l++
+			}
+			add(rest[:l])
+		}
+		i = j
+	}
+	return dst
+}
+
+// isIdentStart returns whether c may start a C identifier.
+func isIdentStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// isIdentPart returns whether c may be part of a C identifier.
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || '0' <= c && c <= '9'
+}
+
+// printFlags renders flags in the style of the kernel's __print_flags.
+// Flags are matched in order, and any remaining bits are rendered in
+// hexadecimal.
+func printFlags(flags uint64, delim string, mapping []Symbol) string {
+	var buf strings.Builder
+	first := true
+	for _, m := range mapping {
+		if flags == 0 {
+			break
+		}
+		if flags&m.Value != m.Value {
+			continue
+		}
+		flags &^= m.Value
+		if !first {
+			buf.WriteString(delim)
+		}
+		first = false
+		buf.WriteString(m.Name)
+	}
+	if flags != 0 {
+		if !first {
+			buf.WriteString(delim)
+		}
+		fmt.Fprintf(&buf, "0x%x", flags)
+	}
+	return buf.String()
+}
+
+// closingParen returns the index of the parenthesis closing the opening
+// parenthesis at the start of s, or -1 if it is not closed.
+func closingParen(s string) int {
+	var depth int
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// call returns the function name and arguments of a function call
+// expression.
+func call(expr string) (fn string, args []string, ok bool) {
+	i := strings.Index(expr, "(")
+	if i <= 0 || !strings.HasSuffix(expr, ")") || closingParen(expr[i:]) != len(expr)-i-1 {
+		return "", nil, false
+	}
+	fn = strings.TrimSpace(expr[:i])
+	for _, r := range fn {
+		if r != '_' && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') && !('0' <= r && r <= '9') {
+			return "", nil, false
+		}
+	}
+	args, err := splitArgs(expr[i+1 : len(expr)-1])
+	if err != nil {
+		return "", nil, false
+	}
+	return fn, args, true
+}
+
+// conversion is a C printf conversion specification.
+type conversion struct {
+	text   string // text is the complete specification.
+	flags  string
+	width  string
+	prec   string // prec includes the leading '.' if present.
+	length string
+	verb   byte
+}
+
+// parseConversion parses the conversion specification at the start of s
+// and returns it and its length.
+func parseConversion(s string) (spec conversion, n int, err error) {
+	i := 1
+	for i < len(s) && strings.IndexByte("-+ #0", s[i]) >= 0 {
+		i++
+	}
+	spec.flags = s[1:i]
+	start := i
+	if i < len(s) && s[i] == '*' {
+		i++
+	} else {
+		for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+			i++
+		}
+	}
+	spec.width = s[start:i]
+	if i < len(s) && s[i] == '.' {
+		start = i
+		i++
+		for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+			i++
+		}
+		spec.prec = s[start:i]
+	}
+	start = i
+	for i < len(s) && strings.IndexByte("hlLqjzZt", s[i]) >= 0 {
+		i++
+	}
+	spec.length = s[start:i]
+	if i == len(s) {
+		return spec, 0, fmt.Errorf("incomplete conversion: %q", s)
+	}
+	spec.verb = s[i]
+	i++
+	switch spec.verb {
+	case 'd', 'i', 'u', 'x', 'X', 'o', 'c', 's':
+	case 'p':
+		// Consume kernel pointer extensions.
+		for i < len(s) && isAlnum(s[i]) {
+			i++
+		}
+	default:
+		return spec, 0, fmt.Errorf("unsupported conversion: %q", s[:i])
+	}
+	spec.text = s[:i]
+	return spec, i, nil
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// bits returns the width in bits of integer values formatted with the
+// conversion's length modifier.
+func (spec conversion) bits() int {
+	switch spec.length {
+	case "hh":
+		return 8
+	case "h":
+		return 16
+	case "":
+		return 32
+	default:
+		return 64
+	}
+}
+
+// format renders v according to the conversion.
+func (spec conversion) format(v reflect.Value) (string, error) {
+	prefix := "%" + spec.flags + spec.width + spec.prec
+	switch spec.verb {
+	case 's':
+		s, ok := cString(v)
+		if !ok {
+			return "", fmt.Errorf("invalid argument type for %s: %s", spec.text, v.Type())
+		}
+		return fmt.Sprintf(prefix+"s", s), nil
+	case 'p':
+		bits, ok := integerBits(v)
+		if !ok {
+			return "", fmt.Errorf("invalid argument type for %s: %s", spec.text, v.Type())
+		}
+		return fmt.Sprintf("%016x", bits), nil
+	}
+	bits, ok := integerBits(v)
+	if !ok {
+		return "", fmt.Errorf("invalid argument type for %s: %s", spec.text, v.Type())
+	}
+	w := spec.bits()
+	switch spec.verb {
+	case 'd', 'i':
+		return fmt.Sprintf(prefix+"d", int64(bits<<(64-w))>>(64-w)), nil
+	case 'u':
+		return fmt.Sprintf(prefix+"d", bits&mask(w)), nil
+	case 'c':
+		return fmt.Sprintf("%"+spec.flags+spec.width+"c", rune(uint8(bits))), nil
+	default:
+		return fmt.Sprintf(prefix+string(spec.verb), bits&mask(w)), nil
+	}
+}
+
+// mask returns a mask of the low n bits.
+func mask(n int) uint64 {
+	if n >= 64 {
+		return ^uint64(0)
+	}
+	return 1<<n - 1
+}
+
+// integerBits returns the bits of an integer value, sign-extended
+// for signed types.
+func integerBits(v reflect.Value) (uint64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), true
+	case reflect.Bool:
+		if v.Bool() {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// cString returns the NUL-terminated string held in v, which must be
+// a string or a byte-sized integer array or slice.
+func cString(v reflect.Value) (string, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		if i := strings.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		return s, true
+	case reflect.Array, reflect.Slice:
+		switch v.Type().Elem().Kind() {
+		case reflect.Int8, reflect.Uint8:
+		default:
+			return "", false
+		}
+		b := make([]byte, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c, _ := integerBits(v.Index(i))
+			if c == 0 {
+				break
+			}
+			b = append(b, byte(c))
+		}
+		return string(b), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+var sprintTests = []struct {
+	name   string
+	format string
+	data   []byte
+	want   string
+}{
+	{
+		name:   "do_sys_open",
+		format: unpackTests[0].format + "\nprint fmt: \"\"%s\" %x %o\", __get_str(filename), REC->flags, REC->mode\n",
+		data:   unpackTests[0].data,
+		want:   `"file.text" 88241 644`,
+	},
+	{
+		name: "ip_local_out_call",
+		format: `name: ip_local_out_call
+ID: 3965
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:unsigned long __probe_ip;	offset:8;	size:8;	signed:0;
+	field:u64 sock;	offset:16;	size:8;	signed:0;
+	field:u32 size;	offset:24;	size:4;	signed:0;
+	field:u16 af;	offset:28;	size:2;	signed:0;
+	field:u32 laddr;	offset:30;	size:4;	signed:0;
+	field:u16 lport;	offset:34;	size:2;	signed:0;
+	field:u32 raddr;	offset:36;	size:4;	signed:0;
+	field:u16 rport;	offset:40;	size:2;	signed:0;
+
+print fmt: "(%lx) sock=0x%Lx size=%u af=%u laddr=%u lport=%u raddr=%u rport=%u", REC->__probe_ip, REC->sock, REC->size, REC->af, REC->laddr, REC->lport, REC->raddr, REC->rport
+`,
+		data: []byte{
+			0x7d, 0x0f, 0x00, 0x00, 0xc7, 0x29, 0x00, 0x00,
+			0x0f, 0x2b, 0xdb, 0xef, 0x00, 0x00, 0x00, 0x00,
+			0x40, 0xe0, 0x73, 0x97, 0x7d, 0x9e, 0x00, 0x00,
+			0x3c, 0x00, 0x00, 0x00, 0x02, 0x00, 0x7f, 0x00,
+			0x00, 0x01, 0xde, 0xad, 0x7f, 0x00, 0x00, 0x01,
+			0xbe, 0xef, 0x00, 0x00,
+		},
+		want: "(efdb2b0f) sock=0x9e7d9773e040 size=60 af=2 laddr=16777343 lport=44510 raddr=16777343 rport=61374",
+	},
+	{
+		name: "vfs_read",
+		format: `name: vfs_read
+ID: 3842
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:unsigned long __probe_ip;	offset:8;	size:8;	signed:0;
+	field:u64 arg1;	offset:16;	size:8;	signed:0;
+	field:u8 arg2[8];	offset:24;	size:8;	signed:0;
+
+print fmt: "(%lx) arg1=0x%Lx arg2={0x%x,0x%x,0x%x,0x%x,0x%x,0x%x,0x%x,0x%x}", REC->__probe_ip, REC->arg1, REC->arg2[0], REC->arg2[1], REC->arg2[2], REC->arg2[3], REC->arg2[4], REC->arg2[5], REC->arg2[6], REC->arg2[7]
+`,
+		data: []byte{
+			0x02, 0x0f, 0x00, 0x00, 0x73, 0x1e, 0x00, 0x00,
+			0x0f, 0xeb, 0xd4, 0x3f, 0x00, 0x00, 0x00, 0x00,
+			0xb0, 0x1d, 0xfa, 0xce, 0x11, 0xe5, 0x00, 0x00,
+			0x52, 0x12, 0x1b, 0x81, 0xff, 0xff, 0xff, 0xff,
+		},
+		want: "(3fd4eb0f) arg1=0xe511cefa1db0 arg2={0x52,0x12,0x1b,0x81,0xff,0xff,0xff,0xff}",
+	},
+	{
+		name:   "gvt_command",
+		format: unpackTests[1].format,
+		data: func() []byte {
+			b := append([]byte(nil), unpackTests[1].data...)
+			b[8] = 1                                      // vgpu_id
+			b[9] = 2                                      // ring_id
+			*(*uint32)(unsafe.Pointer(&b[12])) = 0xbeef   // ip_gma
+			*(*uint32)(unsafe.Pointer(&b[24])) = 2        // cmd_len
+			*(*uint64)(unsafe.Pointer(&b[32])) = 0xc0ffee // workload
+			copy(b[44:], "MI_NOOP\x00")
+			return b
+		}(),
+		want: "vgpu1 ring 2: address_type 0, buf_type 0, ip_gma 0000beef,cmd (name=MI_NOOP,len=2,raw cmd={0x12345678,0x9abcdef}), workload=0000000000c0ffee\n",
+	},
+	{
+		name: "symbolic",
+		format: `name: inet_sock_set_state
+ID: 1391
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:int oldstate;	offset:8;	size:4;	signed:1;
+	field:int newstate;	offset:12;	size:4;	signed:1;
+	field:__u16 family;	offset:16;	size:2;	signed:0;
+	field:__u16 protocol;	offset:18;	size:2;	signed:0;
+
+print fmt: "family=%s protocol=%s oldstate=%s newstate=%s", __print_symbolic(REC->family, { 2, "AF_INET" }, { 10, "AF_INET6" }), __print_symbolic(REC->protocol, { 6, "IPPROTO_TCP" }, { 33, "IPPROTO_DCCP" }), __print_symbolic(REC->oldstate, { 1, "TCP_ESTABLISHED" }, { 2, "TCP_SYN_SENT" }), __print_symbolic((int)REC->newstate, { 1, "TCP_ESTABLISHED" }, { 2, "TCP_SYN_SENT" })
+`,
+		data: []byte{
+			0x6f, 0x05, 0x00, 0x00, 0x73, 0x1e, 0x00, 0x00,
+			0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+			0x0a, 0x00, 0x11, 0x00,
+		},
+		want: "family=AF_INET6 protocol=0x11 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+	},
+	{
+		name:   "do_sys_open flags",
+		format: unpackTests[0].format + "\nprint fmt: " + openFlagsPrintFmt + "\n",
+		data:   unpackTests[0].data,
+		want:   `"file.text" flags=O_WRONLY|O_CREAT|O_TRUNC|O_LARGEFILE|O_CLOEXEC mode=644`,
+	},
+}
+
+const openFlagsPrintFmt = `"\"%s\" flags=%s mode=%o", __get_str(filename), __print_flags(REC->flags, "|", { 00000001, "O_WRONLY" }, { 00000002, "O_RDWR" }, { 00000100, "O_CREAT" }, { 00000200, "O_EXCL" }, { 00000400, "O_NOCTTY" }, { 00001000, "O_TRUNC" }, { 00002000, "O_APPEND" }, { 00004000, "O_NONBLOCK" }, { 00010000, "O_DSYNC" }, { 00040000, "O_DIRECT" }, { 00100000, "O_LARGEFILE" }, { 00200000, "O_DIRECTORY" }, { 00400000, "O_NOFOLLOW" }, { 01000000, "O_NOATIME" }, { 02000000, "O_CLOEXEC" }), REC->mode`
+
+func TestDecodeFlags(t *testing.T) {
+	f, err := ParseFormat(strings.NewReader(unpackTests[0].format + "\nprint fmt: " + openFlagsPrintFmt + "\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	flags, _ := f.FieldByName("flags")
+	if len(flags.Flags) != 15 || flags.FlagDelim != "|" {
+		t.Errorf("unexpected flags mapping: delim=%q flags=%v", flags.FlagDelim, flags.Flags)
+	}
+	tests := []struct {
+		field string
+		value uint64
+		want  string
+	}{
+		{field: "flags", value: 0x88241, want: "O_WRONLY|O_CREAT|O_TRUNC|O_LARGEFILE|O_CLOEXEC"},
+		{field: "flags", value: 0x2, want: "O_RDWR"},
+		{field: "flags", value: 0x10000000 | 0x40, want: "O_CREAT|0x10000000"},
+		{field: "flags", value: 0, want: ""},
+		{field: "mode", value: 0x1a4, want: "0x1a4"},
+		{field: "missing", value: 1, want: "0x1"},
+	}
+	for _, test := range tests {
+		got := f.DecodeFlags(test.field, test.value)
+		if got != test.want {
+			t.Errorf("unexpected result for %s=%#x: got:%q want:%q", test.field, test.value, got, test.want)
+		}
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	f, err := ParseFormat(strings.NewReader(sprintTests[4].format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	want := map[string][]Symbol{
+		"family":   {{Value: 2, Name: "AF_INET"}, {Value: 10, Name: "AF_INET6"}},
+		"protocol": {{Value: 6, Name: "IPPROTO_TCP"}, {Value: 33, Name: "IPPROTO_DCCP"}},
+		"oldstate": {{Value: 1, Name: "TCP_ESTABLISHED"}, {Value: 2, Name: "TCP_SYN_SENT"}},
+		"newstate": {{Value: 1, Name: "TCP_ESTABLISHED"}, {Value: 2, Name: "TCP_SYN_SENT"}},
+	}
+	for _, field := range f.Fields {
+		if !reflect.DeepEqual(field.Symbols, want[field.Name]) {
+			t.Errorf("unexpected symbols for %s:\ngot: %v\nwant:%v", field.Name, field.Symbols, want[field.Name])
+		}
+	}
+	family, _ := f.FieldByName("family")
+	got, ok := family.Symbol(2)
+	if !ok || got != "AF_INET" {
+		t.Errorf("unexpected symbol for family=2: got:%q ok:%t", got, ok)
+	}
+	_, ok = family.Symbol(1)
+	if ok {
+		t.Error("unexpected symbol for family=1")
+	}
+}
+
+func TestSprint(t *testing.T) {
+	for _, test := range sprintTests {
+		f, err := ParseFormat(strings.NewReader(test.format))
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", test.name, err)
+			continue
+		}
+		src := reflect.NewAt(f.Type, unsafe.Pointer(&test.data[0]))
+		dst := reflect.New(f.Unpacked)
+		err = Unpack(dst, src, f.Unaligned, test.data)
+		if err != nil {
+			t.Errorf("unexpected error unpacking %q: %v", test.name, err)
+			continue
+		}
+		got, err := Sprint(f, dst)
+		if err != nil {
+			t.Errorf("unexpected error printing %q: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("unexpected result for %q:\ngot: %q\nwant:%q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSprintkv(t *testing.T) {
+	test := unpackTests[0]
+	f, err := ParseFormat(strings.NewReader(test.format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, test.data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	got := Sprintkv(f, dst)
+	want := `common_type=7090 common_flags=0 common_preempt_count=0 common_pid=32705 ` +
+		`__probe_ip=18446744072341004784 dfd=2926421296 filename="file.text" flags=557633 mode=420`
+	if got != want {
+		t.Errorf("unexpected result:\ngot: %s\nwant:%s", got, want)
+	}
+
+	const arrays = `name: arrays
+ID: 7038
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:char comm[6];	offset:2;	size:6;	signed:1;
+	field:u16 ports[3];	offset:8;	size:6;	signed:0;
+`
+	f, err = ParseFormat(strings.NewReader(arrays))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	data := make([]byte, 16)
+	copy(data[2:], "bash\x00")
+	for i, p := range []uint16{22, 80, 443} {
+		machine.PutUint16(data[8+2*i:], p)
+	}
+	got = Sprintkv(f, reflect.NewAt(f.Type, unsafe.Pointer(&data[0])))
+	want = `common_type=0 comm="bash" ports=[22 80 443]`
+	if got != want {
+		t.Errorf("unexpected result for arrays:\ngot: %s\nwant:%s", got, want)
+	}
+}
+
+func TestPrintFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		want   []string
+	}{
+		{
+			name:   "vfs_read",
+			format: formatTests[2].format,
+			want:   []string{"__probe_ip", "arg1", "arg2"},
+		},
+		{
+			name: "display order",
+			format: `name: display_order
+ID: 7041
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:u32 flags;	offset:4;	size:4;	signed:0;
+	field:u32 x10;	offset:8;	size:4;	signed:0;
+	field:__data_loc char[] filename;	offset:12;	size:4;	signed:1;
+	field:u32 mode;	offset:16;	size:4;	signed:0;
+
+print fmt: "name=%s mode=%o flags=%s", __get_str(filename), REC->mode, __print_flags(REC->flags & 0x10, "|", {0x10, "X"})
+`,
+			want: []string{"filename", "mode", "flags"},
+		},
+	}
+	for _, test := range tests {
+		f, err := ParseFormat(strings.NewReader(test.format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(f.PrintFields, test.want) {
+			t.Errorf("unexpected print fields for %s: got:%q want:%q", test.name, f.PrintFields, test.want)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	f, err := ParseFormat(strings.NewReader(sprintTests[1].format)) // ip_local_out_call
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	got := make(map[string]string)
+	for _, field := range f.Fields {
+		if field.Label != "" {
+			got[field.Name] = field.Label
+		}
+	}
+	want := map[string]string{
+		"sock":  "sock",
+		"size":  "size",
+		"af":    "af",
+		"laddr": "laddr",
+		"lport": "lport",
+		"raddr": "raddr",
+		"rport": "rport",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected labels for ip_local_out_call:\ngot: %v\nwant:%v", got, want)
+	}
+
+	const format = `name: labels
+ID: 7071
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:u32 flags;	offset:4;	size:4;	signed:0;
+	field:__data_loc char[] filename;	offset:8;	size:4;	signed:1;
+	field:u32 mode;	offset:12;	size:4;	signed:0;
+	field:u32 len;	offset:16;	size:4;	signed:0;
+
+print fmt: "name=\"%s\" perm=%o%% f=%s (%u) total=%u", __get_str(filename), REC->mode, __print_flags(REC->flags, "|", {0x10, "X"}), REC->len, REC->len + REC->mode
+`
+	f, err = ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	want = map[string]string{
+		"filename": "name",
+		"mode":     "perm",
+		"flags":    "f",
+		"len":      "",
+	}
+	for name, label := range want {
+		field, _ := f.FieldByName(name)
+		if field.Label != label {
+			t.Errorf("unexpected label for %s: got:%q want:%q", name, field.Label, label)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+// TraceFS is the mount point of the tracefs file system used to find
+// event formats. On systems where tracefs is only available via debugfs
+// it should be set to "/sys/kernel/debug/tracing".
+var TraceFS = "/sys/kernel/tracing"
+
+// watchInterval is the polling interval for WatchEvents.
+var watchInterval = time.Second
+
+// StructFromEvent returns the format of the tracefs event in the given
+// group, read from the event's format file under TraceFS.
+func StructFromEvent(group, event string, opts ...Option) (*Format, error) {
+	return StructFromFS(os.DirFS(TraceFS), path.Join("events", group, event, "format"), opts...)
+}
+
+// StructFromFS returns the format held in the named file of fsys. For
+// example, the format of a tracefs event may be read using
+//
+//	StructFromFS(os.DirFS("/sys/kernel/tracing"), "events/kprobes/myprobe/format")
+func StructFromFS(fsys fs.FS, name string, opts ...Option) (*Format, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseFormat(f, opts...)
+}
+
+// WatchEvents polls the tracefs events directory for the given group and
+// sends the format of each event not previously seen on the returned
+// channel. Events are identified by their ID. Events whose format cannot
+// be read or parsed, for example because the event was removed while its
+// format was being read, are retried on the next poll. The channel is
+// closed when ctx is cancelled.
+func WatchEvents(ctx context.Context, group string, opts ...Option) (<-chan *Format, error) {
+	fsys := os.DirFS(TraceFS)
+	dir := path.Join("events", group)
+	_, err := fs.Stat(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	c := make(chan *Format)
+	go func() {
+		defer close(c)
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		seen := make(map[uint16]bool)
+		for {
+			for _, f := range newEvents(fsys, dir, seen, opts) {
+				select {
+				case c <- f:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+// newEvents returns the formats of events in the directory, dir, of fsys
+// with IDs that are not in seen, and adds their IDs to seen.
+func newEvents(fsys fs.FS, dir string, seen map[uint16]bool, opts []Option) []*Format {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil
+	}
+	var formats []*Format
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		f, err := StructFromFS(fsys, path.Join(dir, e.Name(), "format"), opts...)
+		if err != nil || seen[f.ID] {
+			continue
+		}
+		seen[f.ID] = true
+		formats = append(formats, f)
+	}
+	return formats
+}
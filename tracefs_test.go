@@ -0,0 +1,140 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func writeEvent(t *testing.T, root, group, event, format string) {
+	t.Helper()
+	dir := filepath.Join(root, "events", group, event)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		t.Fatalf("unexpected error creating event directory: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "format"), []byte(format), 0o644)
+	if err != nil {
+		t.Fatalf("unexpected error writing format: %v", err)
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	root := t.TempDir()
+	defer func(path string, interval time.Duration) {
+		TraceFS = path
+		watchInterval = interval
+	}(TraceFS, watchInterval)
+	TraceFS = root
+	watchInterval = 10 * time.Millisecond
+
+	writeEvent(t, root, "kprobes", "do_sys_open_test", unpackTests[0].format)
+	// An event directory without a format file, as seen when a
+	// probe is removed while the directory is being read.
+	err := os.MkdirAll(filepath.Join(root, "events", "kprobes", "removed"), 0o755)
+	if err != nil {
+		t.Fatalf("unexpected error creating event directory: %v", err)
+	}
+
+	f, err := StructFromEvent("kprobes", "do_sys_open_test")
+	if err != nil {
+		t.Fatalf("unexpected error reading event: %v", err)
+	}
+	if f.Name != "do_sys_open_test" || f.ID != 7021 {
+		t.Errorf("unexpected event: name=%s id=%d", f.Name, f.ID)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := WatchEvents(ctx, "kprobes")
+	if err != nil {
+		t.Fatalf("unexpected error watching events: %v", err)
+	}
+	recv := func() *Format {
+		t.Helper()
+		select {
+		case f := <-c:
+			return f
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for event")
+			return nil
+		}
+	}
+	if f := recv(); f.Name != "do_sys_open_test" {
+		t.Errorf("unexpected first event: %s", f.Name)
+	}
+
+	writeEvent(t, root, "kprobes", "gvt_command", unpackTests[1].format)
+	if f := recv(); f.Name != "gvt_command" {
+		t.Errorf("unexpected second event: %s", f.Name)
+	}
+
+	// A new event directory with a previously seen ID is not sent.
+	writeEvent(t, root, "kprobes", "duplicate", strings.Replace(unpackTests[0].format, "do_sys_open_test", "duplicate", 1))
+	select {
+	case f := <-c:
+		t.Errorf("unexpected event for seen ID: %s", f.Name)
+	case <-time.After(5 * watchInterval):
+	}
+
+	cancel()
+	for range c {
+	}
+
+	_, err = WatchEvents(context.Background(), "missing")
+	if err == nil {
+		t.Error("expected error for missing group")
+	}
+}
+
+func TestStructFromFS(t *testing.T) {
+	tests := unpackTests[:2]
+	fsys := fstest.MapFS{
+		"events/kprobes/invalid/format": &fstest.MapFile{Data: []byte("name: invalid\nID: 0x10000\n")},
+	}
+	for _, test := range tests {
+		fsys["events/kprobes/"+test.name+"/format"] = &fstest.MapFile{Data: []byte(test.format)}
+	}
+	for _, test := range tests {
+		f, err := StructFromFS(fsys, "events/kprobes/"+test.name+"/format")
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.name, err)
+			continue
+		}
+		want, err := ParseFormat(strings.NewReader(test.format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(f, want) {
+			t.Errorf("unexpected format for %s:\ngot: %#v\nwant:%#v", test.name, f, want)
+		}
+	}
+	_, err := StructFromFS(fsys, "events/kprobes/missing/format")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("unexpected error for missing format: %v", err)
+	}
+	_, err = StructFromFS(fsys, "events/kprobes/invalid/format")
+	if err == nil {
+		t.Error("expected error for invalid format")
+	}
+
+	seen := make(map[uint16]bool)
+	got := newEvents(fsys, "events/kprobes", seen, nil)
+	if len(got) != len(tests) {
+		t.Errorf("unexpected number of new events: got:%d want:%d", len(got), len(tests))
+	}
+	if got := newEvents(fsys, "events/kprobes", seen, nil); len(got) != 0 {
+		t.Errorf("unexpected repeated events: %d", len(got))
+	}
+}
@@ -0,0 +1,441 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Unpacker is a kprobe event handler that unpacks events for a set of
+// registered event formats, dispatching on the common_type field of each
+// event. It is safe for concurrent use.
+type Unpacker struct {
+	opts []Option
+
+	// allowShort is whether the AllowShort
+	// option is included in opts.
+	allowShort bool
+
+	// alwaysUnpack is whether events must be
+	// unpacked because of per-field byte order
+	// options in opts.
+	alwaysUnpack bool
+
+	// interned is the table of interned dynamic
+	// char array values. It is nil if interning
+	// is not enabled.
+	interned *internTable
+
+	mu sync.RWMutex
+	// typeOffset and typeSize are the offset and size of
+	// the common_type field in events. They are determined
+	// by the first registered format, and typeOffset is -1
+	// until then.
+	typeOffset int
+	typeSize   int
+	order      binary.ByteOrder
+	formats    map[uint16]*Format
+
+	// last holds the *Format of the most recently
+	// unpacked event, avoiding a map lookup for runs of
+	// events of the same type. It is stored while
+	// holding the read lock and is cleared while
+	// holding the write lock whenever formats changes.
+	last atomic.Value // *Format
+
+	// stats holds the decoding counters if
+	// collection has been enabled.
+	stats *Stats
+}
+
+// Stats holds counters describing the events decoded by an Unpacker.
+type Stats struct {
+	// Events is the number of events successfully
+	// decoded and Bytes is the total length of their
+	// event data.
+	Events uint64
+	Bytes  uint64
+
+	// FastPath is the number of events returned as
+	// a value aliasing the event data, and SlowPath is
+	// the number of events unpacked into a new value.
+	FastPath uint64
+	SlowPath uint64
+
+	// DynamicArrayAllocs is the number of non-empty
+	// dynamic arrays unpacked into newly allocated
+	// slices rather than aliasing the event data.
+	DynamicArrayAllocs uint64
+}
+
+// NewUnpacker returns a new Unpacker. The provided options are used for
+// parsing registered formats and unpacking events.
+func NewUnpacker(opts ...Option) *Unpacker {
+	// Errors in the options are reported by Register.
+	cfg, _ := newConfig(opts)
+	u := &Unpacker{
+		opts:         opts,
+		allowShort:   cfg.allowShort,
+		alwaysUnpack: len(cfg.fieldOrders) != 0,
+		typeOffset:   -1,
+		formats:      make(map[uint16]*Format),
+	}
+	if cfg.internSize > 0 {
+		u.interned = newInternTable(cfg.internSize)
+	}
+	return u
+}
+
+// EnableStats enables collection of decoding counters for u. Counters are
+// not collected unless EnableStats has been called, avoiding their cost in
+// the decoding path.
+func (u *Unpacker) EnableStats() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.stats == nil {
+		u.stats = &Stats{}
+	}
+}
+
+// Stats returns a snapshot of the decoding counters of u. The returned
+// counters are all zero if EnableStats has not been called.
+func (u *Unpacker) Stats() Stats {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if u.stats == nil {
+		return Stats{}
+	}
+	return Stats{
+		Events:             atomic.LoadUint64(&u.stats.Events),
+		Bytes:              atomic.LoadUint64(&u.stats.Bytes),
+		FastPath:           atomic.LoadUint64(&u.stats.FastPath),
+		SlowPath:           atomic.LoadUint64(&u.stats.SlowPath),
+		DynamicArrayAllocs: atomic.LoadUint64(&u.stats.DynamicArrayAllocs),
+	}
+}
+
+// Register registers a kprobe event format and returns the event's name.
+// The location and size of the common_type field used to identify events
+// are taken from the format's field with the C name common_type, which must
+// be a 1, 2, 4 or 8 byte field with the same offset and size in all formats
+// registered with u.
+//
+// Registering a format with the ID of a registered event replaces the
+// registered format if the two formats have the same name and compatible
+// layouts. Otherwise Register returns an error and the registered format
+// is retained, since event IDs may be reused for different events when
+// probes are removed and recreated. Use Replace to register a format in
+// place of an incompatible registered format.
+func (u *Unpacker) Register(format io.Reader) (name string, err error) {
+	return u.register(format, false)
+}
+
+// Replace is like Register, but replaces any format registered with the
+// same ID, whether or not it is compatible.
+func (u *Unpacker) Replace(format io.Reader) (name string, err error) {
+	return u.register(format, true)
+}
+
+func (u *Unpacker) register(format io.Reader, replace bool) (name string, err error) {
+	cfg, err := newConfig(u.opts)
+	if err != nil {
+		return "", err
+	}
+	f, err := ParseFormat(format, u.opts...)
+	if err != nil {
+		return "", err
+	}
+	typ, err := f.commonType()
+	if err != nil {
+		return "", err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.typeOffset < 0 {
+		u.typeOffset = typ.Offset
+		u.typeSize = typ.Size
+		u.order = cfg.byteOrder()
+	} else if typ.Offset != u.typeOffset {
+		return "", fmt.Errorf("inconsistent common_type offset in format for %s: %d != %d", f.Name, typ.Offset, u.typeOffset)
+	} else if typ.Size != u.typeSize {
+		return "", fmt.Errorf("inconsistent common_type size in format for %s: %d != %d", f.Name, typ.Size, u.typeSize)
+	}
+	if prev, ok := u.formats[f.ID]; ok && !replace {
+		if prev.Name != f.Name {
+			return "", fmt.Errorf("event id=%d is registered for %s: cannot register %s", f.ID, prev.Name, f.Name)
+		}
+		if ok, diffs := Compatible(prev, f); !ok {
+			return "", fmt.Errorf("incompatible format for registered event %s id=%d: %s", f.Name, f.ID, strings.Join(diffs, "; "))
+		}
+	}
+	u.formats[f.ID] = f
+	u.last.Store((*Format)(nil))
+	return f.Name, nil
+}
+
+// Reset removes all registered formats from u, allowing u to be reused
+// with a new set of formats, which need not have the same common_type
+// location as the removed formats. Decoding counters and any interned
+// strings are retained.
+func (u *Unpacker) Reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.typeOffset = -1
+	u.typeSize = 0
+	u.order = nil
+	u.formats = make(map[uint16]*Format)
+	u.last.Store((*Format)(nil))
+}
+
+// RegisteredEvent describes an event format registered with an Unpacker.
+type RegisteredEvent struct {
+	ID   uint16
+	Name string
+}
+
+// Registered returns the IDs and names of the event formats registered
+// with u, sorted by ID. It is safe to call concurrently with Register and
+// Unpack.
+func (u *Unpacker) Registered() []RegisteredEvent {
+	u.mu.RLock()
+	events := make([]RegisteredEvent, 0, len(u.formats))
+	for id, f := range u.formats {
+		events = append(events, RegisteredEvent{ID: id, Name: f.Name})
+	}
+	u.mu.RUnlock()
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+	return events
+}
+
+// Unpack parses the provided data and returns the name of the event and
+// a pointer to a struct holding the event details. Events with a layout
+// consistent with the Go struct type alias data and the struct fields are
+// not valid after the next write to data. Dynamic arrays of other events
+// may also alias data. If u was created with the AllowShort option, events
+// shorter than their fixed record size are decoded as described for
+// AllowShort. If u was created with the InternStrings option, dynamic char
+// array fields may share their backing array with other events and must
+// be treated as read-only.
+//
+// Events that are unpacked into a new value are unpacked into a value drawn
+// from the DestPool of the event's format. Callers that have finished with
+// an event may return it to the pool with PutDest to reduce allocation. If
+// unpacking fails for a reason other than a short record allowed by
+// AllowShort, the value is returned to the pool and the zero reflect.Value
+// is returned with the name of the event and the error.
+func (u *Unpacker) Unpack(data []byte) (string, reflect.Value, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if u.typeOffset < 0 {
+		return "", reflect.Value{}, fmt.Errorf("no registered formats")
+	}
+	if len(data) < u.typeOffset+u.typeSize {
+		return "", reflect.Value{}, io.ErrUnexpectedEOF
+	}
+	typ := decodeUint(data[u.typeOffset:], u.typeSize, u.order)
+	f, _ := u.last.Load().(*Format)
+	if f == nil || uint64(f.ID) != typ {
+		ok := typ <= math.MaxUint16
+		if ok {
+			f, ok = u.formats[uint16(typ)]
+		}
+		if !ok {
+			return "", reflect.Value{}, fmt.Errorf("no unpacker for event id=%d", typ)
+		}
+		u.last.Store(f)
+	}
+	short := len(data) < f.Size
+	if !f.NeedsUnpack() && !u.alwaysUnpack && !(short && u.allowShort) {
+		if short {
+			return "", reflect.Value{}, &DataError{Len: f.Size, Size: len(data)}
+		}
+		// Fast path with layout consistent between kprobe
+		// event and Go struct.
+		if u.stats != nil {
+			atomic.AddUint64(&u.stats.Events, 1)
+			atomic.AddUint64(&u.stats.Bytes, uint64(len(data)))
+			atomic.AddUint64(&u.stats.FastPath, 1)
+		}
+		if len(data) == 0 {
+			// There is no data to alias for
+			// empty records.
+			return f.Name, reflect.New(f.Type), nil
+		}
+		return f.Name, reflect.NewAt(f.Type, unsafe.Pointer(&data[0])), nil
+	}
+	// Slow path with either unaligned fields, dynamic arrays,
+	// per-field byte orders or a short record.
+	dst := reflect.ValueOf(DestPool(f).Get())
+	err := f.Unpack(dst, data, u.opts...)
+	if err != nil {
+		var truncated *TruncatedError
+		if errors.As(err, &truncated) {
+			// Partially decoded short records are
+			// returned with the error.
+			return f.Name, dst, err
+		}
+		// The partially unpacked value is not returned,
+		// so it can be reused.
+		DestPool(f).Put(dst.Interface())
+		return f.Name, reflect.Value{}, err
+	}
+	if u.interned != nil {
+		u.interned.internFields(f, dst)
+	}
+	if u.stats != nil {
+		atomic.AddUint64(&u.stats.Events, 1)
+		atomic.AddUint64(&u.stats.Bytes, uint64(len(data)))
+		atomic.AddUint64(&u.stats.SlowPath, 1)
+		if n := dynamicAllocs(f, dst, data); n != 0 {
+			atomic.AddUint64(&u.stats.DynamicArrayAllocs, n)
+		}
+	}
+	return f.Name, dst, nil
+}
+
+// destPools holds the destination value pools for unpacked struct types.
+var destPools sync.Map // map[reflect.Type]*sync.Pool
+
+// DestPool returns a pool of destination values for unpacking events of f.
+// Values obtained from the pool are interface{} values holding a pointer to
+// a struct of f's Unpacked type, suitable for passing to f.Unpack after
+// conversion with reflect.ValueOf. The same pool is returned for all formats
+// with the same Unpacked type and is used by Unpacker for events unpacked
+// on its slow path. Values from the pool may hold the fields of a previous
+// event, but are fully overwritten when an event is unpacked into them.
+func DestPool(f *Format) *sync.Pool {
+	if p, ok := destPools.Load(f.Unpacked); ok {
+		return p.(*sync.Pool)
+	}
+	typ := f.Unpacked
+	p, _ := destPools.LoadOrStore(typ, &sync.Pool{
+		New: func() interface{} {
+			return reflect.New(typ).Interface()
+		},
+	})
+	return p.(*sync.Pool)
+}
+
+// PutDest returns the unpacked event value v of f to the DestPool of f for
+// reuse. The value must not be used after it has been returned. Values that
+// are not pointers to f's Unpacked type are not added to the pool. Values of
+// formats whose Type and Unpacked types are identical are also not added,
+// since values returned by Unpacker.Unpack for those formats may alias the
+// event data.
+func PutDest(f *Format, v reflect.Value) {
+	if f.Type == f.Unpacked || v.Kind() != reflect.Ptr || v.Type().Elem() != f.Unpacked || v.IsNil() {
+		return
+	}
+	DestPool(f).Put(v.Interface())
+}
+
+// dynamicAllocs returns the number of non-empty dynamic array fields of the
+// unpacked value dst that do not alias data.
+func dynamicAllocs(f *Format, dst reflect.Value, data []byte) uint64 {
+	if !f.Unaligned.DynamicArray {
+		return 0
+	}
+	start := uintptr(unsafe.Pointer(&data[0]))
+	end := start + uintptr(len(data))
+	var n uint64
+	for _, field := range f.Fields {
+		if _, ok := dynamicElement(field.CType); !ok || field.Index == nil {
+			continue
+		}
+		v := dst.Elem().FieldByIndex(field.Index)
+		if v.Kind() != reflect.Slice || v.Len() == 0 {
+			continue
+		}
+		if p := v.Pointer(); p < start || end <= p {
+			n++
+		}
+	}
+	return n
+}
+
+// internTable is a size-bounded table of interned byte slices with least
+// recently used eviction. The values held by the table are shared by all
+// the events carrying them.
+type internTable struct {
+	mu     sync.Mutex
+	size   int
+	lru    *list.List // lru holds the table's *internEntry values, most recently used first.
+	values map[string]*list.Element
+}
+
+func newInternTable(size int) *internTable {
+	return &internTable{
+		size:   size,
+		lru:    list.New(),
+		values: make(map[string]*list.Element),
+	}
+}
+
+// internFields replaces the non-empty dynamic char array fields of the
+// unpacked value dst of f with interned copies.
+func (t *internTable) internFields(f *Format, dst reflect.Value) {
+	for _, field := range f.Fields {
+		if elem, ok := dynamicElement(field.CType); !ok || strings.TrimLeft(elem, "_") != "char[]" || field.Index == nil {
+			continue
+		}
+		v := dst.Elem().FieldByIndex(field.Index)
+		if v.Kind() != reflect.Slice || v.Len() == 0 {
+			continue
+		}
+		v.SetBytes(t.intern(v.Bytes()))
+	}
+}
+
+// internEntry is an interned value and the string it was interned for.
+type internEntry struct {
+	key string
+	val []byte
+}
+
+// intern returns the interned copy of b, adding it to the table if it is
+// not already held. Interned values are shared between events and must not
+// be modified, but a value that has been modified is replaced by a fresh
+// copy so the modification is not seen by later events.
+func (t *internTable) intern(b []byte) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.values[string(b)]; ok {
+		t.lru.MoveToFront(e)
+		entry := e.Value.(*internEntry)
+		if string(entry.val) != entry.key {
+			entry.val = readOnlyCopy(b)
+		}
+		return entry.val
+	}
+	if t.lru.Len() >= t.size {
+		e := t.lru.Back()
+		t.lru.Remove(e)
+		delete(t.values, e.Value.(*internEntry).key)
+	}
+	entry := &internEntry{key: string(b), val: readOnlyCopy(b)}
+	t.values[entry.key] = t.lru.PushFront(entry)
+	return entry.val
+}
+
+// readOnlyCopy returns a copy of b with its capacity limited to its length
+// so appends by the caller cannot write into the shared value.
+func readOnlyCopy(b []byte) []byte {
+	v := append([]byte(nil), b...)
+	return v[:len(v):len(v)]
+}
@@ -0,0 +1,705 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUnpackerTypeOffset(t *testing.T) {
+	const format = `name: raw_synth
+ID: 812
+format:
+	field:u32 seq;	offset:0;	size:4;	signed:0;
+	field:unsigned short common_type;	offset:4;	size:2;	signed:0;
+	field:u16 cpu;	offset:6;	size:2;	signed:0;
+	field:u64 value;	offset:8;	size:8;	signed:0;
+`
+	u := NewUnpacker()
+	name, err := u.Register(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	if name != "raw_synth" {
+		t.Errorf("unexpected name: got:%q want:%q", name, "raw_synth")
+	}
+
+	data := make([]byte, 16)
+	machine.PutUint32(data[0:], 7)
+	machine.PutUint16(data[4:], 812)
+	machine.PutUint16(data[6:], 3)
+	machine.PutUint64(data[8:], 0xdeadbeef)
+	name, v, err := u.Unpack(data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if name != "raw_synth" {
+		t.Errorf("unexpected name: got:%q want:%q", name, "raw_synth")
+	}
+	want := []uint64{7, 812, 3, 0xdeadbeef}
+	v = v.Elem()
+	for i, w := range want {
+		if got := v.Field(i).Uint(); got != w {
+			t.Errorf("unexpected value for field %d: got:%d want:%d", i, got, w)
+		}
+	}
+
+	const inconsistent = `name: other
+ID: 813
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:u16 cpu;	offset:2;	size:2;	signed:0;
+`
+	_, err = u.Register(strings.NewReader(inconsistent))
+	if err == nil {
+		t.Error("expected error for inconsistent common_type offset")
+	}
+}
+
+func TestUnpackerNoCommonType(t *testing.T) {
+	const format = `name: headerless
+ID: 814
+format:
+	field:u32 seq;	offset:0;	size:4;	signed:0;
+	field:u64 value;	offset:8;	size:8;	signed:0;
+`
+	u := NewUnpacker()
+	_, err := u.Register(strings.NewReader(format))
+	want := "no common_type field in format for headerless"
+	if err == nil || err.Error() != want {
+		t.Errorf("unexpected error: got:%v want:%s", err, want)
+	}
+	_, v, err := u.Unpack(make([]byte, 16))
+	if err == nil {
+		t.Error("expected error unpacking with no registered formats")
+	}
+	if v != (reflect.Value{}) {
+		t.Errorf("unexpected value: %v", v)
+	}
+}
+
+func TestUnpackerStats(t *testing.T) {
+	const (
+		fixed = `name: fixed
+ID: 820
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:u16 cpu;	offset:2;	size:2;	signed:0;
+	field:u32 value;	offset:4;	size:4;	signed:0;
+`
+		dynamic = `name: dynamic
+ID: 821
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:__data_loc u16[] vals;	offset:4;	size:4;	signed:0;
+	field:__data_loc char[] name;	offset:8;	size:4;	signed:1;
+`
+	)
+	// Use the opposite of the host byte order so that multi-byte
+	// dynamic arrays are decoded into new slices. All events are
+	// then unpacked on the slow path.
+	var order binary.ByteOrder = binary.BigEndian
+	if machine == binary.BigEndian {
+		order = binary.LittleEndian
+	}
+	u := NewUnpacker(ByteOrder(order))
+	for _, format := range []string{fixed, dynamic} {
+		_, err := u.Register(strings.NewReader(format))
+		if err != nil {
+			t.Fatalf("unexpected error registering format: %v", err)
+		}
+	}
+
+	fixedData := make([]byte, 8)
+	order.PutUint16(fixedData, 820)
+	dynamicData := make([]byte, 20)
+	order.PutUint16(dynamicData, 821)
+	order.PutUint32(dynamicData[4:], 4<<16|12)
+	order.PutUint32(dynamicData[8:], 4<<16|16)
+	copy(dynamicData[16:], "abc\x00")
+
+	// Counters are not collected until enabled.
+	_, _, err := u.Unpack(fixedData)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if got := u.Stats(); got != (Stats{}) {
+		t.Errorf("unexpected stats before enabling: %+v", got)
+	}
+
+	u.EnableStats()
+	for _, data := range [][]byte{fixedData, fixedData, dynamicData, {0, 0}} {
+		u.Unpack(data)
+	}
+	want := Stats{
+		Events:             3,
+		Bytes:              8 + 8 + 20,
+		SlowPath:           3,
+		DynamicArrayAllocs: 1,
+	}
+	if got := u.Stats(); got != want {
+		t.Errorf("unexpected stats:\ngot: %+v\nwant:%+v", got, want)
+	}
+
+	// Events in host byte order without dynamic arrays alias
+	// the event data.
+	u = NewUnpacker()
+	_, err = u.Register(strings.NewReader(fixed))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	u.EnableStats()
+	machine.PutUint16(fixedData, 820)
+	for _, data := range [][]byte{fixedData, fixedData} {
+		u.Unpack(data)
+	}
+	want = Stats{
+		Events:   2,
+		Bytes:    8 + 8,
+		FastPath: 2,
+	}
+	if got := u.Stats(); got != want {
+		t.Errorf("unexpected stats for host order:\ngot: %+v\nwant:%+v", got, want)
+	}
+}
+
+func TestUnpackerRegistered(t *testing.T) {
+	u := NewUnpacker()
+	if got := u.Registered(); len(got) != 0 {
+		t.Errorf("unexpected registered events for new unpacker: %v", got)
+	}
+	for _, format := range []string{unpackTests[0].format, unpackTests[1].format, sysReadFormat} {
+		_, err := u.Register(strings.NewReader(format))
+		if err != nil {
+			t.Fatalf("unexpected error registering format: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			u.Unpack(unpackTests[0].data)
+		}
+	}()
+	got := u.Registered()
+	wg.Wait()
+
+	want := []RegisteredEvent{
+		{ID: 2034, Name: "gvt_command"},
+		{ID: 7021, Name: "do_sys_open_test"},
+		{ID: 7022, Name: "sys_read_test"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected registered events:\ngot: %v\nwant:%v", got, want)
+	}
+}
+
+func TestUnpackerCommonTypeSize(t *testing.T) {
+	const format = `name: wide_type
+ID: 815
+format:
+	field:u64 seq;	offset:0;	size:8;	signed:0;
+	field:unsigned int common_type;	offset:8;	size:4;	signed:0;
+	field:u32 value;	offset:12;	size:4;	signed:0;
+`
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		u := NewUnpacker(ByteOrder(order))
+		_, err := u.Register(strings.NewReader(format))
+		if err != nil {
+			t.Fatalf("unexpected error registering format: %v", err)
+		}
+		f, _ := ParseFormat(strings.NewReader(format), ByteOrder(order))
+
+		data := make([]byte, 16)
+		order.PutUint32(data[8:], 815)
+		id, err := f.CommonType(data)
+		if err != nil || id != 815 {
+			t.Errorf("unexpected common type for %v: got:%d want:815 err:%v", order, id, err)
+		}
+		name, _, err := u.Unpack(data)
+		if err != nil {
+			t.Errorf("unexpected error unpacking for %v: %v", order, err)
+		}
+		if name != "wide_type" {
+			t.Errorf("unexpected name for %v: got:%q want:%q", order, name, "wide_type")
+		}
+
+		// Values that do not fit in an event ID are not
+		// truncated to match a registered event.
+		order.PutUint32(data[8:], 1<<16|815)
+		_, err = f.CommonType(data)
+		if err == nil {
+			t.Errorf("expected error for out of range common type for %v", order)
+		}
+		_, _, err = u.Unpack(data)
+		if err == nil {
+			t.Errorf("expected error unpacking out of range common type for %v", order)
+		}
+	}
+
+	u := NewUnpacker()
+	_, err := u.Register(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	const inconsistent = `name: narrow_type
+ID: 816
+format:
+	field:u64 seq;	offset:0;	size:8;	signed:0;
+	field:unsigned short common_type;	offset:8;	size:2;	signed:0;
+	field:u16 value;	offset:10;	size:2;	signed:0;
+`
+	_, err = u.Register(strings.NewReader(inconsistent))
+	if err == nil {
+		t.Error("expected error for inconsistent common_type size")
+	}
+
+	const invalid = `name: odd_type
+ID: 817
+format:
+	field:u8 common_type[3];	offset:0;	size:3;	signed:0;
+`
+	_, err = NewUnpacker().Register(strings.NewReader(invalid))
+	if err == nil {
+		t.Error("expected error for invalid common_type size")
+	}
+}
+
+const internFormat = `name: intern
+ID: 822
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:__data_loc char[] name;	offset:4;	size:4;	signed:1;
+`
+
+// internEvent returns an intern format event holding name.
+func internEvent(name string) []byte {
+	data := make([]byte, 8+len(name))
+	machine.PutUint16(data, 822)
+	machine.PutUint32(data[4:], uint32(len(name))<<16|8)
+	copy(data[8:], name)
+	return data
+}
+
+func TestUnpackerInternStrings(t *testing.T) {
+	u := NewUnpacker(InternStrings(2))
+	_, err := u.Register(strings.NewReader(internFormat))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	name := func(data []byte) []byte {
+		_, v, err := u.Unpack(data)
+		if err != nil {
+			t.Fatalf("unexpected error unpacking: %v", err)
+		}
+		f, ok := fieldByCName(v, "name")
+		if !ok {
+			t.Fatal("missing name field")
+		}
+		return f.Bytes()
+	}
+
+	first := internEvent("/etc/passwd\x00")
+	a := name(first)
+	b := name(internEvent("/etc/passwd\x00"))
+	if &a[0] != &b[0] {
+		t.Error("expected shared value for repeated string")
+	}
+	if &a[0] == &first[8] {
+		t.Error("unexpected aliasing of event data")
+	}
+	if cap(a) != len(a) {
+		t.Errorf("unexpected capacity of interned value: got:%d want:%d", cap(a), len(a))
+	}
+	for i := range first {
+		first[i] = 0xff
+	}
+	if string(a) != "/etc/passwd\x00" {
+		t.Errorf("unexpected value after overwriting data: %q", a)
+	}
+
+	// Filling the table evicts the least recently used value.
+	name(internEvent("/tmp/a\x00"))
+	name(internEvent("/tmp/b\x00"))
+	c := name(internEvent("/etc/passwd\x00"))
+	if &a[0] == &c[0] {
+		t.Error("expected evicted value to be reinterned")
+	}
+	if string(c) != "/etc/passwd\x00" {
+		t.Errorf("unexpected reinterned value: %q", c)
+	}
+
+	// Interned values are read-only, but a modified value is
+	// not handed to later events.
+	c[0] = 'X'
+	d := name(internEvent("/etc/passwd\x00"))
+	if string(d) != "/etc/passwd\x00" {
+		t.Errorf("unexpected value after modifying interned value: %q", d)
+	}
+	e := name(internEvent("/etc/passwd\x00"))
+	if &d[0] != &e[0] {
+		t.Error("expected shared value for repeated string after replacement")
+	}
+	_ = append(e, "/x"...)
+	if f := name(internEvent("/etc/passwd\x00")); &f[0] != &e[0] || string(f) != "/etc/passwd\x00" {
+		t.Errorf("unexpected value after appending to interned value: %q", f)
+	}
+
+	// Events that fail to unpack are not returned or interned.
+	bad := internEvent("/tmp/c\x00")
+	machine.PutUint32(bad[4:], 64<<16|8)
+	_, v, err := u.Unpack(bad)
+	if err == nil {
+		t.Fatal("expected error for corrupt data location")
+	}
+	if v.IsValid() {
+		t.Errorf("unexpected value returned with error: %#v", v)
+	}
+	if got := u.interned.lru.Len(); got != 2 {
+		t.Errorf("unexpected intern table length after error: got:%d want:2", got)
+	}
+}
+
+func BenchmarkUnpackerInternStrings(b *testing.B) {
+	events := [][]byte{
+		internEvent("/usr/lib/x86_64-linux-gnu/libc.so.6\x00"),
+		internEvent("/etc/ld.so.cache\x00"),
+		internEvent("/proc/self/status\x00"),
+	}
+	for _, bench := range []struct {
+		name string
+		opts []Option
+	}{
+		// Without interning, retained events must be
+		// detached from the event data with Clone.
+		{name: "clone"},
+		{name: "intern", opts: []Option{InternStrings(16)}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			u := NewUnpacker(bench.opts...)
+			_, err := u.Register(strings.NewReader(internFormat))
+			if err != nil {
+				b.Fatalf("unexpected error registering format: %v", err)
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, v, err := u.Unpack(events[i%len(events)])
+				if err != nil {
+					b.Fatalf("unexpected error unpacking: %v", err)
+				}
+				if bench.opts == nil {
+					v = Clone(v)
+				}
+				_ = v
+			}
+		})
+	}
+}
+
+func TestUnpackerReplace(t *testing.T) {
+	const (
+		before = `name: churn
+ID: 830
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:u16 cpu;	offset:2;	size:2;	signed:0;
+	field:u32 value;	offset:4;	size:4;	signed:0;
+`
+		// after reuses the ID of before with a different layout.
+		after = `name: churn
+ID: 830
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:u16 cpu;	offset:2;	size:2;	signed:0;
+	field:u64 value;	offset:8;	size:8;	signed:0;
+`
+		// other reuses the ID of before for a different event.
+		other = `name: other_churn
+ID: 830
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:u16 cpu;	offset:2;	size:2;	signed:0;
+	field:u32 value;	offset:4;	size:4;	signed:0;
+`
+	)
+	u := NewUnpacker()
+	_, err := u.Register(strings.NewReader(before))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	// Re-registering a compatible format is allowed.
+	_, err = u.Register(strings.NewReader(before))
+	if err != nil {
+		t.Errorf("unexpected error re-registering format: %v", err)
+	}
+	for _, format := range []string{after, other} {
+		_, err = u.Register(strings.NewReader(format))
+		if err == nil {
+			t.Error("expected error registering incompatible format with the same ID")
+		}
+	}
+
+	data := make([]byte, 16)
+	machine.PutUint16(data, 830)
+	machine.PutUint32(data[4:], 1)
+	machine.PutUint64(data[8:], 2)
+	value := func() uint64 {
+		_, v, err := u.Unpack(data)
+		if err != nil {
+			t.Fatalf("unexpected error unpacking: %v", err)
+		}
+		f, ok := fieldByCName(v, "value")
+		if !ok {
+			t.Fatal("missing value field")
+		}
+		return f.Uint()
+	}
+	if got := value(); got != 1 {
+		t.Errorf("unexpected value with original format: got:%d want:1", got)
+	}
+
+	name, err := u.Replace(strings.NewReader(after))
+	if err != nil {
+		t.Fatalf("unexpected error replacing format: %v", err)
+	}
+	if name != "churn" {
+		t.Errorf("unexpected name: got:%q want:%q", name, "churn")
+	}
+	if got := value(); got != 2 {
+		t.Errorf("unexpected value with replacement format: got:%d want:2", got)
+	}
+}
+
+func TestUnpackerReset(t *testing.T) {
+	u := NewUnpacker()
+	_, err := u.Register(strings.NewReader(unpackTests[0].format))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	data := append([]byte(nil), unpackTests[0].data...)
+	machine.PutUint16(data, 7021)
+	_, _, err = u.Unpack(data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+
+	u.Reset()
+	if got := u.Registered(); len(got) != 0 {
+		t.Errorf("unexpected registered events after reset: %v", got)
+	}
+	_, _, err = u.Unpack(data)
+	if err == nil {
+		t.Error("expected error unpacking after reset")
+	}
+
+	// The unpacker is usable with a format with a different
+	// common_type location after reset.
+	const format = `name: raw_synth
+ID: 812
+format:
+	field:u32 seq;	offset:0;	size:4;	signed:0;
+	field:unsigned short common_type;	offset:4;	size:2;	signed:0;
+`
+	_, err = u.Register(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error registering format after reset: %v", err)
+	}
+	data = make([]byte, 8)
+	machine.PutUint16(data[4:], 812)
+	name, _, err := u.Unpack(data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking after reset: %v", err)
+	}
+	if name != "raw_synth" {
+		t.Errorf("unexpected name: got:%q want:%q", name, "raw_synth")
+	}
+}
+
+func TestDestPool(t *testing.T) {
+	parse := func() *Format {
+		t.Helper()
+		f, err := ParseFormat(strings.NewReader(unpackTests[1].format))
+		if err != nil {
+			t.Fatalf("unexpected error parsing format: %v", err)
+		}
+		return f
+	}
+	f := parse()
+	if DestPool(f) != DestPool(parse()) {
+		t.Error("unexpected distinct pools for formats with the same unpacked type")
+	}
+
+	withArray := append([]byte(nil), unpackTests[1].data...)
+	machine.PutUint16(withArray, 2034)
+	withArray[8] = 1
+	empty := append([]byte(nil), withArray[:f.Size]...)
+	machine.PutUint32(empty[40:], 0)
+	empty[8] = 2
+
+	// Pooled values must be fully overwritten when reused.
+	dst := reflect.ValueOf(DestPool(f).Get())
+	if dst.Type() != reflect.PtrTo(f.Unpacked) {
+		t.Fatalf("unexpected pooled value type: %s", dst.Type())
+	}
+	err := f.Unpack(dst, withArray)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	err = f.Unpack(dst, empty)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	want := reflect.New(f.Unpacked)
+	err = f.Unpack(want, empty)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	if !reflect.DeepEqual(dst.Interface(), want.Interface()) {
+		t.Errorf("unexpected reused value:\ngot: %#v\nwant:%#v", dst.Elem(), want.Elem())
+	}
+	PutDest(f, dst)
+
+	u := NewUnpacker()
+	_, err = u.Register(strings.NewReader(unpackTests[1].format))
+	if err != nil {
+		t.Fatalf("unexpected error registering format: %v", err)
+	}
+	for i, data := range [][]byte{withArray, empty, withArray} {
+		_, v, err := u.Unpack(data)
+		if err != nil {
+			t.Fatalf("unexpected error unpacking event %d: %v", i, err)
+		}
+		want := reflect.New(f.Unpacked)
+		err = f.Unpack(want, data)
+		if err != nil {
+			t.Fatalf("unexpected error unpacking event %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(v.Interface(), want.Interface()) {
+			t.Errorf("unexpected value for event %d:\ngot: %#v\nwant:%#v", i, v.Elem(), want.Elem())
+		}
+		PutDest(f, v)
+	}
+}
+
+func BenchmarkUnpackerDestPool(b *testing.B) {
+	data := append([]byte(nil), unpackTests[1].data...)
+	machine.PutUint16(data, 2034)
+	f, err := ParseFormat(strings.NewReader(unpackTests[1].format))
+	if err != nil {
+		b.Fatalf("unexpected error parsing format: %v", err)
+	}
+	for _, bench := range []struct {
+		name string
+		put  bool
+	}{
+		{name: "new"},
+		{name: "pool", put: true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			u := NewUnpacker()
+			_, err := u.Register(strings.NewReader(unpackTests[1].format))
+			if err != nil {
+				b.Fatalf("unexpected error registering format: %v", err)
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, v, err := u.Unpack(data)
+				if err != nil {
+					b.Fatalf("unexpected error unpacking: %v", err)
+				}
+				if bench.put {
+					PutDest(f, v)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackerLastFormat(t *testing.T) {
+	u := NewUnpacker()
+	for _, format := range []string{unpackTests[0].format, sysReadFormat} {
+		_, err := u.Register(strings.NewReader(format))
+		if err != nil {
+			t.Fatalf("unexpected error registering format: %v", err)
+		}
+	}
+	open := append([]byte(nil), unpackTests[0].data...)
+	machine.PutUint16(open, 7021)
+	read := make([]byte, 32)
+	machine.PutUint16(read, 7022)
+	unknown := make([]byte, 32)
+	machine.PutUint16(unknown, 7023)
+
+	// Repeated and interleaved event types must each be
+	// dispatched to their own format.
+	for i, test := range []struct {
+		data []byte
+		want string
+	}{
+		{data: open, want: "do_sys_open_test"},
+		{data: open, want: "do_sys_open_test"},
+		{data: read, want: "sys_read_test"},
+		{data: unknown},
+		{data: read, want: "sys_read_test"},
+		{data: open, want: "do_sys_open_test"},
+		{data: unknown},
+	} {
+		name, _, err := u.Unpack(test.data)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("expected error for event %d with unknown id", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error unpacking event %d: %v", i, err)
+			continue
+		}
+		if name != test.want {
+			t.Errorf("unexpected name for event %d: got:%q want:%q", i, name, test.want)
+		}
+	}
+}
+
+func BenchmarkUnpackerSkewed(b *testing.B) {
+	// Both formats are decoded on the fast path so that the
+	// cost of dispatch dominates.
+	writeFormat := strings.NewReplacer("sys_read_test", "sys_write_test", "7022", "7023").Replace(sysReadFormat)
+	read := make([]byte, 32)
+	machine.PutUint16(read, 7022)
+	write := make([]byte, 32)
+	machine.PutUint16(write, 7023)
+	for _, bench := range []struct {
+		name   string
+		events [][]byte
+	}{
+		{name: "single", events: [][]byte{read}},
+		{name: "skewed", events: [][]byte{read, read, read, read, read, read, read, read, read, write}},
+		{name: "alternating", events: [][]byte{read, write}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			u := NewUnpacker()
+			for _, format := range []string{sysReadFormat, writeFormat} {
+				_, err := u.Register(strings.NewReader(format))
+				if err != nil {
+					b.Fatalf("unexpected error registering format: %v", err)
+				}
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, err := u.Unpack(bench.events[i%len(bench.events)])
+				if err != nil {
+					b.Fatalf("unexpected error unpacking: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"encoding/hex"
+	"reflect"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// CStringField returns the NUL-terminated string held in the char array
+// field of the struct v with the C name, field. The array elements may be
+// either int8 or uint8, and dynamic char arrays are also accepted. If the
+// array holds no NUL byte, the complete array is returned. CStringField
+// returns false if v has no char array field with the given name.
+func CStringField(v reflect.Value, field string) (string, bool) {
+	f, ok := fieldByCName(v, field)
+	if !ok {
+		return "", false
+	}
+	return cString(f)
+}
+
+// Encoding is a character encoding used to interpret the bytes of a char
+// array.
+type Encoding int
+
+const (
+	// Latin1 interprets each byte as the Unicode code point
+	// with the same value, as for ISO 8859-1. Any sequence of
+	// bytes is valid.
+	Latin1 Encoding = iota
+
+	// UTF8 interprets the bytes as UTF-8 encoded text.
+	// Invalid UTF-8 is not accepted.
+	UTF8
+)
+
+// CStringFieldEncoding is like CStringField, but interprets the bytes of
+// the string with the given encoding, returning the string as UTF-8 encoded
+// text. The zero Encoding, Latin1, converts each byte to a rune, so bytes
+// with the high bit set are represented as the corresponding Latin-1
+// characters. CStringFieldEncoding returns false if v has no char array
+// field with the given name, or if the bytes of the string are not valid
+// for the encoding.
+func CStringFieldEncoding(v reflect.Value, field string, enc Encoding) (string, bool) {
+	s, ok := CStringField(v, field)
+	if !ok {
+		return "", false
+	}
+	switch enc {
+	case Latin1:
+		r := make([]rune, len(s))
+		for i := 0; i < len(s); i++ {
+			r[i] = rune(s[i])
+		}
+		return string(r), true
+	case UTF8:
+		if !utf8.ValidString(s) {
+			return "", false
+		}
+		return s, true
+	default:
+		return "", false
+	}
+}
+
+// TimeField returns the time held as a count of nanoseconds in the 64 bit
+// integer field of the struct v with the C name, field. The count is taken
+// to be relative to the Unix epoch, as it is for CLOCK_REALTIME. Kernel
+// timestamps are more often taken from CLOCK_MONOTONIC, for example by
+// bpf_ktime_get_ns, or CLOCK_BOOTTIME, which count from an unspecified
+// point near boot; times from these clocks must be adjusted by the caller
+// by the offset of the clock from the Unix epoch, or handled as durations
+// with DurationField. The returned time has no monotonic clock reading.
+// TimeField returns false if v has no 64 bit integer field with the given
+// name.
+func TimeField(v reflect.Value, field string) (time.Time, bool) {
+	ns, ok := nanosecondField(v, field)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// DurationField returns the duration held as a count of nanoseconds in the
+// 64 bit integer field of the struct v with the C name, field. It may be
+// used for latencies, and for timestamps from any clock source where only
+// the interval from the clock's origin is needed. DurationField returns
+// false if v has no 64 bit integer field with the given name.
+func DurationField(v reflect.Value, field string) (time.Duration, bool) {
+	ns, ok := nanosecondField(v, field)
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(ns), true
+}
+
+// RetField returns the return value held in the integer field of the
+// struct v with the C name ret, as conventionally named in kretprobe
+// definitions such as
+//
+//	r:myretprobe do_sys_open ret=$retval
+//
+// Return values are often fetched as unsigned values, so unsigned fields
+// are sign-extended from their width, allowing negative error numbers to
+// be recovered; a ret field of type u32 holding 0xfffffffe is returned as
+// -2. RetField returns false if v has no integer field named ret.
+func RetField(v reflect.Value) (int64, bool) {
+	f, ok := fieldByCName(v, "ret")
+	if !ok {
+		return 0, false
+	}
+	switch f.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return f.Int(), true
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		shift := 64 - 8*f.Type().Size()
+		return int64(f.Uint()<<shift) >> shift, true
+	default:
+		return 0, false
+	}
+}
+
+// HexDumpField returns a hex dump, as formatted by hex.Dump, of the bytes
+// held in the byte array or byte slice field of the struct v with the C
+// name, field. This is useful for inspecting opaque binary payloads such as
+// the __data_loc u8[] buf field of the ath10k_htt_stats event. Elements of
+// the array may be either int8 or uint8. HexDumpField returns false if v has
+// no byte array or byte slice field with the given name.
+func HexDumpField(v reflect.Value, field string) (string, bool) {
+	f, ok := fieldByCName(v, field)
+	if !ok {
+		return "", false
+	}
+	switch f.Kind() {
+	case reflect.Array, reflect.Slice:
+	default:
+		return "", false
+	}
+	switch f.Type().Elem().Kind() {
+	case reflect.Int8, reflect.Uint8:
+	default:
+		return "", false
+	}
+	if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint8 {
+		return hex.Dump(f.Bytes()), true
+	}
+	b := make([]byte, f.Len())
+	for i := range b {
+		c, _ := integerBits(f.Index(i))
+		b[i] = byte(c)
+	}
+	return hex.Dump(b), true
+}
+
+// nanosecondField returns the value of the 64 bit integer field of the
+// struct v with the given C name.
+func nanosecondField(v reflect.Value, field string) (int64, bool) {
+	f, ok := fieldByCName(v, field)
+	if !ok {
+		return 0, false
+	}
+	switch f.Kind() {
+	case reflect.Int64:
+		return f.Int(), true
+	case reflect.Uint64:
+		return int64(f.Uint()), true
+	default:
+		return 0, false
+	}
+}
+
+// fieldByCName returns the field of the struct, or pointer to struct, v with
+// the given C name. Fields of an embedded CommonFields struct are found if
+// v has no direct field with the name.
+func fieldByCName(v reflect.Value, name string) (reflect.Value, bool) {
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	index, ok := cNameIndex(v.Type())[name]
+	if !ok {
+		return reflect.Value{}, false
+	}
+	return v.FieldByIndex(index), true
+}
+
+// cNameIndexes holds the C name to field index maps of struct types.
+var cNameIndexes sync.Map // map[reflect.Type]map[string][]int
+
+// cNameIndex returns a map from the C names in the name field tags of the
+// struct type typ to the index sequence of the first field with the name.
+// The fields of an embedded CommonFields struct are included after the
+// direct fields of typ.
+func cNameIndex(typ reflect.Type) map[string][]int {
+	if m, ok := cNameIndexes.Load(typ); ok {
+		return m.(map[string][]int)
+	}
+	m := make(map[string][]int, typ.NumField())
+	var embedded []int
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous && field.Type == commonFieldsType {
+			embedded = append(embedded, i)
+			continue
+		}
+		name, ok := field.Tag.Lookup("name")
+		if !ok {
+			continue
+		}
+		if _, ok := m[name]; !ok {
+			m[name] = []int{i}
+		}
+	}
+	for _, i := range embedded {
+		for j := 0; j < commonFieldsType.NumField(); j++ {
+			name, ok := commonFieldsType.Field(j).Tag.Lookup("name")
+			if !ok {
+				continue
+			}
+			if _, ok := m[name]; !ok {
+				m[name] = []int{i, j}
+			}
+		}
+	}
+	cNameIndexes.Store(typ, m)
+	return m
+}
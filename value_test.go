@@ -0,0 +1,328 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kprobe
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+var cStringFieldTests = []struct {
+	name   string
+	v      interface{}
+	field  string
+	want   string
+	wantOK bool
+}{
+	{
+		name: "int8 terminated",
+		v: &struct {
+			Cmd_name [8]int8 `ctyp:"char[8]" name:"cmd_name"`
+		}{Cmd_name: [8]int8{'M', 'I', '_', 'N', 'O', 'O', 'P', 0}},
+		field:  "cmd_name",
+		want:   "MI_NOOP",
+		wantOK: true,
+	},
+	{
+		name: "uint8 terminated",
+		v: struct {
+			Cmd_name [8]uint8 `ctyp:"char[8]" name:"cmd_name"`
+		}{Cmd_name: [8]uint8{'a', 'b', 0, 'c'}},
+		field:  "cmd_name",
+		want:   "ab",
+		wantOK: true,
+	},
+	{
+		name: "full length",
+		v: struct {
+			Comm [4]int8 `ctyp:"char[4]" name:"comm"`
+		}{Comm: [4]int8{'b', 'a', 's', 'h'}},
+		field:  "comm",
+		want:   "bash",
+		wantOK: true,
+	},
+	{
+		name: "dynamic",
+		v: struct {
+			Filename []uint8 `ctyp:"__data_loc char[]" name:"filename"`
+		}{Filename: []byte("file.text\x00")},
+		field:  "filename",
+		want:   "file.text",
+		wantOK: true,
+	},
+	{
+		name: "not char",
+		v: struct {
+			Args [2]uint32 `ctyp:"u32[2]" name:"args"`
+		}{},
+		field:  "args",
+		wantOK: false,
+	},
+	{
+		name: "missing",
+		v: struct {
+			Comm [4]int8 `ctyp:"char[4]" name:"comm"`
+		}{},
+		field:  "cmd_name",
+		wantOK: false,
+	},
+}
+
+func TestCStringField(t *testing.T) {
+	for _, test := range cStringFieldTests {
+		got, ok := CStringField(reflect.ValueOf(test.v), test.field)
+		if ok != test.wantOK {
+			t.Errorf("unexpected ok for %q: got:%t want:%t", test.name, ok, test.wantOK)
+		}
+		if got != test.want {
+			t.Errorf("unexpected result for %q: got:%q want:%q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTimeField(t *testing.T) {
+	v := &struct {
+		Ts      uint64 `ctyp:"u64" name:"ts"`
+		Latency int64  `ctyp:"s64" name:"latency"`
+		Pid     int32  `ctyp:"int" name:"pid"`
+	}{
+		Ts:      1633046400123456789,
+		Latency: 1500,
+	}
+
+	got, ok := TimeField(reflect.ValueOf(v), "ts")
+	want := time.Date(2021, time.October, 1, 0, 0, 0, 123456789, time.UTC)
+	if !ok || !got.Equal(want) {
+		t.Errorf("unexpected time: got:%v ok:%t want:%v", got, ok, want)
+	}
+	d, ok := DurationField(reflect.ValueOf(v), "latency")
+	if !ok || d != 1500*time.Nanosecond {
+		t.Errorf("unexpected duration: got:%v ok:%t want:%v", d, ok, 1500*time.Nanosecond)
+	}
+	d, ok = DurationField(reflect.ValueOf(v), "ts")
+	if !ok || d != time.Duration(v.Ts) {
+		t.Errorf("unexpected timestamp duration: got:%v ok:%t", d, ok)
+	}
+
+	for _, field := range []string{"pid", "missing"} {
+		if _, ok := TimeField(reflect.ValueOf(v), field); ok {
+			t.Errorf("unexpected ok for time field %q", field)
+		}
+		if _, ok := DurationField(reflect.ValueOf(v), field); ok {
+			t.Errorf("unexpected ok for duration field %q", field)
+		}
+	}
+}
+
+func TestRetField(t *testing.T) {
+	const format = `name: myretprobe
+ID: 1766
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:unsigned long __probe_func;	offset:8;	size:8;	signed:0;
+	field:unsigned long __probe_ret_ip;	offset:16;	size:8;	signed:0;
+	field:u64 ret;	offset:24;	size:8;	signed:0;
+
+print fmt: "(%lx <- %lx) ret=0x%Lx", REC->__probe_func, REC->__probe_ret_ip, REC->ret
+`
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if !f.IsReturnProbe() {
+		t.Error("expected kretprobe format to be a return probe")
+	}
+	if f.NeedsUnpack() {
+		t.Error("unexpected unpacking requirement for kretprobe format")
+	}
+	entry, err := ParseFormat(strings.NewReader(unpackTests[0].format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	if entry.IsReturnProbe() {
+		t.Error("unexpected return probe for kprobe format")
+	}
+
+	data := make([]byte, 32)
+	machine.PutUint16(data[0:], 1766)
+	machine.PutUint64(data[8:], 0xffffffff81234560)
+	machine.PutUint64(data[16:], 0xffffffff81000010)
+	machine.PutUint64(data[24:], uint64(0xfffffffffffffffe)) // -ENOENT
+	v := reflect.NewAt(f.Type, unsafe.Pointer(&data[0]))
+	got, ok := RetField(v)
+	if !ok || got != -2 {
+		t.Errorf("unexpected return value: got:%d,%t want:-2,true", got, ok)
+	}
+	if got := Sprintkv(f, v); !strings.Contains(got, "__probe_func=18446744071581156704 ") {
+		t.Errorf("unexpected formatted event: %s", got)
+	}
+
+	for _, test := range []struct {
+		v      interface{}
+		want   int64
+		wantOK bool
+	}{
+		{v: struct {
+			Ret uint32 `name:"ret"`
+		}{Ret: 0xfffffff2}, want: -14, wantOK: true},
+		{v: struct {
+			Ret int32 `name:"ret"`
+		}{Ret: -1}, want: -1, wantOK: true},
+		{v: struct {
+			Ret uint16 `name:"ret"`
+		}{Ret: 3}, want: 3, wantOK: true},
+		{v: struct {
+			Ret [4]uint8 `name:"ret"`
+		}{}, wantOK: false},
+		{v: struct {
+			Arg1 uint64 `name:"arg1"`
+		}{}, wantOK: false},
+	} {
+		got, ok := RetField(reflect.ValueOf(test.v))
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("unexpected result for %T: got:%d,%t want:%d,%t", test.v, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestHexDumpField(t *testing.T) {
+	var format string
+	for _, test := range formatTests {
+		if test.name == "ath10k_htt_stats" {
+			format = test.format
+			break
+		}
+	}
+	if format == "" {
+		t.Fatal("missing ath10k_htt_stats format")
+	}
+	f, err := ParseFormat(strings.NewReader(format))
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	data := make([]byte, 48)
+	machine.PutUint32(data[8:], 28)
+	machine.PutUint32(data[12:], 28)
+	machine.PutUint64(data[16:], 20)
+	machine.PutUint32(data[24:], 20<<16|28)
+	copy(data[28:], "\x00\x01\x02\x03htt stats payload")
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+
+	got, ok := HexDumpField(dst, "buf")
+	if !ok {
+		t.Fatal("unexpected failure to dump buf")
+	}
+	want := "00000000  00 01 02 03 68 74 74 20  73 74 61 74 73 20 70 61  |....htt stats pa|\n" +
+		"00000010  79 6c 6f 61                                       |yloa|\n"
+	if got != want {
+		t.Errorf("unexpected hex dump:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	v := struct {
+		Name [4]int8 `ctyp:"char[4]" name:"name"`
+		Len  uint64  `ctyp:"size_t" name:"len"`
+	}{Name: [4]int8{'a', 'b', -1, 0}}
+	got, ok = HexDumpField(reflect.ValueOf(v), "name")
+	if !ok {
+		t.Fatal("unexpected failure to dump name")
+	}
+	want = "00000000  61 62 ff 00                                       |ab..|\n"
+	if got != want {
+		t.Errorf("unexpected hex dump of array:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	for _, field := range []string{"len", "missing"} {
+		if _, ok := HexDumpField(reflect.ValueOf(v), field); ok {
+			t.Errorf("unexpected success dumping %s", field)
+		}
+	}
+}
+
+func TestCStringFieldEncoding(t *testing.T) {
+	v := reflect.ValueOf(&struct {
+		Latin [8]int8 `ctyp:"char[8]" name:"latin"`
+		UTF   [8]int8 `ctyp:"char[8]" name:"utf"`
+		Value uint32  `ctyp:"u32" name:"value"`
+	}{
+		// "café" in Latin-1.
+		Latin: [8]int8{'c', 'a', 'f', -0x17, 0},
+		// "café" in UTF-8.
+		UTF: [8]int8{'c', 'a', 'f', -0x3d, -0x57, 0},
+	})
+	for _, test := range []struct {
+		field  string
+		enc    Encoding
+		want   string
+		wantOK bool
+	}{
+		{field: "latin", enc: Latin1, want: "café", wantOK: true},
+		{field: "latin", enc: UTF8, wantOK: false},
+		{field: "utf", enc: UTF8, want: "café", wantOK: true},
+		{field: "utf", enc: Latin1, want: "cafÃ©", wantOK: true},
+		{field: "value", enc: Latin1, wantOK: false},
+		{field: "missing", enc: Latin1, wantOK: false},
+		{field: "latin", enc: Encoding(-1), wantOK: false},
+	} {
+		got, ok := CStringFieldEncoding(v, test.field, test.enc)
+		if ok != test.wantOK {
+			t.Errorf("unexpected ok for %s with encoding %d: got:%t want:%t", test.field, test.enc, ok, test.wantOK)
+		}
+		if got != test.want {
+			t.Errorf("unexpected result for %s with encoding %d: got:%q want:%q", test.field, test.enc, got, test.want)
+		}
+	}
+}
+
+func TestFieldByCNameEmbedded(t *testing.T) {
+	test := unpackTests[0]
+	f, err := ParseFormat(strings.NewReader(test.format), EmbedCommonFields())
+	if err != nil {
+		t.Fatalf("unexpected error parsing format: %v", err)
+	}
+	dst := reflect.New(f.Unpacked)
+	err = f.Unpack(dst, test.data)
+	if err != nil {
+		t.Fatalf("unexpected error unpacking: %v", err)
+	}
+	for name, want := range map[string]interface{}{
+		"common_type": uint16(0x1bb2),
+		"common_pid":  int32(32705),
+	} {
+		got, ok := fieldByCName(dst, name)
+		if !ok {
+			t.Errorf("missing embedded field %s", name)
+			continue
+		}
+		if got.Interface() != want {
+			t.Errorf("unexpected value for %s: got:%#v want:%#v", name, got.Interface(), want)
+		}
+	}
+	if got, ok := CStringField(dst, "filename"); !ok || got != "file.text" {
+		t.Errorf("unexpected filename: got:%q ok:%t", got, ok)
+	}
+
+	// Direct fields take precedence over embedded fields.
+	v := struct {
+		CommonFields
+		Pid int64 `ctyp:"s64" name:"common_pid"`
+	}{CommonFields: CommonFields{Common_pid: 1}, Pid: 2}
+	if got, ok := DurationField(reflect.ValueOf(v), "common_pid"); !ok || got != 2 {
+		t.Errorf("unexpected direct field: got:%v ok:%t", got, ok)
+	}
+	if _, ok := fieldByCName(reflect.ValueOf(v), "common_flags"); !ok {
+		t.Error("missing embedded field common_flags")
+	}
+}